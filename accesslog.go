@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Access log
+//
+// With access_log, one line is written for each transaction that reaches the end of DATA, whether the message was
+// relayed or not, in the key=value style of Postfix's logs, e.g.
+//   2026-10-16T09:30:00Z session=3f9a1c0b7e22 client=192.0.2.1 user=alice from=<a@example.com> to=<b@example.net>,<c@example.net>
+//     size=1234 queue_id=4BQ2Xz0fLz status=250 response="2.0.0 Ok: queued as 4BQ2Xz0fLz"
+// (as one line). It's written whatever the verbose setting. session is the ID that prefixes the session's verbose log
+// lines, so a transaction can be followed from one to the other.
+//-----------------------------------------------------------------------------
+
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openAccessLog opens (appending to) the named file
+func openAccessLog(name string) (*accessLog, *os.File, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &accessLog{w: f}, f, nil
+}
+
+func (a *accessLog) write(line string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := io.WriteString(a.w, line+"\n")
+	return err
+}
+
+// queueIDPattern matches the queue ID in upstream responses such as "2.0.0 Ok: queued as ABC123", or
+// "2.0.0 OK id=1abcde-000123-XY" (Exim)
+var queueIDPattern = regexp.MustCompile(`(?i)\b(?:queued as|id=)\s*([A-Za-z0-9._-]+)`)
+
+// queueID returns the upstream queue ID given in an accepted DATA response, if it has one
+func queueID(resp string) string {
+	if m := queueIDPattern.FindStringSubmatch(resp); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// noteQueueID records the queue ID from an upstream's accepted DATA response, if it gives one
+func (s *Session) noteQueueID(resp string) {
+	if id := queueID(resp); id != "" {
+		s.logger("\tUpstream queue ID", id)
+		s.queueIDs = append(s.queueIDs, id)
+	}
+}
+
+// withQueueIDs adds the upstream queue IDs to a response the proxy makes up for the client, e.g. after relaying a
+// message in several transactions, so the message can still be traced across both hops
+func (s *Session) withQueueIDs(resp string) string {
+	if len(s.queueIDs) == 0 {
+		return resp
+	}
+	return resp + " (upstream queued as " + strings.Join(s.queueIDs, " ") + ")"
+}
+
+// logAccess writes the transaction's access log line, if access_log is enabled
+func (s *Session) logAccess(size int64, code int, msg string) {
+	if s.bkd.accessLog == nil {
+		return
+	}
+	to := make([]string, len(s.rcptto))
+	for i, r := range s.rcptto {
+		to[i] = "<" + r + ">"
+	}
+	line := fmt.Sprintf("%s session=%s client=%s user=%s from=<%s> to=%s size=%d queue_id=%s status=%d response=%s",
+		time.Now().UTC().Format(time.RFC3339), s.id, remoteHost(s.remoteAddr), s.authUser, s.mailfrom, strings.Join(to, ","),
+		size, strings.Join(s.queueIDs, ","), code, strconv.Quote(msg))
+	if err := s.bkd.accessLog.write(line); err != nil {
+		log.Println("Access log error", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Sender and recipient lists
+//
+// allow_senders and deny_rcpt name files of address patterns, one per line, with # comments:
+//   user@example.com   exactly this address
+//   @example.com       any address in the domain
+//   *@*.example.com    glob, with * and ? wildcards
+// The domain part is matched without regard to case. The null sender is written <>. With allow_senders, MAIL FROM
+// must match a pattern; with deny_rcpt, RCPT TO must not. Both are refused without contacting the upstream.
+//-----------------------------------------------------------------------------
+
+const addrListCode = 550
+const senderDeniedMsg = "5.7.1 Sender address not allowed"
+const rcptDeniedMsg = "5.7.1 Recipient address not allowed"
+
+type addrList []string
+
+// loadAddrList reads a file of address patterns. An empty file gives an empty list.
+func loadAddrList(file string) (addrList, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var l addrList
+	for i, line := range strings.Split(string(b), "\n") {
+		if c := strings.Index(line, "#"); c >= 0 {
+			line = line[:c]
+		}
+		p := strings.TrimSpace(line)
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", file, i+1, err)
+		}
+		l = append(l, normalizeAddr(p))
+	}
+	return l, nil
+}
+
+// normalizeAddr lower-cases the domain part of an address or pattern
+func normalizeAddr(addr string) string {
+	local, domain := splitAddress(addr)
+	if !strings.Contains(addr, "@") {
+		return addr
+	}
+	return local + "@" + strings.ToLower(domain)
+}
+
+// matches tells whether addr matches any pattern in the list
+func (l addrList) matches(addr string) bool {
+	if addr == "" {
+		addr = "<>"
+	}
+	addr = normalizeAddr(addr)
+	_, domain := splitAddress(addr)
+	for _, p := range l {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			if strings.Contains(addr, "@") && domain == p[1:] {
+				return true
+			}
+		case strings.ContainsAny(p, "*?["):
+			if ok, _ := path.Match(p, addr); ok {
+				return true
+			}
+		case p == addr:
+			return true
+		}
+	}
+	return false
+}
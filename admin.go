@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+//-----------------------------------------------------------------------------
+// Admin API
+//
+// With admin_addr, an HTTP listener accepts:
+//   POST /pause   new client connections get 421 in place of the greeting, and /readyz reports 503. With ?drain=1,
+//                 open sessions are also drained, as at shutdown: ended at once, or once their message is answered.
+//   POST /resume  connections are accepted again
+//   GET  /pause   reports whether the proxy is paused
+//   GET, DELETE /suppression  lists or clears the suppression list (see suppression.go)
+// The process keeps running throughout, e.g. for an upstream maintenance window. Bind it to a private address; with
+// admin_token, requests must also carry "Authorization: Bearer <token>".
+//-----------------------------------------------------------------------------
+
+const pausedCode = 421
+const pausedMsg = "4.3.2 Service not available, try again later"
+
+// isPaused tells whether new client connections are being refused
+func (bkd *Backend) isPaused() bool {
+	return atomic.LoadInt32(&bkd.paused) != 0
+}
+
+// pause refuses new client connections, and if drain is set, ends open sessions as they finish their message
+func (bkd *Backend) pause(drain bool) {
+	atomic.StoreInt32(&bkd.paused, 1)
+	if !drain {
+		log.Println("Paused: refusing new connections")
+		return
+	}
+	log.Println("Paused: refusing new connections, draining", bkd.drainAll(), "sessions")
+}
+
+func (bkd *Backend) resume() {
+	atomic.StoreInt32(&bkd.paused, 0)
+	log.Println("Resumed: accepting connections")
+}
+
+// adminAuthorized checks the request's bearer token, if admin_token is set
+func (bkd *Backend) adminAuthorized(r *http.Request) bool {
+	if bkd.adminToken == "" {
+		return true
+	}
+	got := []byte(r.Header.Get("Authorization"))
+	want := []byte("Bearer " + bkd.adminToken)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func (bkd *Backend) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	if !bkd.adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		bkd.pause(r.URL.Query().Get("drain") == "1")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"paused": bkd.isPaused()})
+}
+
+func (bkd *Backend) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	if !bkd.adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bkd.resume()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"paused": bkd.isPaused()})
+}
+
+// serveAdmin runs the admin HTTP listener on addr
+func (bkd *Backend) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pause", bkd.pauseHandler)
+	mux.HandleFunc("/resume", bkd.resumeHandler)
+	if bkd.suppression != nil {
+		mux.HandleFunc("/suppression", bkd.suppressionHandler)
+	}
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Upstream AUTH failure alarm
+//
+// A single client getting its password wrong is its own business. When the upstream rejects AUTH consistently across
+// several different users, the likely cause is the upstream side (expired or revoked credentials, account suspended),
+// so raise one prominent, rate-limited alert rather than a stream of individual errors.
+//-----------------------------------------------------------------------------
+
+type authAlarm struct {
+	threshold int           // consecutive failures needed to raise the alarm
+	interval  time.Duration // minimum time between alerts
+	webhook   string        // optional URL to POST alerts to
+
+	mu          sync.Mutex
+	consecutive int
+	who         map[string]bool // distinct users (or client hosts, if user unknown) in the current failure run
+	lastCode    int
+	lastMsg     string
+	lastAlert   time.Time
+}
+
+// authAlert is the payload sent to the ops webhook
+type authAlert struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Failures    int       `json:"consecutive_failures"`
+	Distinct    int       `json:"distinct_users"`
+	Upstream    string    `json:"upstream"`
+	LastCode    int       `json:"last_code"`
+	LastMessage string    `json:"last_message"`
+}
+
+// record the outcome of an upstream AUTH attempt on behalf of who
+func (a *authAlarm) record(who string, ok bool, code int, msg string, upstream string) {
+	if a == nil || a.threshold <= 0 {
+		return
+	}
+	a.mu.Lock()
+	if ok {
+		a.consecutive = 0
+		a.who = nil
+		a.mu.Unlock()
+		return
+	}
+	a.consecutive++
+	if a.who == nil {
+		a.who = make(map[string]bool)
+	}
+	a.who[who] = true
+	a.lastCode, a.lastMsg = code, msg
+	fire := a.consecutive >= a.threshold && len(a.who) >= 2 && time.Since(a.lastAlert) >= a.interval
+	var alert authAlert
+	if fire {
+		a.lastAlert = time.Now()
+		alert = authAlert{
+			Time:        a.lastAlert,
+			Event:       "upstream_auth_failing",
+			Failures:    a.consecutive,
+			Distinct:    len(a.who),
+			Upstream:    upstream,
+			LastCode:    a.lastCode,
+			LastMessage: a.lastMsg,
+		}
+	}
+	a.mu.Unlock()
+
+	if fire {
+		log.Printf("ALERT: upstream %s rejected AUTH %d times in a row for %d different users (last: %d %s) - upstream credentials may be invalid or expired",
+			upstream, alert.Failures, alert.Distinct, alert.LastCode, alert.LastMessage)
+		if a.webhook != "" {
+			go postJSON(a.webhook, alert)
+		}
+	}
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// postJSON sends v to url, logging any failure
+func postJSON(url string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Webhook error", err)
+		return
+	}
+	res, err := webhookClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Println("Webhook error", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Println("Webhook", url, "returned", res.Status)
+	}
+}
+
+// authIdentity returns who to attribute an AUTH attempt to: the username if known, otherwise the client host
+func (s *Session) authIdentity(user string) string {
+	if user != "" {
+		return user
+	}
+	return remoteHost(s.remoteAddr)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Client network allow list
+//
+// With allow_networks, a comma-separated list of IPv4 and IPv6 CIDRs (a bare address means just that host), clients
+// from elsewhere are refused as soon as they connect, before any TLS or AUTH, with a 554 in place of the greeting.
+// The address checked is the real client's with proxy_protocol. IPv4-mapped IPv6 addresses (::ffff:192.0.2.1), as
+// seen on dual-stack listeners, match the IPv4 networks.
+//-----------------------------------------------------------------------------
+
+const networkDeniedCode = 554
+const networkDeniedMsg = "5.7.1 Client host not allowed"
+
+type networkList []*net.IPNet
+
+// parseNetworks parses a comma-separated list of CIDRs and addresses
+func parseNetworks(list string) (networkList, error) {
+	var l networkList
+	for _, n := range strings.Split(list, ",") {
+		if n = strings.TrimSpace(n); n == "" {
+			continue
+		}
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %q", n)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			l = append(l, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, ipNet)
+	}
+	return l, nil
+}
+
+// allows tells whether the address a is in one of the networks. An empty list allows everything.
+func (l networkList) allows(a net.Addr) bool {
+	if len(l) == 0 {
+		return true
+	}
+	host := remoteHost(a)
+	if zone := strings.IndexByte(host, '%'); zone >= 0 {
+		host = host[:zone] // e.g. fe80::1%eth0
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4 // match ::ffff:a.b.c.d against IPv4 networks
+	}
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
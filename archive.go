@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+//-----------------------------------------------------------------------------
+// Archive relay
+//
+// The X-MSYS-API archive header only means something to SparkPost. For other upstreams, archive_relay sends a full
+// duplicate of each message, in its own transaction, to a separate archive MX once the primary relay has accepted it.
+//
+// The copy goes to the original envelope recipients, or to archive_relay_rcpt. archive_map can choose the archive
+// recipient by sender domain instead: a file of "domain address" lines, with # comments, where a domain also covers
+// its subdomains. Senders in unlisted domains fall back to archive_relay_rcpt.
+//
+// With archive_mode rcpt, no separate copy is made. The archive recipient (archive_relay_rcpt, or from archive_map)
+// is instead added as an extra RCPT TO in each upstream transaction, as a blind copy: it appears only in the envelope,
+// never in the message headers, the proxy's logs of recipients, or the response to the client. Split messages are
+// archived once per copy.
+//
+// The default mode is relay, not header: the proxy never adds an X-MSYS-API archive header itself, so there is no
+// header mode to select. SparkPost users can still archive with the client's own header, which passes through unless
+// strip_msys_api is set.
+//-----------------------------------------------------------------------------
+
+// Archive modes
+const (
+	archiveModeRelay = "relay" // Duplicate each message to archive_relay
+	archiveModeRcpt  = "rcpt"  // Add the archive recipient to each upstream transaction
+)
+
+var archiveModes = []string{archiveModeRelay, archiveModeRcpt}
+
+// With archive_relay_required, the archive copy is sent first, and the primary is only relayed if that succeeded.
+// The reverse order can't be undone: once the upstream has accepted a message, it's gone. The cost is that if the
+// primary then fails, the archive holds a message that was never delivered.
+const archiveFailCode = 451
+const archiveFailMsg = "4.3.0 Unable to archive message, not relayed, try again later"
+
+type archiveMapping struct {
+	domain string
+	rcpt   string
+}
+
+// loadArchiveMap reads an archive_map file
+func loadArchiveMap(file string) ([]archiveMapping, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var m []archiveMapping
+	for i, line := range strings.Split(string(b), "\n") {
+		if c := strings.Index(line, "#"); c >= 0 {
+			line = line[:c]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 || !strings.Contains(f[1], "@") {
+			return nil, fmt.Errorf("%s line %d: not domain address", file, i+1)
+		}
+		m = append(m, archiveMapping{domain: strings.ToLower(strings.Trim(f[0], ".")), rcpt: f[1]})
+	}
+	return m, nil
+}
+
+// archiveRcptFor returns the archive recipient for messages from sender, or "" for the original recipients
+func (bkd *Backend) archiveRcptFor(sender string) string {
+	_, domain := splitAddress(sender)
+	domain = strings.ToLower(domain)
+	for _, m := range bkd.archiveMap {
+		if domain == m.domain || strings.HasSuffix(domain, "."+m.domain) {
+			return m.rcpt
+		}
+	}
+	return bkd.archiveRelayRcpt
+}
+
+// archiving tells whether messages are duplicated to an archive relay
+func (s *Session) archiving() bool {
+	return s.bkd.archiveMode == archiveModeRelay && s.bkd.archiveRelay != ""
+}
+
+// addArchiveRcpt adds the archive recipient to the upstream transaction, with archive_mode rcpt. Returns a non-zero
+// code if it was refused and archive_relay_required is set.
+func (s *Session) addArchiveRcpt() (int, string, error) {
+	if s.bkd.archiveMode != archiveModeRcpt {
+		return 0, "", nil
+	}
+	rcpt := s.bkd.archiveRcptFor(s.mailfrom)
+	if rcpt == "" {
+		return 0, "", nil
+	}
+	code, msg, err := s.Passthru(25, "RCPT", "TO:<"+rcpt+">")
+	if err == nil {
+		return 0, "", nil
+	}
+	s.archiveFailed(fmt.Errorf("archive recipient refused: %d %s", code, msg))
+	if !s.bkd.archiveRelayRequired {
+		return 0, "", nil
+	}
+	return archiveFailCode, archiveFailMsg, errors.New(archiveFailMsg)
+}
+
+// archiveFailed logs and counts an archive relay failure
+func (s *Session) archiveFailed(err error) {
+	atomic.AddInt64(&s.bkd.archiveFailures, 1)
+	if s.bkd.archiveRelayRequired {
+		log.Println("Archive relay failed, message rejected:", err, "correlation ID:", s.correlationID)
+	} else {
+		log.Println("Archive relay failed, primary delivery unaffected:", err, "correlation ID:", s.correlationID)
+	}
+}
+
+// archiveCopy relays msg to the archive relay. Recipients are the original envelope, unless archive_relay_rcpt is set.
+func (s *Session) archiveCopy(msg []byte) error {
+	rcpts := s.rcptto
+	if rcpt := s.bkd.archiveRcptFor(s.mailfrom); rcpt != "" {
+		rcpts = []string{rcpt}
+	}
+	addr := s.bkd.archiveRelay
+	s.logger("---Connecting to archive relay", addr)
+	c, err := s.bkd.dialRelay(addr)
+	if err != nil {
+		return fmt.Errorf("archive relay: %v", err)
+	}
+	defer c.Close()
+	if code, msg, err := c.MyCmd(250, "MAIL FROM:<%s>", s.mailfrom); err != nil {
+		return fmt.Errorf("archive relay MAIL: %d %s %v", code, msg, err)
+	}
+	accepted := 0
+	for _, rcpt := range rcpts {
+		code, msg, err := c.MyCmd(25, "RCPT TO:<%s>", rcpt)
+		if err != nil {
+			s.logger("\tArchive relay refused recipient", rcpt, code, msg)
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return errors.New("archive relay accepted no recipients")
+	}
+	code, m, err := s.sendData(c, msg)
+	if err != nil {
+		return fmt.Errorf("archive relay DATA: %d %s %v", code, m, err)
+	}
+	s.logger("\tArchive relay accepted copy:", code, m)
+	c.Quit()
+	return nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// Upstream authentication, when the proxy handles AUTH itself rather than passing it through
+//-----------------------------------------------------------------------------
+
+// Upstream AUTH modes. Other than passthru, the proxy decodes the client's credentials and authenticates upstream itself.
+const (
+	authPassthru = ""         // Relay the client's AUTH exchange unchanged
+	authAuto     = "auto"     // Choose the strongest mechanism the upstream offers
+	authPlain    = "plain"    // Always use PLAIN
+	authLogin    = "login"    // Always use LOGIN
+	authCRAMMD5  = "cram-md5" // Always use CRAM-MD5
+	authXOAuth2  = "xoauth2"  // Always use XOAUTH2, with the client's password as the access token
+)
+
+var upstreamAuthModes = []string{authPassthru, authAuto, authPlain, authLogin, authCRAMMD5, authXOAuth2}
+
+// Mechanisms the proxy can decode credentials from, and so offers to clients when handling AUTH itself
+var inboundAuthMechs = []string{"PLAIN", "LOGIN", "XOAUTH2"}
+
+// Upstream mechanism preferences, strongest first
+var passwordMechPrefs = []string{"CRAM-MD5", "PLAIN", "LOGIN"}
+var tokenMechPrefs = []string{"XOAUTH2"}
+
+// credentials gathered from the client's AUTH exchange
+type credentials struct {
+	user    string
+	secret  string
+	token   bool // secret is an OAuth2 bearer token rather than a password
+	refresh bool // secret is the service account's token, renewed by token_refresh_cmd
+}
+
+// withCurrentToken returns cr with the service account's current token, if it's one that token_refresh_cmd renews
+func (bkd *Backend) withCurrentToken(cr credentials) credentials {
+	if cr.refresh && bkd.tokens != nil {
+		cr.secret = bkd.tokens.current()
+	}
+	return cr
+}
+
+const insecureAuthCode = 538
+const insecureAuthMsg = "5.7.11 Encryption required for requested authentication mechanism"
+
+// insecureAuth tells whether a client AUTH must be refused because the connection isn't encrypted, per
+// allow_insecure_auth
+func (s *Session) insecureAuth() bool {
+	if s.bkd.allowInsecureAuth {
+		return false
+	}
+	if s.conn != nil {
+		if _, ok := s.conn.inboundTLS(); ok {
+			return false
+		}
+	}
+	return true
+}
+
+const upstreamMechCode = 454
+const upstreamMechMsg = "4.7.0 Upstream authentication mechanism unavailable"
+
+// authReplayFunc repeats a successful upstream AUTH exchange on a new upstream connection
+type authReplayFunc func(c *smtpproxy.Client) (int, string, error)
+
+// advertiseAuth replaces the upstream's AUTH capability with the mechanisms the proxy can accept from clients
+func advertiseAuth(caps []string) []string {
+	var out []string
+	for _, c := range caps {
+		if ok, _ := capability([]string{c}, "AUTH"); ok {
+			c = "AUTH " + strings.Join(inboundAuthMechs, " ")
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// chooseAuthMech returns the strongest mechanism offered by the upstream that suits the credentials, falling back to PLAIN
+func chooseAuthMech(caps []string, cr credentials) string {
+	_, params := capability(caps, "AUTH")
+	offered := strings.Fields(strings.ToUpper(params))
+	prefs := passwordMechPrefs
+	if cr.token {
+		prefs = tokenMechPrefs
+	}
+	for _, m := range prefs {
+		if Contains(offered, m) {
+			return m
+		}
+	}
+	return "PLAIN"
+}
+
+// upstreamMech returns the mechanism to authenticate upstream with, per upstream_auth. A mechanism set explicitly
+// must be one the upstream offers.
+func (bkd *Backend) upstreamMech(caps []string, cr *credentials) (string, error) {
+	if bkd.upstreamAuth == authAuto {
+		return chooseAuthMech(caps, *cr), nil
+	}
+	mech := strings.ToUpper(bkd.upstreamAuth)
+	if mech == "XOAUTH2" {
+		cr.token = true
+	}
+	_, params := capability(caps, "AUTH")
+	if !Contains(strings.Fields(strings.ToUpper(params)), mech) {
+		return mech, fmt.Errorf("upstream does not offer AUTH %s (offers: %s)", mech, params)
+	}
+	return mech, nil
+}
+
+// proxyAuth handles the client side of an AUTH exchange, then authenticates upstream with the decoded credentials
+func (s *Session) proxyAuth(cmd, arg string) (int, string, error) {
+	var resp string
+	if s.authPending == "" {
+		f := strings.Fields(arg)
+		if len(f) == 0 {
+			return 501, "5.5.4 Syntax error in AUTH parameters", errors.New("AUTH without mechanism")
+		}
+		mech := strings.ToUpper(f[0])
+		s.logger(cmdTwiddle(s), cmd, mech, "(credentials redacted)")
+		if !Contains(inboundAuthMechs, mech) {
+			return 504, "5.5.4 Unrecognized authentication type", errors.New("unsupported AUTH mechanism " + mech)
+		}
+		s.authPending = mech
+		s.authLoginUser = ""
+		if len(f) < 2 {
+			return authChallenge(mech)
+		}
+		resp = f[1]
+	} else {
+		resp = strings.TrimSpace(cmd + " " + arg) // continuation line from the client
+	}
+	if resp == "*" {
+		s.authPending = ""
+		return 501, "5.0.0 Authentication cancelled", errors.New("AUTH cancelled by client")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		s.authPending = ""
+		return 501, "5.5.2 Cannot decode response", err
+	}
+
+	var cr credentials
+	switch s.authPending {
+	case "PLAIN":
+		parts := strings.Split(string(decoded), "\x00")
+		if len(parts) != 3 {
+			s.authPending = ""
+			return 501, "5.5.2 Malformed PLAIN response", errors.New("malformed AUTH PLAIN response")
+		}
+		cr = credentials{user: parts[1], secret: parts[2]}
+	case "LOGIN":
+		if s.authLoginUser == "" {
+			s.authLoginUser = string(decoded)
+			return 334, base64.StdEncoding.EncodeToString([]byte("Password:")), nil
+		}
+		cr = credentials{user: s.authLoginUser, secret: string(decoded)}
+	case "XOAUTH2":
+		user, token, ok := parseXOAuth2(string(decoded))
+		if !ok {
+			s.authPending = ""
+			return 501, "5.5.2 Malformed XOAUTH2 response", errors.New("malformed AUTH XOAUTH2 response")
+		}
+		cr = credentials{user: user, secret: token, token: true}
+	}
+	s.authPending = ""
+	if code, msg, err := s.loginAllowed(cr.user); err != nil {
+		return code, msg, err
+	}
+	if s.bkd.localUsers != nil {
+		if code, msg, err := s.checkLocalUser(cr); err != nil {
+			s.loginDone(false)
+			return code, msg, err
+		}
+	}
+	up := cr
+	if s.bkd.serviceCreds != nil {
+		up = s.bkd.withCurrentToken(*s.bkd.serviceCreds)
+	}
+	code, msg, err := s.upstreamLogin(up)
+	s.loginDone(err == nil)
+	if err == nil {
+		s.authUser = cr.user // the client, even when upstream knows it as the service account
+	}
+	return code, msg, err
+}
+
+// plainAuthUser returns the username from an AUTH PLAIN command argument carrying an initial response
+func plainAuthUser(arg string) (string, bool) {
+	f := strings.Fields(arg)
+	if len(f) != 2 || !strings.EqualFold(f[0], "PLAIN") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(f[1])
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(string(decoded), "\x00")
+	if len(parts) != 3 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// relayedAuthUser follows an AUTH exchange relayed to the upstream, returning the username if this line is the one
+// that carries it: a PLAIN response, whether initial or on a continuation line, or the first LOGIN response. Other
+// mechanisms don't reveal the username.
+func (s *Session) relayedAuthUser(cmd, arg string) string {
+	resp := strings.TrimSpace(arg)
+	if strings.EqualFold(cmd, "AUTH") {
+		f := strings.Fields(arg)
+		s.authRelayMech, s.authRelayUser, resp = "", "", ""
+		if len(f) > 0 {
+			s.authRelayMech = strings.ToUpper(f[0])
+		}
+		if len(f) > 1 {
+			resp = f[1]
+		}
+	}
+	if resp == "" || resp == "=" || resp == "*" || s.authRelayUser != "" {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return ""
+	}
+	switch s.authRelayMech {
+	case "PLAIN":
+		if parts := strings.Split(string(decoded), "\x00"); len(parts) == 3 {
+			s.authRelayUser = parts[1]
+		}
+	case "LOGIN":
+		s.authRelayUser = string(decoded)
+	}
+	return s.authRelayUser
+}
+
+// authChallenge returns the initial server challenge for a mechanism where the client gave no initial response
+func authChallenge(mech string) (int, string, error) {
+	if mech == "LOGIN" {
+		return 334, base64.StdEncoding.EncodeToString([]byte("Username:")), nil
+	}
+	return 334, "", nil
+}
+
+// parseXOAuth2 extracts the user and bearer token from a decoded XOAUTH2 initial response
+func parseXOAuth2(s string) (string, string, bool) {
+	var user, token string
+	for _, kv := range strings.Split(s, "\x01") {
+		switch {
+		case strings.HasPrefix(kv, "user="):
+			user = strings.TrimPrefix(kv, "user=")
+		case strings.HasPrefix(kv, "auth="):
+			auth := strings.TrimPrefix(kv, "auth=")
+			if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+				token = auth[7:]
+			}
+		}
+	}
+	return user, token, user != "" && token != ""
+}
+
+// upstreamLogin authenticates to the upstream server with the client's credentials, logging the chosen mechanism
+func (s *Session) upstreamLogin(cr credentials) (int, string, error) {
+	if s.bkd.sink {
+		s.authUser = cr.user
+		return 235, "2.7.0 Authentication successful", nil
+	}
+	key := poolKey(cr.user, cr.secret)
+	if s.fromPool(key) {
+		s.authUser = cr.user
+		s.authReplay = func(c *smtpproxy.Client) (int, string, error) {
+			cr = s.bkd.withCurrentToken(cr)
+			mech, err := s.bkd.upstreamMech(c.Capabilities(), &cr)
+			if err != nil {
+				return upstreamMechCode, upstreamMechMsg, err
+			}
+			return saslAuth(c, mech, cr)
+		}
+		return 235, "2.7.0 Authentication successful", nil
+	}
+	mech, err := s.bkd.upstreamMech(s.caps, &cr)
+	if err != nil {
+		log.Println("Upstream AUTH not possible:", err)
+		return upstreamMechCode, upstreamMechMsg, err
+	}
+	s.logger("\tUpstream AUTH mechanism chosen:", mech)
+	s.logger(cmdTwiddle(s), "AUTH", mech, "(credentials redacted)")
+	if s.blockUpstream {
+		s.logger("\t", upstreamBlockMsg)
+		return upstreamBlockCode, "4.0.0 " + upstreamBlockMsg, errors.New(upstreamBlockMsg)
+	}
+	code, msg, err := saslAuth(s.upstream, mech, cr)
+	s.logger(respTwiddle(s), code, msg)
+	cr, code, msg, err = s.refreshedLogin(mech, cr, code, msg, err)
+	s.bkd.authAlarm.record(s.authIdentity(cr.user), err == nil, code, msg, s.upstreamHost)
+	if err == nil {
+		s.authUser = cr.user
+		s.poolKey = key
+		s.authReplay = func(c *smtpproxy.Client) (int, string, error) {
+			return saslAuth(c, mech, s.bkd.withCurrentToken(cr))
+		}
+	}
+	return code, msg, err
+}
+
+// saslAuth runs the client side of the given SASL mechanism against the upstream server
+func saslAuth(c *smtpproxy.Client, mech string, cr credentials) (int, string, error) {
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	switch mech {
+	case "CRAM-MD5":
+		code, msg, err := c.MyCmd(334, "AUTH CRAM-MD5")
+		if err != nil {
+			return code, msg, err
+		}
+		challenge, err := base64.StdEncoding.DecodeString(msg)
+		if err != nil {
+			c.MyCmd(501, "*") // abandon the exchange
+			return 454, "4.7.0 Upstream sent an invalid CRAM-MD5 challenge", err
+		}
+		h := hmac.New(md5.New, []byte(cr.secret))
+		h.Write(challenge)
+		return c.MyCmd(235, "%s", b64(cr.user+" "+hex.EncodeToString(h.Sum(nil))))
+
+	case "LOGIN":
+		if code, msg, err := c.MyCmd(334, "AUTH LOGIN"); err != nil {
+			return code, msg, err
+		}
+		if code, msg, err := c.MyCmd(334, "%s", b64(cr.user)); err != nil {
+			return code, msg, err
+		}
+		return c.MyCmd(235, "%s", b64(cr.secret))
+
+	case "XOAUTH2":
+		code, msg, err := c.MyCmd(235, "AUTH XOAUTH2 %s", b64("user="+cr.user+"\x01auth=Bearer "+cr.secret+"\x01\x01"))
+		if code == 334 {
+			// Server sent a JSON error challenge; an empty response fetches the final failure code
+			return c.MyCmd(235, "")
+		}
+		return code, msg, err
+
+	default:
+		return c.MyCmd(235, "AUTH PLAIN %s", b64("\x00"+cr.user+"\x00"+cr.secret))
+	}
+}
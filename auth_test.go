@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestRelayedAuthUser(t *testing.T) {
+	type line struct{ cmd, arg string }
+	cases := []struct {
+		name  string
+		lines []line
+		want  []string // username returned for each line
+	}{
+		{"PLAIN initial response", []line{{"AUTH", "PLAIN " + b64("\x00alice\x00secret")}}, []string{"alice"}},
+		{"PLAIN continuation", []line{{"AUTH", "PLAIN"}, {"", b64("\x00alice\x00secret")}}, []string{"", "alice"}},
+		{"LOGIN", []line{{"AUTH", "LOGIN"}, {"", b64("alice")}, {"", b64("secret")}}, []string{"", "alice", ""}},
+		{"LOGIN initial response", []line{{"AUTH", "LOGIN " + b64("alice")}, {"", b64("secret")}}, []string{"alice", ""}},
+		{"cancelled", []line{{"AUTH", "LOGIN"}, {"", "*"}}, []string{"", ""}},
+		{"CRAM-MD5", []line{{"AUTH", "CRAM-MD5"}, {"", b64("alice 0123456789abcdef")}}, []string{"", ""}},
+		{"new exchange", []line{{"AUTH", "LOGIN " + b64("alice")}, {"AUTH", "LOGIN"}, {"", b64("bob")}}, []string{"alice", "", "bob"}},
+	}
+	for _, tc := range cases {
+		s := &Session{}
+		for i, l := range tc.lines {
+			if got := s.relayedAuthUser(l.cmd, l.arg); got != tc.want[i] {
+				t.Errorf("%s: line %d: got %q, want %q", tc.name, i, got, tc.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Bounce classification: upstream rejections mapped to categories, for bounce handling and suppression
+//-----------------------------------------------------------------------------
+
+// Bounce categories
+const (
+	bounceUserUnknown  = "user_unknown" // Hard: the mailbox doesn't exist
+	bounceMailboxFull  = "mailbox_full" // Soft: over quota
+	bounceSpamBlock    = "spam_block"   // Content or sender reputation judged as spam
+	bouncePolicy       = "policy"       // Refused by policy, e.g. authentication (SPF, DKIM, DMARC) or relay denied
+	bounceRateLimited  = "rate_limited" // Soft: sending too fast
+	bounceHard         = "hard"         // Other permanent failures
+	bounceSoft         = "soft"         // Other temporary failures
+	bounceUndetermined = "undetermined" // No response, e.g. the upstream couldn't be reached
+)
+
+type bounceRule struct {
+	category string
+	re       *regexp.Regexp // Matched against the lower-cased response text, including any enhanced status code
+}
+
+// bounceRules are tried in order; the first match wins. Text is checked before enhanced status codes, as providers
+// often use a generic code (e.g. 5.7.1) with a more specific explanation. Policy refusals are checked before unknown
+// users, as they often say "Recipient address rejected" too (e.g. Postfix access and greylisting rules), and must not
+// be mistaken for hard bounces. Generic words such as "not found" or "disabled" only count with a 5.1.x code.
+var bounceRules = []bounceRule{
+	{bounceSpamBlock, regexp.MustCompile(`spam|blocklist|blacklist|block list|black list|spamhaus|reputation|junk`)},
+	{bounceMailboxFull, regexp.MustCompile(`mailbox (is )?full|over ?quota|quota exceeded|insufficient (disk )?space|storage`)},
+	{bounceRateLimited, regexp.MustCompile(`rate limit|too many|throttl|try again later|slow down`)},
+	{bouncePolicy, regexp.MustCompile(`spf|dkim|dmarc|policy|relay(ing)? (access )?denied|access denied|greylist|not permitted|authentication required|unauthenticated`)},
+	{bouncePolicy, regexp.MustCompile(`\b[45]\.7\.\d+\b`)},
+	{bounceUserUnknown, regexp.MustCompile(`user unknown|unknown user|no such (user|mailbox|recipient)|(user|mailbox|recipient|account) (does not|doesn't) exist|invalid (recipient|mailbox)|mailbox unavailable`)},
+	{bounceUserUnknown, regexp.MustCompile(`\b5\.1\.(1|10)\b`)},
+	{bounceMailboxFull, regexp.MustCompile(`\b[45]\.2\.2\b`)},
+}
+
+// classifyBounce returns the category of an upstream rejection
+func classifyBounce(code int, msg string) string {
+	if code == 0 {
+		return bounceUndetermined
+	}
+	text := strings.ToLower(msg)
+	for _, r := range bounceRules {
+		if r.re.MatchString(text) {
+			return r.category
+		}
+	}
+	if code >= 500 {
+		return bounceHard
+	}
+	return bounceSoft
+}
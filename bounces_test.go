@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestClassifyBounce(t *testing.T) {
+	cases := []struct {
+		code int
+		msg  string
+		want string
+	}{
+		{550, "5.1.1 <a@example.net>: Recipient address rejected: User unknown in virtual mailbox table", bounceUserUnknown},
+		{550, "5.1.1 The email account that you tried to reach does not exist", bounceUserUnknown},
+		{550, "No such user here", bounceUserUnknown},
+		{550, "5.1.1 <a@example.net>: Recipient address rejected", bounceUserUnknown},
+		{550, "5.1.10 Recipient not found", bounceUserUnknown},
+		{550, "Requested action not taken: mailbox unavailable", bounceUserUnknown},
+		{554, "5.7.1 <a@example.net>: Recipient address rejected: Access denied", bouncePolicy},
+		{450, "4.2.0 <a@example.net>: Recipient address rejected: Greylisted, see http://postgrey.schweikert.ch/", bouncePolicy},
+		{550, "5.7.1 Recipient address rejected: account disabled for abuse", bouncePolicy},
+		{550, "5.7.1 Mailbox inactive", bouncePolicy},
+		{550, "5.7.26 Unauthenticated email is not accepted due to DMARC policy", bouncePolicy},
+		{550, "5.1.8 <s@example.com>: Sender address rejected: Domain not found", bounceHard},
+		{450, "4.1.2 <a@example.net>: Recipient address rejected: Domain not found", bounceSoft},
+		{451, "4.4.0 Host not found", bounceSoft},
+		{550, "Account disabled", bounceHard},
+		{552, "5.2.2 Mailbox full", bounceMailboxFull},
+		{554, "5.7.1 Message rejected as spam", bounceSpamBlock},
+		{421, "4.7.0 Too many connections, slow down", bounceRateLimited},
+		{554, "Transaction failed", bounceHard},
+		{451, "Local error in processing", bounceSoft},
+		{0, "", bounceUndetermined},
+	}
+	for _, tc := range cases {
+		if got := classifyBounce(tc.code, tc.msg); got != tc.want {
+			t.Errorf("classifyBounce(%d, %q) = %s, want %s", tc.code, tc.msg, got, tc.want)
+		}
+	}
+}
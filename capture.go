@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Per-session capture of the inbound SMTP conversation, for diagnosing client incompatibilities.
+//
+// Each captured session gets its own file in capture_dir, named by session ID. The capture comes from the server's
+// debug transcript, so it holds both directions as plain text, including after STARTTLS.
+//
+// debug_dir is the unfiltered equivalent of server_debug: every connection's transcript goes to its own file, named by
+// start time, client IP and session ID, so they sort by time and concurrent conversations aren't interleaved.
+//-----------------------------------------------------------------------------
+
+// newSessionID returns a short random identifier for a session
+func newSessionID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%012x", time.Now().UnixNano()&0xffffffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// sessionCapture is an open capture file for one session
+type sessionCapture struct {
+	*os.File
+	filter []string // keep the capture only if the client IP or user is listed; empty = keep all
+}
+
+// openCapture starts a capture for the session, if capturing is enabled
+func (bkd *Backend) openCapture(id string, remote net.Addr) *sessionCapture {
+	if bkd.captureDir == "" {
+		return nil
+	}
+	host := remoteHost(remote)
+	if len(bkd.captureFilter) > 0 && !bkd.captureUsers && !Contains(bkd.captureFilter, host) {
+		return nil // filtered on IP only, and this one doesn't match
+	}
+	f, err := os.Create(filepath.Join(bkd.captureDir, id+".smtp"))
+	if err != nil {
+		log.Println("Capture error", err)
+		return nil
+	}
+	fmt.Fprintf(f, "# session %s client %s started %s\n", id, host, time.Now().Format(time.RFC3339))
+	return &sessionCapture{File: f, filter: bkd.captureFilter}
+}
+
+// openDebugFile starts a connection's debug transcript in debug_dir, if set
+func (bkd *Backend) openDebugFile(id string, remote net.Addr) *os.File {
+	if bkd.debugDir == "" {
+		return nil
+	}
+	host := strings.NewReplacer(":", "-", "%", "-").Replace(remoteHost(remote)) // IPv6, safe in file names
+	name := fmt.Sprintf("%s_%s_%s.smtp", time.Now().UTC().Format("20060102T150405Z"), host, id)
+	f, err := os.Create(filepath.Join(bkd.debugDir, name))
+	if err != nil {
+		log.Println("Debug transcript error", err)
+		return nil
+	}
+	return f
+}
+
+// finish closes the capture, discarding it if neither the client IP nor the authenticated user match the filter
+func (c *sessionCapture) finish(remote net.Addr, user string) {
+	c.Close()
+	if len(c.filter) > 0 && !Contains(c.filter, remoteHost(remote)) && (user == "" || !Contains(c.filter, user)) {
+		os.Remove(c.Name())
+	}
+}
+
+// parseCaptureFilter splits a comma-separated list of IPs and usernames. The second return is true if any entry
+// isn't an IP, meaning we can only decide whether to keep a capture once the session has authenticated.
+func parseCaptureFilter(list string) ([]string, bool) {
+	var out []string
+	users := false
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if net.ParseIP(f) == nil {
+			users = true
+		}
+		out = append(out, f)
+	}
+	return out, users
+}
+
+// remoteHost returns the IP part of a client address
+func remoteHost(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return a.String()
+	}
+	return host
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// Upstream certificate expiry warnings
+//-----------------------------------------------------------------------------
+
+const certWarnInterval = 24 * time.Hour // Per host
+
+// certWatch tracks the expiry of upstream server certificates
+type certWatch struct {
+	warnDays int // Warn when a certificate expires within this many days, 0 = don't warn
+	mu       sync.Mutex
+	expiry   map[string]time.Time // Leaf certificate NotAfter, as last seen per host
+	warned   map[string]time.Time // When each host was last warned about
+}
+
+// check notes the expiry of host's certificate from a TLS connection, warning if it's close
+func (w *certWatch) check(host string, cs tls.ConnectionState) {
+	if len(cs.PeerCertificates) == 0 {
+		return
+	}
+	notAfter := cs.PeerCertificates[0].NotAfter
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.expiry == nil {
+		w.expiry = make(map[string]time.Time)
+		w.warned = make(map[string]time.Time)
+	}
+	w.expiry[host] = notAfter
+	if w.warnDays <= 0 || notAfter.Sub(now) > time.Duration(w.warnDays)*24*time.Hour {
+		return
+	}
+	if now.Sub(w.warned[host]) < certWarnInterval {
+		return
+	}
+	w.warned[host] = now
+	log.Printf("Warning: upstream %s certificate expires %s (in %.1f days)\n", host, notAfter.Format(time.RFC3339), notAfter.Sub(now).Hours()/24)
+}
+
+// nearest returns the upstream host whose certificate expires soonest, and when
+func (w *certWatch) nearest() (string, time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var (
+		host string
+		t    time.Time
+	)
+	for h, e := range w.expiry {
+		if host == "" || e.Before(t) {
+			host, t = h, e
+		}
+	}
+	return host, t
+}
+
+// noteUpstreamCert checks the certificate of a secured upstream connection
+func (bkd *Backend) noteUpstreamCert(host string, c *smtpproxy.Client) {
+	if cs, ok := c.TLSConnectionState(); ok {
+		bkd.certWatch.check(host, cs)
+	}
+}
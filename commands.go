@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Client command allowlist
+//-----------------------------------------------------------------------------
+
+const commandDeniedCode = 502
+const commandDeniedMsg = "5.5.1 Command not implemented"
+
+// parseCommandList parses a comma-separated list of SMTP verbs. An empty list gives nil, meaning all are allowed.
+// QUIT is always allowed, so clients can end the session cleanly.
+func parseCommandList(list string) map[string]bool {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	m := map[string]bool{"QUIT": true}
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			m[c] = true
+		}
+	}
+	return m
+}
+
+// commandAllowed tells whether clients may use the SMTP verb cmd
+func (bkd *Backend) commandAllowed(cmd string) bool {
+	return bkd.allowedCommands == nil || bkd.allowedCommands[strings.ToUpper(cmd)]
+}
+
+// denyCommand returns code 0 if the client may use cmd, else the response to give it. Denied commands are answered
+// here, and never reach the upstream.
+func (s *Session) denyCommand(cmd, arg string) (int, string, error) {
+	if s.bkd.commandAllowed(cmd) {
+		return 0, "", nil
+	}
+	s.logger(cmdTwiddle(s), cmd, arg, "(not in allowed_commands)")
+	s.logger("\t", commandDeniedCode, commandDeniedMsg)
+	return commandDeniedCode, commandDeniedMsg, errors.New(commandDeniedMsg)
+}
+
+const bdatRejectCode = 503
+const bdatRejectMsg = "5.5.1 CHUNKING not enabled"
+
+// withoutCapability removes the named extension from a capability list
+func withoutCapability(caps []string, name string) []string {
+	var out []string
+	for _, c := range caps {
+		if ok, _ := capability([]string{c}, name); !ok {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// rejectBDAT answers a BDAT command. The proxy relays DATA only, so never advertises CHUNKING, and a client that sends
+// BDAT anyway is refused without disturbing the upstream session. RFC 3030 doesn't allow a client to send the chunk
+// without CHUNKING advertised, so any that follows is read as commands, and refused as unrecognized.
+func (s *Session) rejectBDAT(cmd, arg string) (int, string, error) {
+	s.logger(cmdTwiddle(s), cmd, arg, "(not relayed)")
+	s.logger("\t", bdatRejectCode, bdatRejectMsg)
+	return bdatRejectCode, bdatRejectMsg, errors.New(bdatRejectMsg)
+}
+
+// SMTP verbs that reach the Unknown handler, but aren't bad commands
+var otherVerbs = []string{"NOOP", "VRFY", "EXPN", "HELP", "ETRN", "BDAT", "TURN", "ATRN", "XCLIENT", "XFORWARD"}
+
+const badCommandCode = 500
+const tooManyBadCode = 421
+const tooManyBadMsg = "4.7.0 Too many bad commands, closing connection"
+
+// badCommand answers an unrecognized command sent before the client has greeted, as port scanners and probes do.
+// Returns code 0 for a command that should be handled as usual. After max_bad_commands, the connection is dropped.
+func (s *Session) badCommand(cmd, arg string) (int, string, error) {
+	if s.greeted || Contains(otherVerbs, strings.ToUpper(cmd)) {
+		return 0, "", nil
+	}
+	s.badCommands++
+	if s.bkd.maxBadCommands > 0 && s.badCommands >= s.bkd.maxBadCommands {
+		s.logger("\tBad command", s.badCommands, "from", remoteHost(s.remoteAddr), "- dropping connection")
+		if s.conn != nil {
+			s.conn.hangup()
+		}
+		return tooManyBadCode, tooManyBadMsg, errors.New(tooManyBadMsg)
+	}
+	s.logger("\tBad command", s.badCommands, "from", remoteHost(s.remoteAddr), "(not relayed)")
+	return badCommandCode, s.bkd.badCommandReply, errors.New(s.bkd.badCommandReply)
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestBDATRejected(t *testing.T) {
+	f := newFakeUpstream(t, nil)
+	f.caps = append(f.caps, "CHUNKING")
+	s := testSession(t, f, nil)
+
+	caps, _, _, err := s.Greet("EHLO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := capability(caps, "CHUNKING"); ok {
+		t.Errorf("CHUNKING advertised to the client: %q", caps)
+	}
+	if code, msg, err := s.Mail(250, "MAIL", "FROM:<sender@example.com>"); err != nil {
+		t.Fatalf("MAIL: %d %s %v", code, msg, err)
+	}
+	if code, msg, err := s.Rcpt(250, "RCPT", "TO:<rcpt@example.net>"); err != nil {
+		t.Fatalf("RCPT: %d %s %v", code, msg, err)
+	}
+	code, _, err := s.Unknown(250, "BDAT", "86 LAST")
+	if err == nil || code != bdatRejectCode {
+		t.Errorf("BDAT got %d %v, want %d", code, err, bdatRejectCode)
+	}
+	if n := len(f.commands("BDAT")); n != 0 {
+		t.Errorf("upstream saw %d BDAT commands, want none", n)
+	}
+
+	// The connection and the transaction are still usable
+	if code, msg, err := sendMessage(t, s, testMessage); err != nil || code != 250 {
+		t.Fatalf("DATA after BDAT: %d %s %v", code, msg, err)
+	}
+	if n := len(f.messages()); n != 1 {
+		t.Errorf("upstream received %d messages, want 1", n)
+	}
+}
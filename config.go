@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//-----------------------------------------------------------------------------
+// Configuration file
+//
+// With -config, options are also read from a YAML file of flag names and values, e.g.
+//   in_hostport: ":587"
+//   out_hostport: smtp.sparkpostmail.com:587
+//   verbose: true
+//   upstream_timeout: 2m
+// Any flag can be set this way, with the same meaning and default as on the command line; a list gives a
+// comma-separated value. Flags given on the command line override the file.
+//
+// Options can also be given as environment variables, named SMTP_ and the flag name in upper case, e.g.
+// SMTP_OUT_HOSTPORT for out_hostport. Precedence is: command line, then environment, then config file, then default.
+//-----------------------------------------------------------------------------
+
+const envPrefix = "SMTP_"
+
+// envName returns the environment variable giving the named flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(flagName)
+}
+
+// loadEnv sets each flag that has an environment variable, unless it was given on the command line
+func loadEnv() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if serr := flag.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), serr)
+		}
+	})
+	return err
+}
+
+// loadConfig sets each flag named in the YAML file, unless it was given on the command line or by loadEnv
+func loadConfig(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, v := range values {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown option %q", file, name)
+		}
+		if given[name] {
+			continue
+		}
+		value, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: option %q: %v", file, name, err)
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: option %q: %v", file, name, err)
+		}
+	}
+	return nil
+}
+
+// configValue returns a YAML value as a flag would be given it
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("nested values not supported")
+	}
+	return fmt.Sprint(v), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// DATA transfer deadline
+//
+// read_timeout limits each read, so a client trickling a message slowly can hold a session, and perhaps an upstream
+// connection mid-DATA, far longer. With data_timeout, the whole message must arrive within it. Otherwise the transfer
+// is aborted: the client gets 451 and is disconnected, and the upstream transaction is abandoned as for an oversized
+// message, so the partial message is never completed.
+//-----------------------------------------------------------------------------
+
+const dataTimeoutCode = 451
+const dataTimeoutMsg = "4.4.2 Message transfer took too long"
+
+var errDataTimeout = errors.New(dataTimeoutMsg)
+
+// ctxReader fails with errDataTimeout once its context is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, errDataTimeout
+	}
+	n, err := c.r.Read(p)
+	if err != nil && c.ctx.Err() != nil {
+		err = errDataTimeout
+	}
+	return n, err
+}
+
+// withDataTimeout limits reading the message from r to data_timeout. A read blocked at the deadline is interrupted
+// through the client connection's read deadline. Call the returned function when the message has been read.
+func (s *Session) withDataTimeout(r io.Reader) (io.Reader, func()) {
+	if s.bkd.dataTimeout <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.bkd.dataTimeout)
+	stop := context.AfterFunc(ctx, func() {
+		if ctx.Err() == context.DeadlineExceeded && s.conn != nil {
+			s.conn.conn.SetReadDeadline(time.Now())
+		}
+	})
+	return &ctxReader{ctx: ctx, r: r}, func() {
+		stop()
+		cancel()
+	}
+}
+
+// dataTimedOut refuses the message being read, and ends the session once the client has the response
+func (s *Session) dataTimedOut() (int, string, error) {
+	s.logger(respTwiddle(s), dataTimeoutCode, dataTimeoutMsg)
+	s.abandonData()
+	if s.conn != nil {
+		s.conn.hangup()
+	}
+	return dataTimeoutCode, dataTimeoutMsg, errDataTimeout
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+//-----------------------------------------------------------------------------
+// DKIM signing
+//
+// With dkim_domain, dkim_selector and dkim_key, each message is DKIM-signed as the "sign" transform stage (see
+// pipeline.go), which must follow the stages that add headers, so the signature covers them. Signing needs the whole
+// message, so messages are buffered rather than streamed.
+//-----------------------------------------------------------------------------
+
+const dkimErrorCode = 451
+const dkimErrorMsg = "4.3.0 Unable to sign message, try again later"
+
+// loadDKIM returns signing options for domain and selector, with the PEM private key (RSA or Ed25519) in keyFile
+func loadDKIM(domain, selector, keyFile string) (*dkim.SignOptions, error) {
+	if domain == "" || selector == "" || keyFile == "" {
+		return nil, errors.New("dkim_domain, dkim_selector and dkim_key must all be given")
+	}
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", keyFile)
+	}
+	var signer crypto.Signer
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		signer, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var k interface{}
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		switch k := k.(type) {
+		case *rsa.PrivateKey:
+			signer = k
+		case ed25519.PrivateKey:
+			signer = k
+		default:
+			if err == nil {
+				err = fmt.Errorf("%s: unsupported key type %T", keyFile, k)
+			}
+		}
+	default:
+		err = fmt.Errorf("%s: unsupported PEM block %q", keyFile, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dkim.SignOptions{Domain: domain, Selector: selector, Signer: signer}, nil
+}
+
+func (s *Session) transformSign(msg []byte) ([]byte, int, string, error) {
+	if s.bkd.dkim == nil {
+		return msg, 0, "", nil
+	}
+	var out bytes.Buffer
+	if err := dkim.Sign(&out, bytes.NewReader(msg), s.bkd.dkim); err != nil {
+		s.logger(respTwiddle(s), "DKIM signing error", err)
+		return msg, dkimErrorCode, dkimErrorMsg, err
+	}
+	return out.Bytes(), 0, "", nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Delivery status notifications
+//
+// Bounces are RFC 3464 reports: a multipart/report with a human-readable part, a message/delivery-status part giving
+// each failed recipient's status and the upstream's response, and the original message's header as
+// text/rfc822-headers. They have a null sender, so are never bounced themselves, and honour the recipient's RFC 3461
+// NOTIFY parameter: none is sent for a recipient given NOTIFY=NEVER, or NOTIFY without FAILURE.
+//
+// Store-and-forward always bounces recipients it gives up on. With generate_dsn, the proxy also reports recipients a
+// client's own session accepted at RCPT but could not relay, having told the client the message was accepted, e.g.
+// refused when replayed by pipeline_rcpt, split_recipients or upstream_reconnect, or by a recipient_routes upstream.
+// The report is sent to the MAIL FROM address over the session's upstream connection, as the message completes.
+//-----------------------------------------------------------------------------
+
+// dsnReport describes a message that couldn't be delivered to some of its recipients
+type dsnReport struct {
+	id            string // Identifies the report, and the original message in it
+	mailFrom      string
+	correlationID string
+	arrived       time.Time
+	failed        []string
+	reasons       map[string]refusal
+	header        []byte // The original message's header, if known
+}
+
+var enhancedStatusPattern = regexp.MustCompile(`\b[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// dsnStatus returns the RFC 3463 status code for a refusal: its enhanced status code if it has one, else from its
+// reply code
+func dsnStatus(r refusal) string {
+	if status := enhancedStatusPattern.FindString(r.reason); status != "" {
+		return status
+	}
+	if r.code >= 400 && r.code < 500 {
+		return "4.0.0"
+	}
+	return "5.0.0"
+}
+
+// wantsFailureDSN tells whether a recipient's RCPT TO parameters allow a failure report (RFC 3461 section 4.1)
+func wantsFailureDSN(params string) bool {
+	for _, p := range strings.Fields(params) {
+		if kv := strings.SplitN(p, "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "NOTIFY") {
+			return Contains(strings.Split(strings.ToUpper(kv[1]), ","), "FAILURE")
+		}
+	}
+	return true
+}
+
+// dsnRecipients returns those of failed whose parameters allow a failure report, sorted
+func dsnRecipients(failed []string, params map[string]string) []string {
+	var out []string
+	for _, r := range failed {
+		if wantsFailureDSN(params[r]) {
+			out = append(out, r)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// buildDSN returns the report as a message, addressed to the original sender
+func (bkd *Backend) buildDSN(r dsnReport) []byte {
+	domain := bkd.domain()
+	boundary := "=_dsn_" + r.id
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", domain)
+	fmt.Fprintf(&b, "To: <%s>\r\n", r.mailFrom)
+	fmt.Fprintf(&b, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <%s.bounce@%s>\r\n", r.id, domain)
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=us-ascii\r\n\r\n")
+	fmt.Fprintf(&b, "Your message, received %s, could not be delivered to these recipients:\r\n\r\n", r.arrived.Format(time.RFC1123Z))
+	for _, rcpt := range r.failed {
+		why := r.reasons[rcpt]
+		fmt.Fprintf(&b, "  <%s>: %s (%s)\r\n", rcpt, headerSafe(why.reason), classifyBounce(why.code, why.reason))
+	}
+	if r.correlationID != "" {
+		fmt.Fprintf(&b, "\r\nCorrelation ID: %s\r\n", r.correlationID)
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", domain)
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", r.arrived.Format(time.RFC1123Z))
+	for _, rcpt := range r.failed {
+		why := r.reasons[rcpt]
+		fmt.Fprintf(&b, "\r\nFinal-Recipient: rfc822; %s\r\n", rcpt)
+		fmt.Fprintf(&b, "Action: failed\r\n")
+		fmt.Fprintf(&b, "Status: %s\r\n", dsnStatus(why))
+		if why.code != 0 {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", headerSafe(why.reason))
+		}
+	}
+
+	if len(r.header) > 0 {
+		fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: text/rfc822-headers\r\n\r\n")
+		b.Write(bytes.TrimRight(r.header, "\r\n"))
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return []byte(b.String())
+}
+
+// noteUndelivered records recipients the client was told were accepted, but that couldn't be relayed, for
+// generate_dsn. code is the upstream's response, or 0 if there was only an error.
+func (s *Session) noteUndelivered(rcpts []string, code int, m string, err error) {
+	why := fmt.Sprintf("%d %s", code, m)
+	if code == 0 && err != nil {
+		why = err.Error()
+	}
+	if s.undelivered == nil {
+		s.undelivered = make(map[string]refusal)
+	}
+	for _, r := range rcpts {
+		s.undelivered[r] = refusal{code: code, reason: why}
+	}
+}
+
+// sendDSN reports the message's undelivered recipients to its sender, with generate_dsn, over the upstream connection
+func (s *Session) sendDSN(msgHeader []byte) {
+	if !s.bkd.generateDSN || s.mailfrom == "" || s.bkd.sink || len(s.undelivered) == 0 {
+		return
+	}
+	var failed []string
+	for r := range s.undelivered {
+		failed = append(failed, r)
+	}
+	failed = dsnRecipients(failed, s.rcptParams)
+	if len(failed) == 0 {
+		return
+	}
+	log.Println("Message undeliverable to", failed, "correlation ID:", s.correlationID)
+	dsn := s.bkd.buildDSN(dsnReport{
+		id:            newSessionID(),
+		mailFrom:      s.mailfrom,
+		correlationID: s.correlationID,
+		arrived:       time.Now(),
+		failed:        failed,
+		reasons:       s.undelivered,
+		header:        msgHeader,
+	})
+	s.logger("---Sending delivery status notification to", s.mailfrom)
+	if _, _, err := s.Passthru(250, "MAIL", "FROM:<>"); err != nil {
+		log.Println("DSN to", s.mailfrom, "not sent:", err)
+		return
+	}
+	if _, _, err := s.Passthru(25, "RCPT", "TO:<"+s.mailfrom+">"); err != nil {
+		s.Passthru(250, "RSET", "")
+		log.Println("DSN to", s.mailfrom, "not sent:", err)
+		return
+	}
+	if code, m, err := s.sendData(s.upstream, dsn); err != nil {
+		log.Println("DSN to", s.mailfrom, "not sent:", code, m, err)
+	}
+}
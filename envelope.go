@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Envelope helpers
+//-----------------------------------------------------------------------------
+
+// parsePath splits a MAIL or RCPT argument such as "FROM:<a@example.com> SIZE=100" into the address and any
+// trailing ESMTP parameters (with leading space). prefix is "FROM:" or "TO:", matched case-insensitively.
+func parsePath(arg, prefix string) (string, string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	rest := strings.TrimLeft(arg[len(prefix):], " ")
+	if !strings.HasPrefix(rest, "<") {
+		// Some clients omit the angle brackets
+		f := strings.SplitN(rest, " ", 2)
+		if len(f) == 2 {
+			return f[0], " " + f[1], true
+		}
+		return f[0], "", true
+	}
+	end := strings.Index(rest, ">")
+	if end < 0 {
+		return "", "", false
+	}
+	return rest[1:end], rest[end+1:], true
+}
+
+// addRcpt records an accepted recipient, and its ESMTP parameters so they go with it when the message is relayed
+// later, e.g. when held for DATA or spooled
+func (s *Session) addRcpt(addr, params string) {
+	s.rcptto = append(s.rcptto, addr)
+	s.setRcptParams(addr, params)
+}
+
+// setRcptParams records the ESMTP parameters given with a recipient, if any
+func (s *Session) setRcptParams(addr, params string) {
+	if params != "" {
+		if s.rcptParams == nil {
+			s.rcptParams = make(map[string]string)
+		}
+		s.rcptParams[addr] = params
+	}
+}
+
+// splitAddress returns the local part and domain of addr
+func splitAddress(addr string) (string, string) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, ""
+	}
+	return addr[:at], addr[at+1:]
+}
+
+// verpAddress builds a VERP return path from template, which may contain the placeholders
+// {sender_local}, {sender_domain}, {rcpt_local} and {rcpt_domain}.
+func verpAddress(template, sender, rcpt string) string {
+	sl, sd := splitAddress(sender)
+	rl, rd := splitAddress(rcpt)
+	return strings.NewReplacer(
+		"{sender_local}", sl,
+		"{sender_domain}", sd,
+		"{rcpt_local}", rl,
+		"{rcpt_domain}", rd,
+	).Replace(template)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Event logs, written as one JSON object per line
+//-----------------------------------------------------------------------------
+
+// jsonLog serializes events from concurrent sessions onto a single writer
+type jsonLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openJSONLog opens (appending to) the named file
+func openJSONLog(name string) (*jsonLog, *os.File, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &jsonLog{w: f}, f, nil
+}
+
+func (j *jsonLog) write(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(b)
+	return err
+}
+
+// usageEvent summarizes a whole client session, for chargeback
+type usageEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Client     string    `json:"client"`
+	User       string    `json:"user,omitempty"`
+	Messages   int       `json:"messages"`
+	Bytes      int64     `json:"bytes"`
+	Recipients int       `json:"recipients"`
+	Duration   float64   `json:"duration_secs"`
+}
+
+// messageEvent records each relayed message, with a hash of the content as sent upstream, for audit
+type messageEvent struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	Session       string    `json:"session"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Client        string    `json:"client"`
+	User          string    `json:"user,omitempty"`
+	MailFrom      string    `json:"mail_from"`
+	RcptTo        []string  `json:"rcpt_to"`
+	Bytes         int64     `json:"bytes"`
+	SHA256        string    `json:"sha256"`
+	Code          int       `json:"code"`
+	Response      string    `json:"response"`            // upstream response, which usually carries its queue ID
+	QueueIDs      []string  `json:"queue_ids,omitempty"` // as parsed from the upstream responses
+}
+
+// bounceEvent records a store-and-forward recipient that couldn't be delivered
+type bounceEvent struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	ID            string    `json:"id"` // Spool ID
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	User          string    `json:"user,omitempty"`
+	MailFrom      string    `json:"mail_from"`
+	Rcpt          string    `json:"rcpt"`
+	Code          int       `json:"code"`
+	Response      string    `json:"response"`
+	Category      string    `json:"category"` // see classifyBounce
+}
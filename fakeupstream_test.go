@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUpstream is a scriptable SMTP server for tests to relay to. It records the commands and messages it receives.
+type fakeUpstream struct {
+	t    *testing.T
+	ln   net.Listener
+	addr string // host:port to dial
+	caps []string
+
+	// reply, if set, may override the response to a command line, returning 0 to give the default
+	reply func(line string) (int, string)
+
+	mu    sync.Mutex
+	cmds  []string // command lines received, on all connections
+	msgs  []string // message contents received
+	conns int      // connections accepted
+}
+
+// newFakeUpstream starts a fake upstream, speaking TLS from the start if tlsConfig is given
+func newFakeUpstream(t *testing.T, tlsConfig *tls.Config) *fakeUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	f := &fakeUpstream{t: t, ln: ln, addr: ln.Addr().String(), caps: []string{"PIPELINING", "8BITMIME"}}
+	go f.serve()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeUpstream) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns++
+		f.mu.Unlock()
+		go f.session(conn)
+	}
+}
+
+func (f *fakeUpstream) session(conn net.Conn) {
+	text := textproto.NewConn(conn)
+	defer text.Close()
+	text.PrintfLine("220 fake.example ESMTP")
+	queued := 0
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.cmds = append(f.cmds, line)
+		reply := f.reply
+		f.mu.Unlock()
+		if reply != nil {
+			if code, msg := reply(line); code != 0 {
+				text.PrintfLine("%d %s", code, msg)
+				continue
+			}
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			text.PrintfLine("250-fake.example")
+			for _, c := range f.caps {
+				text.PrintfLine("250-%s", c)
+			}
+			text.PrintfLine("250 SIZE 10240000")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			b, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.msgs = append(f.msgs, strings.ReplaceAll(string(b), "\n", "\r\n")) // DotReader gives LF line endings
+			f.mu.Unlock()
+			queued++
+			text.PrintfLine("250 2.0.0 Ok: queued as Q%d", queued)
+		case "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			text.PrintfLine("250 2.0.0 Ok")
+		}
+	}
+}
+
+// commands returns the command lines received so far with the given verb, e.g. "MAIL"
+func (f *fakeUpstream) commands(verb string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for _, c := range f.cmds {
+		if strings.HasPrefix(strings.ToUpper(c), verb) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// messages returns the messages received so far
+func (f *fakeUpstream) messages() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.msgs...)
+}
+
+// connections returns the number of connections accepted so far
+func (f *fakeUpstream) connections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns
+}
+
+// rejectRcpt makes the upstream refuse RCPT TO for addr with code
+func (f *fakeUpstream) rejectRcpt(addr string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reply = func(line string) (int, string) {
+		if strings.EqualFold(line, "RCPT TO:<"+addr+">") {
+			return code, fmt.Sprintf("%d.1.1 <%s>: Recipient address rejected", code/100, addr)
+		}
+		return 0, ""
+	}
+}
+
+// testSession returns a greeted session relaying to f, using bkd's settings (nil for the defaults)
+func testSession(t *testing.T, f *fakeUpstream, bkd *Backend) *Session {
+	t.Helper()
+	if bkd == nil {
+		bkd = &Backend{}
+	}
+	if bkd.upstreams == nil {
+		bkd.upstreams = newUpstreamSet(f.addr)
+	}
+	if bkd.upstreamStartTLS == "" {
+		bkd.upstreamStartTLS = startTLSNone
+	}
+	s, err := bkd.newSession(newSessionID(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code, msg, err := s.Greet("EHLO"); err != nil {
+		t.Fatalf("EHLO: %d %s %v", code, msg, err)
+	}
+	t.Cleanup(s.logout)
+	return s
+}
+
+const testMessage = "From: <sender@example.com>\r\nTo: <rcpt@example.net>\r\nSubject: test\r\n\r\nHello\r\n"
+
+// sendMessage runs DATA on the session as the server would, returning the final response
+func sendMessage(t *testing.T, s *Session, msg string) (int, string, error) {
+	t.Helper()
+	w, code, m, err := s.DataCommand()
+	if err != nil {
+		return code, m, err
+	}
+	return s.Data(strings.NewReader(msg), w)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Forward-confirmed reverse DNS check on the connecting client
+//-----------------------------------------------------------------------------
+
+// FCrDNS modes
+const (
+	fcrdnsOff     = ""
+	fcrdnsLog     = "log"     // Log failures only
+	fcrdnsEnforce = "enforce" // Reject clients that fail
+)
+
+var fcrdnsModes = []string{fcrdnsOff, fcrdnsLog, fcrdnsEnforce}
+
+const fcrdnsRejectCode = 550
+const fcrdnsRejectMsg = "5.7.25 Client host rejected: reverse DNS does not confirm"
+
+const fcrdnsCacheTTL = 5 * time.Minute
+const fcrdnsTimeout = 10 * time.Second
+
+type fcrdnsResult struct {
+	ok      bool
+	name    string // confirmed hostname, if ok
+	expires time.Time
+}
+
+// fcrdnsCache holds recent results, so repeat connections from the same IP don't repeat the lookups
+type fcrdnsCache struct {
+	mu sync.Mutex
+	m  map[string]fcrdnsResult
+}
+
+// check returns whether ip has forward-confirmed reverse DNS, and the confirmed name
+func (c *fcrdnsCache) check(ip string) (bool, string) {
+	now := time.Now()
+	c.mu.Lock()
+	if r, found := c.m[ip]; found && now.Before(r.expires) {
+		c.mu.Unlock()
+		return r.ok, r.name
+	}
+	c.mu.Unlock()
+
+	ok, name := lookupFCrDNS(ip)
+
+	c.mu.Lock()
+	if c.m == nil {
+		c.m = make(map[string]fcrdnsResult)
+	}
+	for k, r := range c.m {
+		if now.After(r.expires) {
+			delete(c.m, k) // keep the cache from growing without bound
+		}
+	}
+	c.m[ip] = fcrdnsResult{ok: ok, name: name, expires: now.Add(fcrdnsCacheTTL)}
+	c.mu.Unlock()
+	return ok, name
+}
+
+// lookupFCrDNS resolves the PTR names for ip, and confirms one of them resolves back to ip
+func lookupFCrDNS(ip string) (bool, string) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false, ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fcrdnsTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil {
+		return false, ""
+	}
+	for _, name := range names {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range ips {
+			if a.IP.Equal(addr) {
+				return true, strings.TrimSuffix(name, ".")
+			}
+		}
+	}
+	return false, ""
+}
+
+// checkFCrDNS applies the FCrDNS policy to a connecting client. Returns false if the client should be rejected.
+func (bkd *Backend) checkFCrDNS(remote net.Addr) bool {
+	if bkd.fcrdns == fcrdnsOff {
+		return true
+	}
+	host := remoteHost(remote)
+	ok, name := bkd.fcrdnsCache.check(host)
+	if ok {
+		bkd.logger("\tFCrDNS confirmed", host, "is", name)
+		return true
+	}
+	log.Println("FCrDNS check failed for client", host, "mode:", bkd.fcrdns)
+	return bkd.fcrdns != fcrdnsEnforce
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// Store-and-forward
+//
+// With store_and_forward, the client's message is written to the spool and accepted with 250 straight away; the
+// forwarder relays it later, on its own upstream connection. Recipients refused temporarily are retried (see retry.go),
+// for up to spool_max_age. Recipients refused permanently, or timed out, are reported to the sender with a bounce, as the
+// client has already been told the message was accepted.
+//
+// forward_workers messages are relayed at once, in priority order (see priority.go) then oldest first, with at most forward_max_per_upstream connections open
+// to any one upstream. A worker waits for a busy upstream, rather than skip ahead to a later message.
+//
+// Client credentials are not kept, so the forwarder authenticates to out_hostport as the upstream_user service account.
+// Without one, store_and_forward needs forward_without_auth, saying the upstream accepts relaying from the proxy itself,
+// e.g. by IP address. Clients still authenticate on their own session's upstream connection.
+//-----------------------------------------------------------------------------
+
+const spoolScanInterval = 10 * time.Second
+
+// spoolMessage stores the buffered message for the forwarder, and accepts it
+func (s *Session) spoolMessage(msg []byte) (int, string, error) {
+	hdr, _, _ := readHeader(bytes.NewReader(msg))
+	env := &spoolEnvelope{
+		ID:            newSessionID(),
+		MailFrom:      s.mailfrom,
+		MailParams:    s.mailParams,
+		RcptTo:        s.rcptto,
+		RcptParams:    s.rcptParams,
+		User:          s.authUser,
+		CorrelationID: s.correlationID,
+		Priority:      s.bkd.priorities.of(s.authUser, parseHeader(hdr)),
+		Received:      time.Now(),
+		NextAttempt:   time.Now(),
+	}
+	if err := s.bkd.spool.put(env, msg); err != nil {
+		log.Println("Spool error", err, "correlation ID:", s.correlationID)
+		return 451, "4.3.0 Unable to queue message, try again later", err
+	}
+	s.logger("\tSpooled as", env.ID)
+	return 250, "2.0.0 Ok: queued as " + env.ID, nil
+}
+
+// forwarder runs the store-and-forward workers
+type forwarder struct {
+	workers     int
+	perUpstream int // 0 = unlimited
+	jobs        chan string
+	mu          sync.Mutex
+	inFlight    map[string]bool          // Message IDs being relayed, or waiting for a worker
+	slots       map[string]chan struct{} // Connections in use, per route
+	depth       int                      // Messages in the spool, at the last scan
+}
+
+// runForwarder relays spooled messages as they fall due
+func (bkd *Backend) runForwarder() {
+	f := &bkd.forwarder
+	f.inFlight = make(map[string]bool)
+	f.slots = make(map[string]chan struct{})
+	f.jobs = make(chan string)
+	for i := 0; i < f.workers; i++ {
+		go bkd.forwardWorker()
+	}
+	for {
+		bkd.forwardDue()
+		select {
+		case <-bkd.spool.wake:
+		case <-time.After(spoolScanInterval):
+		}
+	}
+}
+
+// forwardDue hands each spooled message that's due a delivery attempt to the workers, highest priority first
+func (bkd *Backend) forwardDue() {
+	f := &bkd.forwarder
+	envs, err := bkd.spool.list()
+	if err != nil {
+		log.Println("Spool error", err)
+		return
+	}
+	now := time.Now()
+	sort.Slice(envs, func(i, j int) bool {
+		pi, pj := bkd.priorities.effective(envs[i], now), bkd.priorities.effective(envs[j], now)
+		if pi != pj {
+			return pi > pj
+		}
+		return envs[i].Received.Before(envs[j].Received)
+	})
+	f.mu.Lock()
+	f.depth = len(envs)
+	f.mu.Unlock()
+	for _, env := range envs {
+		if now.Before(env.NextAttempt) {
+			continue
+		}
+		f.mu.Lock()
+		busy := f.inFlight[env.ID]
+		f.inFlight[env.ID] = true
+		f.mu.Unlock()
+		if !busy {
+			f.jobs <- env.ID // waits for a free worker
+		}
+	}
+}
+
+func (bkd *Backend) forwardWorker() {
+	f := &bkd.forwarder
+	for id := range f.jobs {
+		// Read the envelope afresh: it may have been relayed, or retried, since the scan that queued it
+		if env, err := bkd.spool.load(id); err == nil && !time.Now().Before(env.NextAttempt) {
+			bkd.forward(env)
+		}
+		f.mu.Lock()
+		delete(f.inFlight, id)
+		f.mu.Unlock()
+	}
+}
+
+// acquire waits for a free connection slot to route, returning the function to release it
+func (f *forwarder) acquire(route string) func() {
+	if f.perUpstream <= 0 {
+		return func() {}
+	}
+	f.mu.Lock()
+	slot, ok := f.slots[route]
+	if !ok {
+		slot = make(chan struct{}, f.perUpstream)
+		f.slots[route] = slot
+	}
+	f.mu.Unlock()
+	slot <- struct{}{}
+	return func() { <-slot }
+}
+
+// snapshot returns the spool depth at the last scan, and the number of messages being relayed or waiting for a worker
+func (f *forwarder) snapshot() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.depth, len(f.inFlight)
+}
+
+// forward attempts delivery of a spooled message to its remaining recipients
+func (bkd *Backend) forward(env *spoolEnvelope) {
+	msg, err := bkd.spool.message(env.ID)
+	if err != nil {
+		log.Println("Spool error", env.ID, err)
+		return
+	}
+	// Group recipients by upstream
+	groups := make(map[string][]string)
+	for _, rcpt := range env.RcptTo {
+		route := bkd.routeFor(rcpt)
+		groups[route] = append(groups[route], rcpt)
+	}
+	var temp, perm []string
+	reasons := make(map[string]refusal)
+	for route, rcpts := range groups {
+		t, p, why := bkd.deliver(route, env, rcpts, msg)
+		temp = append(temp, t...)
+		perm = append(perm, p...)
+		for r, w := range why {
+			reasons[r] = w
+		}
+	}
+	env.Attempts++
+	bkd.logger("---Forwarded", env.ID, "attempt", env.Attempts, "delivered", len(env.RcptTo)-len(temp)-len(perm), "deferred", len(temp), "failed", len(perm))
+	var delay time.Duration
+	if len(temp) > 0 {
+		last := reasons[temp[0]]
+		env.LastCode, env.LastError = last.code, last.reason
+		var retry bool
+		delay, retry = bkd.retrySchedules.next(last.code, env.Attempts)
+		if !retry || time.Since(env.Received) > bkd.spool.maxAge {
+			perm = append(perm, temp...)
+			temp = nil
+		}
+	}
+	if len(perm) > 0 {
+		bkd.bounce(env, perm, reasons, msg)
+	}
+	if len(temp) == 0 {
+		if err := bkd.spool.remove(env.ID); err != nil {
+			log.Println("Spool error", env.ID, err)
+		}
+		return
+	}
+	env.RcptTo = temp
+	env.NextAttempt = time.Now().Add(delay)
+	if err := bkd.spool.save(env); err != nil {
+		log.Println("Spool error", env.ID, err)
+	}
+}
+
+// refusal is why a recipient wasn't delivered: the upstream response code (0 if there was none) and text
+type refusal struct {
+	code   int
+	reason string
+}
+
+// deliver relays msg to rcpts via the given route ("" for out_hostport) in one transaction. Returns the recipients
+// refused temporarily and permanently, with the reasons.
+func (bkd *Backend) deliver(route string, env *spoolEnvelope, rcpts []string, msg []byte) ([]string, []string, map[string]refusal) {
+	var temp, perm []string
+	reasons := make(map[string]refusal)
+	// refuse notes that rs were refused, with a response code (0 if there's only an error)
+	refuse := func(rs []string, code int, m string, err error) {
+		why := fmt.Sprintf("%d %s", code, m)
+		if code == 0 {
+			why = err.Error()
+		}
+		for _, r := range rs {
+			reasons[r] = refusal{code: code, reason: why}
+		}
+		if code >= 500 {
+			perm = append(perm, rs...)
+		} else {
+			temp = append(temp, rs...)
+		}
+	}
+	defer bkd.forwarder.acquire(route)()
+	c, err := bkd.dialForward(route)
+	if err != nil {
+		refuse(rcpts, 0, "", err)
+		return temp, perm, reasons
+	}
+	defer c.Close()
+	if route == "" && bkd.serviceCreds != nil {
+		if code, m, err := bkd.forwardLogin(c); err != nil {
+			// Not the recipients' fault, so retried rather than bounced
+			refuse(rcpts, 0, "", fmt.Errorf("upstream AUTH: %d %s %v", code, m, err))
+			return temp, perm, reasons
+		}
+	}
+	if code, m, err := c.MyCmd(250, "MAIL FROM:<%s>%s", env.MailFrom, env.MailParams); err != nil {
+		refuse(rcpts, code, m, err)
+		return temp, perm, reasons
+	}
+	var accepted []string
+	for _, rcpt := range rcpts {
+		if code, m, err := c.MyCmd(25, "RCPT TO:<%s>%s", rcpt, env.RcptParams[rcpt]); err != nil {
+			refuse([]string{rcpt}, code, m, err)
+		} else {
+			accepted = append(accepted, rcpt)
+		}
+	}
+	if len(accepted) == 0 {
+		return temp, perm, reasons
+	}
+	w, code, m, err := c.Data()
+	if err != nil {
+		refuse(accepted, code, m, err)
+		return temp, perm, reasons
+	}
+	if _, err := smtpproxy.MailCopy(w, bytes.NewReader(msg)); err != nil {
+		w.Close()
+		refuse(accepted, 0, "", err)
+		return temp, perm, reasons
+	}
+	if err := w.Close(); err != nil {
+		refuse(accepted, c.DataResponseCode, c.DataResponseMsg, err)
+		return temp, perm, reasons
+	}
+	c.Quit()
+	return temp, perm, reasons
+}
+
+// dialForward connects to the given route ("" for out_hostport) for the forwarder
+func (bkd *Backend) dialForward(route string) (*smtpproxy.Client, error) {
+	if !bkd.dialLimiter.wait() {
+		return nil, errors.New("upstream dial rate limit reached")
+	}
+	if route != "" {
+		return bkd.dialRelay(route)
+	}
+	c, hostPort, err := bkd.dialUpstream()
+	if err != nil {
+		return nil, err
+	}
+	host := upstreamName(hostPort)
+	if code, m, err := c.Hello(host); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("EHLO: %d %s %v", code, m, err)
+	}
+	if _, isTLS := c.TLSConnectionState(); !isTLS && bkd.upstreamStartTLS != startTLSNone && (!isUnixSocket(hostPort) || bkd.requireUpstreamTLS) {
+		if ok, _ := capability(c.Capabilities(), "STARTTLS"); ok || bkd.requireUpstreamTLS {
+			if code, m, err := c.StartTLS(bkd.outTLSConfig(hostPort)); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("STARTTLS: %d %s %v", code, m, err)
+			}
+			bkd.noteUpstreamCert(host, c)
+		}
+	}
+	return c, nil
+}
+
+// forwardLogin authenticates the forwarder's connection as the upstream_user service account
+func (bkd *Backend) forwardLogin(c *smtpproxy.Client) (int, string, error) {
+	cr := bkd.withCurrentToken(*bkd.serviceCreds)
+	mech, err := bkd.upstreamMech(c.Capabilities(), &cr)
+	if err != nil {
+		return upstreamMechCode, upstreamMechMsg, err
+	}
+	return saslAuth(c, mech, cr)
+}
+
+// bounce tells the sender of a spooled message that it couldn't be delivered to some recipients, by spooling a
+// delivery status notification to them (see dsn.go)
+func (bkd *Backend) bounce(env *spoolEnvelope, failed []string, reasons map[string]refusal, msg []byte) {
+	log.Println("Message", env.ID, "undeliverable to", failed, "correlation ID:", env.CorrelationID)
+	for _, r := range failed {
+		category := classifyBounce(reasons[r].code, reasons[r].reason)
+		bkd.logger("\tBounce", env.ID, r, category, reasons[r].reason)
+		bkd.suppression.add(r, reasons[r].code, reasons[r].reason)
+		if bkd.messageLog != nil {
+			err := bkd.messageLog.write(bounceEvent{
+				Time:          time.Now(),
+				Event:         "message_bounced",
+				ID:            env.ID,
+				CorrelationID: env.CorrelationID,
+				User:          env.User,
+				MailFrom:      env.MailFrom,
+				Rcpt:          r,
+				Code:          reasons[r].code,
+				Response:      reasons[r].reason,
+				Category:      category,
+			})
+			if err != nil {
+				log.Println("Message log error", err)
+			}
+		}
+	}
+	if env.MailFrom == "" {
+		return
+	}
+	if failed = dsnRecipients(failed, env.RcptParams); len(failed) == 0 {
+		return
+	}
+	hdr, _, _ := readHeader(bytes.NewReader(msg))
+	report := bkd.buildDSN(dsnReport{
+		id:            env.ID,
+		mailFrom:      env.MailFrom,
+		correlationID: env.CorrelationID,
+		arrived:       env.Received,
+		failed:        failed,
+		reasons:       reasons,
+		header:        hdr,
+	})
+	dsn := &spoolEnvelope{
+		ID:          newSessionID(),
+		RcptTo:      []string{env.MailFrom},
+		Priority:    priorityNormal,
+		Received:    time.Now(),
+		NextAttempt: time.Now(),
+	}
+	if err := bkd.spool.put(dsn, report); err != nil {
+		log.Println("Spool error, bounce for", env.ID, "lost:", err)
+	}
+}
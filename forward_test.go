@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeliverServiceAccount(t *testing.T) {
+	f := newFakeUpstream(t, nil)
+	f.caps = append(f.caps, "AUTH PLAIN LOGIN")
+	f.reply = func(line string) (int, string) {
+		if strings.HasPrefix(line, "AUTH") {
+			return 235, "2.7.0 Authentication successful"
+		}
+		return 0, ""
+	}
+	bkd := &Backend{
+		upstreams:        newUpstreamSet(f.addr),
+		upstreamAuth:     authAuto,
+		upstreamStartTLS: startTLSNone,
+		serviceCreds:     &credentials{user: "relay", secret: "secret"},
+	}
+	env := &spoolEnvelope{ID: "1", MailFrom: "sender@example.com"}
+	temp, perm, reasons := bkd.deliver("", env, []string{"rcpt@example.net"}, []byte(testMessage))
+	if len(temp) != 0 || len(perm) != 0 {
+		t.Fatalf("refused temporarily %v, permanently %v: %v", temp, perm, reasons)
+	}
+	auth := f.commands("AUTH")
+	if len(auth) != 1 || auth[0] != "AUTH PLAIN "+b64("\x00relay\x00secret") {
+		t.Errorf("upstream AUTH commands %q, want PLAIN as the service account", auth)
+	}
+	if n := len(f.messages()); n != 1 {
+		t.Errorf("upstream received %d messages, want 1", n)
+	}
+}
+
+func TestDeliverServiceAccountRefused(t *testing.T) {
+	f := newFakeUpstream(t, nil)
+	f.caps = append(f.caps, "AUTH PLAIN")
+	f.reply = func(line string) (int, string) {
+		if strings.HasPrefix(line, "AUTH") {
+			return 535, "5.7.8 Authentication credentials invalid"
+		}
+		return 0, ""
+	}
+	bkd := &Backend{
+		upstreams:        newUpstreamSet(f.addr),
+		upstreamAuth:     authAuto,
+		upstreamStartTLS: startTLSNone,
+		serviceCreds:     &credentials{user: "relay", secret: "wrong"},
+	}
+	env := &spoolEnvelope{ID: "1", MailFrom: "sender@example.com"}
+	temp, perm, _ := bkd.deliver("", env, []string{"rcpt@example.net"}, []byte(testMessage))
+	if len(temp) != 1 || len(perm) != 0 {
+		t.Errorf("refused temporarily %v, permanently %v, want the recipient kept for retry", temp, perm)
+	}
+	if n := len(f.commands("MAIL")); n != 0 {
+		t.Errorf("upstream saw %d MAIL commands after AUTH failed, want none", n)
+	}
+}
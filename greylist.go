@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Greylisting
+//
+// With greylist, the first RCPT TO for each (client IP, MAIL FROM, RCPT TO) triplet is refused with a temporary
+// failure. A well-behaved client retries, and is accepted once greylist_delay has passed; bulk spam tools usually
+// don't. Triplets are kept in memory: passed ones for greylistTTL after they were last used, so regular senders aren't
+// delayed again, and others for greylistTTL after first being seen.
+//-----------------------------------------------------------------------------
+
+const greylistCode = 451
+const greylistMsg = "4.7.1 Greylisted, try again later"
+
+const greylistTTL = 24 * time.Hour
+
+type greylistEntry struct {
+	first  time.Time // When the triplet was first seen
+	last   time.Time // When it was last seen
+	passed bool
+}
+
+type greylist struct {
+	delay     time.Duration
+	mu        sync.Mutex
+	m         map[string]*greylistEntry
+	lastSweep time.Time
+}
+
+// allow records an attempt for the triplet, and tells whether it may proceed
+func (g *greylist) allow(ip, from, rcpt string) bool {
+	key := ip + "\x00" + strings.ToLower(from) + "\x00" + strings.ToLower(rcpt)
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.lastSweep) > time.Hour {
+		for k, e := range g.m {
+			if now.Sub(e.last) > greylistTTL {
+				delete(g.m, k) // keep the list from growing without bound
+			}
+		}
+		g.lastSweep = now
+	}
+	if g.m == nil {
+		g.m = make(map[string]*greylistEntry)
+	}
+	e, ok := g.m[key]
+	if !ok || now.Sub(e.last) > greylistTTL {
+		g.m[key] = &greylistEntry{first: now, last: now}
+		return false
+	}
+	if !e.passed {
+		e.passed = now.Sub(e.first) >= g.delay
+	}
+	if e.passed {
+		e.last = now // passed triplets stay as long as they're in use
+	}
+	return e.passed
+}
+
+// checkGreylist applies greylisting to a recipient of the current transaction
+func (s *Session) checkGreylist(rcpt string) (int, string, error) {
+	if s.bkd.greylist == nil {
+		return 0, "", nil
+	}
+	if s.bkd.greylist.allow(remoteHost(s.remoteAddr), s.mailfrom, rcpt) {
+		return 0, "", nil
+	}
+	return greylistCode, greylistMsg, errors.New(greylistMsg)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Header rules
+//
+// header_rules names a file of directives, one per line, applied in order to each message as the "headers" transform
+// stage (see pipeline.go):
+//   add X-Env: prod                   append a header field
+//   remove X-Internal-*               remove every field whose name matches the pattern (* and ? wildcards)
+//   replace Subject /foo/bar/         rewrite matching text in the named field's value (Go regexp, $1 etc. allowed)
+// Names are not case sensitive. Blank lines and lines starting with # are ignored. Folded fields are unfolded before
+// replace, and removed whole. The body is untouched.
+//-----------------------------------------------------------------------------
+
+// stripMsysAPI removes client-supplied X-MSYS-API headers, with strip_msys_api. SparkPost acts on this header
+// (e.g. archive recipients, tracking options), so an untrusted client could otherwise use it to change how its mail
+// is handled.
+var stripMsysAPI = []headerRule{{op: "remove", name: "x-msys-api"}}
+
+type headerRule struct {
+	op      string // add, remove, replace
+	name    string // Field name, or pattern for remove; lower case
+	value   string // add: the field value. replace: the replacement
+	pattern *regexp.Regexp
+}
+
+// loadHeaderRules reads a header rules file
+func loadHeaderRules(file string) ([]headerRule, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []headerRule
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseHeaderRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", file, i+1, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseHeaderRule(line string) (headerRule, error) {
+	f := strings.SplitN(line, " ", 2)
+	if len(f) != 2 {
+		return headerRule{}, fmt.Errorf("%q: missing argument", line)
+	}
+	op, arg := strings.ToLower(f[0]), strings.TrimSpace(f[1])
+	switch op {
+	case "add":
+		nv := strings.SplitN(arg, ":", 2)
+		name := strings.TrimSpace(nv[0])
+		if len(nv) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+			return headerRule{}, fmt.Errorf("%q: expected add Name: value", line)
+		}
+		return headerRule{op: op, name: strings.ToLower(name), value: name + ":" + headerSafe(nv[1])}, nil
+	case "remove":
+		if _, err := path.Match(arg, ""); err != nil {
+			return headerRule{}, fmt.Errorf("%q: %v", line, err)
+		}
+		return headerRule{op: op, name: strings.ToLower(arg)}, nil
+	case "replace":
+		g := strings.SplitN(arg, " ", 2)
+		if len(g) != 2 {
+			return headerRule{}, fmt.Errorf("%q: expected replace Name /regexp/replacement/", line)
+		}
+		expr := strings.TrimSpace(g[1])
+		if len(expr) < 3 {
+			return headerRule{}, fmt.Errorf("%q: expected /regexp/replacement/", line)
+		}
+		parts := strings.Split(expr[1:], expr[:1]) // any delimiter, as with sed
+		if len(parts) != 3 || parts[2] != "" {
+			return headerRule{}, fmt.Errorf("%q: expected /regexp/replacement/", line)
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return headerRule{}, fmt.Errorf("%q: %v", line, err)
+		}
+		return headerRule{op: op, name: strings.ToLower(g[0]), value: headerSafe(parts[1]), pattern: re}, nil
+	}
+	return headerRule{}, fmt.Errorf("%q: unknown directive %q", line, op)
+}
+
+// headerFields splits a header block into fields, each with its continuation lines. The blank line ending the
+// block, if present, is returned separately.
+func headerFields(hdr []byte) ([]string, string) {
+	var fields []string
+	end := ""
+	for _, line := range strings.SplitAfter(string(hdr), "\n") {
+		switch {
+		case line == "":
+		case line == "\r\n" || line == "\n":
+			end = line
+		case (line[0] == ' ' || line[0] == '\t') && len(fields) > 0:
+			fields[len(fields)-1] += line
+		default:
+			fields = append(fields, line)
+		}
+	}
+	return fields, end
+}
+
+// fieldName returns a field's name, in lower case
+func fieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return strings.ToLower(strings.TrimSpace(field[:i]))
+	}
+	return ""
+}
+
+// applyHeaderRules returns the header block with the rules applied
+func applyHeaderRules(rules []headerRule, hdr []byte) []byte {
+	fields, end := headerFields(hdr)
+	if end == "" {
+		end = "\r\n" // the message was all header; the rewritten one has an empty body
+	}
+	for _, r := range rules {
+		switch r.op {
+		case "add":
+			fields = append(fields, r.value+"\r\n")
+		case "remove":
+			kept := fields[:0]
+			for _, f := range fields {
+				if ok, _ := path.Match(r.name, fieldName(f)); !ok {
+					kept = append(kept, f)
+				}
+			}
+			fields = kept
+		case "replace":
+			for i, f := range fields {
+				if fieldName(f) != r.name {
+					continue
+				}
+				colon := strings.IndexByte(f, ':')
+				value := strings.NewReplacer("\r\n", "", "\n", "").Replace(f[colon+1:]) // unfold
+				fields[i] = f[:colon+1] + r.pattern.ReplaceAllString(value, r.value) + "\r\n"
+			}
+		}
+	}
+	var out bytes.Buffer
+	for _, f := range fields {
+		out.WriteString(f)
+		if !strings.HasSuffix(f, "\n") {
+			out.WriteString("\r\n")
+		}
+	}
+	out.WriteString(end)
+	return out.Bytes()
+}
+
+func (s *Session) transformHeaders(msg []byte) ([]byte, int, string, error) {
+	if s.bkd.headerRules == nil {
+		return msg, 0, "", nil
+	}
+	hdr, body, err := readHeader(bytes.NewReader(msg))
+	if err != nil {
+		return msg, 0, "", nil // can't happen reading from memory
+	}
+	out := bytes.NewBuffer(applyHeaderRules(s.bkd.headerRules, hdr))
+	out.ReadFrom(body)
+	return out.Bytes(), 0, "", nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// spoofedMessage carries a client-supplied X-MSYS-API header, folded, that would turn on archiving
+const spoofedMessage = "From: <sender@example.com>\r\n" +
+	"x-msys-api: {\"archive\": [{\"email\": \"attacker@example.net\"}],\r\n" +
+	"\t\"options\": {\"open_tracking\": false}}\r\n" +
+	"Subject: test\r\n" +
+	"\r\n" +
+	"X-MSYS-API: this line is body text, not a header\r\n"
+
+func TestStripMsysAPI(t *testing.T) {
+	for _, strip := range []bool{true, false} {
+		f := newFakeUpstream(t, nil)
+		s := testSession(t, f, &Backend{stripMsysAPI: strip})
+		relayMessage(t, s, spoofedMessage)
+
+		msgs := f.messages()
+		if len(msgs) != 1 {
+			t.Fatalf("upstream received %d messages, want 1", len(msgs))
+		}
+		hdr, body, _ := strings.Cut(msgs[0], "\r\n\r\n")
+		spoofed := strings.Contains(hdr, "attacker@example.net") || strings.Contains(hdr, "open_tracking")
+		if spoofed == strip {
+			t.Errorf("strip_msys_api %v: header relayed = %v\n%s", strip, spoofed, hdr)
+		}
+		if !strings.Contains(hdr, "Subject: test") || !strings.Contains(hdr, "From: <sender@example.com>") {
+			t.Errorf("strip_msys_api %v: other headers lost\n%s", strip, hdr)
+		}
+		if !strings.Contains(body, "X-MSYS-API: this line is body text") {
+			t.Errorf("strip_msys_api %v: body changed\n%s", strip, body)
+		}
+	}
+}
+
+// relayMessage runs a complete transaction with msg on the session
+func relayMessage(t *testing.T, s *Session, msg string) {
+	t.Helper()
+	if code, m, err := s.Mail(250, "MAIL", "FROM:<sender@example.com>"); err != nil {
+		t.Fatalf("MAIL: %d %s %v", code, m, err)
+	}
+	if code, m, err := s.Rcpt(250, "RCPT", "TO:<rcpt@example.net>"); err != nil {
+		t.Fatalf("RCPT: %d %s %v", code, m, err)
+	}
+	if code, m, err := sendMessage(t, s, msg); err != nil {
+		t.Fatalf("DATA: %d %s %v", code, m, err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Headers added to relayed messages
+//-----------------------------------------------------------------------------
+
+// addedHeaders returns the header lines (CRLF terminated) the proxy prepends to each relayed message
+func (s *Session) addedHeaders() string {
+	var h strings.Builder
+	if s.bkd.addReceivedHeader {
+		h.WriteString(s.receivedHeader()) // Must be topmost, to keep the Received chain in order
+	}
+	h.WriteString(s.spfHeader())
+	if s.bkd.addTLSHeader {
+		h.WriteString(s.tlsHeader())
+	}
+	return h.String()
+}
+
+// receivedHeader traces the message's passage through the proxy (RFC 5321 section 4.4), with the protocol named as in
+// RFC 3848: ESMTP, plus S if the client used TLS, plus A if it authenticated. The client is named by its EHLO name
+// with forward_helo, else its confirmed reverse DNS name, if either is known.
+func (s *Session) receivedHeader() string {
+	ip := remoteHost(s.remoteAddr)
+	tcpInfo := "[" + ip + "]"
+	helo := s.heloName
+	if s.bkd.fcrdns != fcrdnsOff && ip != "" {
+		if ok, name := s.bkd.fcrdnsCache.check(ip); ok {
+			tcpInfo = name + " " + tcpInfo
+			if helo == "" {
+				helo = name
+			}
+		}
+	}
+	from := tcpInfo
+	if helo != "" {
+		from = helo + " (" + tcpInfo + ")"
+	}
+	proto := "SMTP"
+	if s.ehlo {
+		proto = "ESMTP"
+		if s.conn != nil {
+			if _, ok := s.conn.inboundTLS(); ok {
+				proto += "S"
+			}
+		}
+		if s.authUser != "" {
+			proto += "A"
+		}
+	}
+	return fmt.Sprintf("Received: from %s\r\n\tby %s with %s id %s;\r\n\t%s\r\n",
+		headerSafe(from), s.bkd.domain(), proto, s.id, time.Now().Format(time.RFC1123Z))
+}
+
+// tlsHeader records how securely the message arrived at the proxy, or "none" for plaintext connections
+func (s *Session) tlsHeader() string {
+	value := "none"
+	if s.conn != nil {
+		if cs, ok := s.conn.inboundTLS(); ok {
+			value = fmt.Sprintf("version=%s; cipher=%s", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+		}
+	}
+	return "X-Proxy-TLS: " + headerSafe(value) + "\r\n"
+}
+
+// headerSafe removes control characters, so a value can't break out of its header line
+func headerSafe(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, v)
+}
+
+// Mail loops are detected by counting the Received headers already on a message (RFC 5321 section 6.3)
+const loopCode = 554
+const loopMsg = "5.4.6 Routing loop detected"
+
+// checkHops refuses a message that has passed through more than max_hops servers, as it's probably looping
+func (s *Session) checkHops(msgHeader []byte) (int, string, error) {
+	if s.bkd.maxHops <= 0 {
+		return 0, "", nil
+	}
+	hops := len(parseHeader(msgHeader)["Received"])
+	if hops <= s.bkd.maxHops {
+		return 0, "", nil
+	}
+	s.logger("\tMessage has", hops, "Received headers, more than max_hops", s.bkd.maxHops)
+	s.logger(respTwiddle(s), loopCode, loopMsg)
+	return loopCode, loopMsg, errors.New(loopMsg)
+}
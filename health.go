@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Health checks
+//
+// With health_addr, an HTTP listener answers load balancer probes:
+//   /healthz  200 while the process is running
+//   /readyz   200 if an out_hostport upstream can be reached, greeted and (unless upstream_starttls is none) secured
+//             with STARTTLS; 503 if not, once shutdown has begun, or while paused (see admin.go). Results are cached
+//             for readyCacheTTL.
+//-----------------------------------------------------------------------------
+
+const readyCacheTTL = 5 * time.Second
+
+type readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// check returns the cached upstream check result, checking again if it's stale
+func (r *readiness) check(bkd *Backend) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < readyCacheTTL {
+		return r.err
+	}
+	r.err = bkd.checkUpstream()
+	r.checked = time.Now()
+	if r.err != nil {
+		log.Println("Readiness check failed:", r.err)
+	}
+	return r.err
+}
+
+// checkUpstream connects to out_hostport as the forwarder does, then hangs up
+func (bkd *Backend) checkUpstream() error {
+	if bkd.sink {
+		return nil
+	}
+	c, err := bkd.dialForward("")
+	if err != nil {
+		return err
+	}
+	c.Quit()
+	return nil
+}
+
+func (bkd *Backend) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (bkd *Backend) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if bkd.isStopping() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if bkd.isPaused() {
+		http.Error(w, "paused", http.StatusServiceUnavailable)
+		return
+	}
+	if err := bkd.readiness.check(bkd); err != nil {
+		http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveHealth runs the health check HTTP listener on addr
+func (bkd *Backend) serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", bkd.healthzHandler)
+	mux.HandleFunc("/readyz", bkd.readyzHandler)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
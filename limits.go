@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Per-user connection limits
+//-----------------------------------------------------------------------------
+
+const userLimitCode = 421
+const userLimitMsg = "4.7.0 Too many connections for this user, try again later"
+
+// userConns counts active authenticated sessions per username
+type userConns struct {
+	max int // 0 = unlimited
+	mu  sync.Mutex
+	n   map[string]int
+}
+
+// acquire counts a new session for user, returning false if that would exceed the limit
+func (u *userConns) acquire(user string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.max > 0 && u.n[user] >= u.max {
+		return false
+	}
+	if u.n == nil {
+		u.n = make(map[string]int)
+	}
+	u.n[user]++
+	return true
+}
+
+func (u *userConns) release(user string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.n[user] <= 1 {
+		delete(u.n, user)
+	} else {
+		u.n[user]--
+	}
+}
+
+// snapshot returns a copy of the current counts
+func (u *userConns) snapshot() map[string]int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	m := make(map[string]int, len(u.n))
+	for k, v := range u.n {
+		m[k] = v
+	}
+	return m
+}
+
+// loginAllowed checks the per-user connection limit before user authenticates
+func (s *Session) loginAllowed(user string) (int, string, error) {
+	if user == "" || s.countedUser != "" {
+		return 0, "", nil
+	}
+	if !s.bkd.userConns.acquire(user) {
+		s.logger("\tUser", user, "over connection limit")
+		return userLimitCode, userLimitMsg, errors.New(userLimitMsg)
+	}
+	s.countedUser = user
+	return 0, "", nil
+}
+
+// loginDone releases the per-user count if authentication did not succeed
+func (s *Session) loginDone(ok bool) {
+	if !ok && s.countedUser != "" {
+		s.bkd.userConns.release(s.countedUser)
+		s.countedUser = ""
+	}
+}
+
+const dialLimitCode = 421
+const dialLimitMsg = "4.3.2 Too many new connections, try again later"
+
+// dialLimiter spaces out new upstream connections, so a burst of clients reconnecting at once doesn't become a burst
+// of upstream connections. Callers queue for their turn, up to maxWait.
+type dialLimiter struct {
+	interval time.Duration // Between dials, 0 = unlimited
+	maxWait  time.Duration
+	mu       sync.Mutex
+	next     time.Time // When the next dial may start
+}
+
+// newDialLimiter allows perSec dials per second (0 = unlimited)
+func newDialLimiter(perSec float64, maxWait time.Duration) *dialLimiter {
+	d := &dialLimiter{maxWait: maxWait}
+	if perSec > 0 {
+		d.interval = time.Duration(float64(time.Second) / perSec)
+	}
+	return d
+}
+
+// wait blocks until a dial may start. Returns false, without waiting, if that would take longer than maxWait.
+func (d *dialLimiter) wait() bool {
+	if d == nil || d.interval == 0 {
+		return true
+	}
+	d.mu.Lock()
+	now := time.Now()
+	if d.next.Before(now) {
+		d.next = now
+	}
+	delay := d.next.Sub(now)
+	if delay > d.maxWait {
+		d.mu.Unlock()
+		return false
+	}
+	d.next = d.next.Add(d.interval)
+	d.mu.Unlock()
+	time.Sleep(delay)
+	return true
+}
+
+const rateLimitCode = 450
+const rateLimitMsg = "4.7.1 Sending too fast, try again later"
+
+// rateLimiter allows each client IP address a number of messages per minute, as a token bucket: the full allowance
+// may be used at once, and is then refilled at an even rate. Idle buckets are dropped once they would be full.
+type rateLimiter struct {
+	perMin    float64 // 0 = unlimited
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from ip's bucket, returning false if there are none
+func (r *rateLimiter) allow(ip string) bool {
+	if r == nil || r.perMin <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	const fill = time.Minute // Time for an empty bucket to refill
+	if now.Sub(r.lastSweep) > fill {
+		for k, b := range r.buckets {
+			if now.Sub(b.last) > fill {
+				delete(r.buckets, k)
+			}
+		}
+		r.lastSweep = now
+	}
+	if r.buckets == nil {
+		r.buckets = make(map[string]*rateBucket)
+	}
+	b, ok := r.buckets[ip]
+	if !ok {
+		b = &rateBucket{tokens: r.perMin, last: now}
+		r.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * r.perMin
+	if b.tokens > r.perMin {
+		b.tokens = r.perMin
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateAllowed checks the client's message rate limit, as a new transaction starts
+func (s *Session) rateAllowed() (int, string, error) {
+	ip := remoteHost(s.remoteAddr)
+	if ip == "" || s.bkd.rateLimiter.allow(ip) {
+		return 0, "", nil
+	}
+	s.logger("\tClient", ip, "over rate limit")
+	return rateLimitCode, rateLimitMsg, errors.New(rateLimitMsg)
+}
+
+//-----------------------------------------------------------------------------
+// Concurrent connection limit
+//-----------------------------------------------------------------------------
+
+const connLimitCode = 421
+const connLimitMsg = "4.7.0 Too many connections, try again later"
+
+// acquireConnSlot claims one of the limited client connection slots, without waiting. Returns false if all are in use.
+func (bkd *Backend) acquireConnSlot() bool {
+	if bkd.connSlots != nil {
+		select {
+		case bkd.connSlots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	atomic.AddInt64(&bkd.activeConns, 1)
+	return true
+}
+
+// releaseConnSlot frees a slot claimed by acquireConnSlot
+func (bkd *Backend) releaseConnSlot() {
+	atomic.AddInt64(&bkd.activeConns, -1)
+	if bkd.connSlots != nil {
+		<-bkd.connSlots
+	}
+}
+
+//-----------------------------------------------------------------------------
+// Recipients per message limit
+//-----------------------------------------------------------------------------
+
+const rcptLimitCode = 452
+const rcptLimitMsg = "4.5.3 Too many recipients"
+
+// checkRcptLimit refuses another recipient once the transaction has max_rcpts, without asking the upstream
+func (s *Session) checkRcptLimit() (int, string, error) {
+	if s.bkd.maxRcpts <= 0 || len(s.rcptto)+len(s.pendingRcpts) < s.bkd.maxRcpts {
+		return 0, "", nil
+	}
+	return rcptLimitCode, rcptLimitMsg, errors.New(rcptLimitMsg)
+}
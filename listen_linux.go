@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// SO_REUSEPORT, which package syscall doesn't define on Linux
+const soReusePort = 0xf
+
+// listenTCP opens the inbound listener. reusePort sets SO_REUSEPORT so several proxy processes can share the port;
+// backlog, if > 0, sets the queue length for connections not yet accepted (the kernel may cap it, e.g. at somaxconn).
+func listenTCP(addr string, reusePort bool, backlog int) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil || backlog <= 0 {
+		return l, err
+	}
+	// Go listens with the system default backlog. Calling listen() again on the socket adjusts it.
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	var lerr error
+	err = rc.Control(func(fd uintptr) {
+		lerr = syscall.Listen(int(fd), backlog)
+	})
+	if err == nil {
+		err = lerr
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// listenTCP opens the inbound listener. Socket tuning isn't supported on this platform.
+func listenTCP(addr string, reusePort bool, backlog int) (net.Listener, error) {
+	if reusePort || backlog > 0 {
+		return nil, errors.New("reuse_port and listen_backlog are not supported on this platform")
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// Per-connection serving
+//
+// Backend.Init() isn't told which client connection a Session belongs to, or when that connection goes away.
+// So we run our own accept loop, and give each client connection its own smtpproxy.Server driving a connBackend.
+//
+// The smtps_hostport listener is served the same way, but each connection is TLS from the start (implicit TLS, usually
+// port 465). The handshake is done here, after any PROXY protocol header, so it has no STARTTLS, and its server
+// allows AUTH at once, as it can't see the TLS underneath our connection wrappers.
+//-----------------------------------------------------------------------------
+
+const smtpsHandshakeTimeout = 10 * time.Second
+
+// serverFactory returns an smtpproxy.Server with our configuration, driving the given backend
+type serverFactory func(be smtpproxy.Backend) *smtpproxy.Server
+
+// serve accepts client connections from l until it fails. implicitTLS is set for an SMTPS listener.
+func (bkd *Backend) serve(l net.Listener, newServer serverFactory, implicitTLS *tls.Config) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		bkd.sessions.Add(1)
+		go bkd.serveConn(c, newServer, implicitTLS)
+	}
+}
+
+// serveConn runs the SMTP conversation for one client connection, returning when the connection is closed
+func (bkd *Backend) serveConn(c net.Conn, newServer serverFactory, implicitTLS *tls.Config) {
+	defer bkd.sessions.Done()
+	if bkd.proxyProtocol {
+		pc, err := readProxyHeader(c)
+		if err != nil {
+			log.Println("PROXY protocol error from", remoteHost(c.RemoteAddr())+":", err)
+			c.Close()
+			return
+		}
+		c = pc
+	}
+	if !bkd.allowNetworks.allows(c.RemoteAddr()) {
+		log.Println("Client", remoteHost(c.RemoteAddr()), "not in allow_networks, refused")
+		if implicitTLS != nil {
+			c.Close() // a plaintext reply would mean nothing to an SMTPS client
+		} else {
+			refuseConn(c, networkDeniedCode, networkDeniedMsg)
+		}
+		return
+	}
+	var tlsState *tls.ConnectionState
+	if implicitTLS != nil {
+		tc := tls.Server(c, implicitTLS)
+		tc.SetDeadline(time.Now().Add(smtpsHandshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			bkd.logger("SMTPS handshake error from", remoteHost(c.RemoteAddr())+":", err)
+			c.Close()
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		cs := tc.ConnectionState()
+		c, tlsState = tc, &cs
+	}
+	if bkd.isPaused() {
+		bkd.logger("Paused, refusing client", remoteHost(c.RemoteAddr()))
+		refuseConn(c, pausedCode, pausedMsg)
+		return
+	}
+	if !bkd.acquireConnSlot() {
+		log.Println("Connection limit reached, refusing client", remoteHost(c.RemoteAddr()))
+		refuseConn(c, connLimitCode, connLimitMsg)
+		return
+	}
+	defer bkd.releaseConnSlot()
+	if !bkd.checkFCrDNS(c.RemoteAddr()) {
+		refuseConn(c, fcrdnsRejectCode, fcrdnsRejectMsg)
+		return
+	}
+	if !bkd.sink && !bkd.dialLimiter.wait() {
+		log.Println("Upstream dial rate limit reached, refusing client", remoteHost(c.RemoteAddr()))
+		refuseConn(c, dialLimitCode, dialLimitMsg)
+		return
+	}
+	cb := &connBackend{bkd: bkd, id: newSessionID(), remote: c.RemoteAddr(), tls: tlsState}
+	capture := bkd.openCapture(cb.id, cb.remote)
+	debugFile := bkd.openDebugFile(cb.id, cb.remote)
+	done := make(chan struct{})
+	tc := &trackedConn{Conn: c, onClose: func() {
+		user := cb.closed()
+		if capture != nil {
+			capture.finish(cb.remote, user)
+		}
+		if debugFile != nil {
+			debugFile.Close()
+		}
+		close(done)
+	}}
+	tc.sniffHelo = bkd.forwardHelo
+	cb.conn = tc
+	bkd.track(cb)
+	defer bkd.untrack(cb)
+	srv := newServer(cb)
+	if implicitTLS != nil {
+		srv.TLSConfig = nil // No STARTTLS within TLS
+		srv.AllowInsecureAuth = true
+	}
+	if srv.TLSConfig != nil {
+		// Note the inbound TLS details for this connection once the handshake completes
+		srv.TLSConfig = srv.TLSConfig.Clone()
+		srv.TLSConfig.VerifyConnection = cb.verifyConnection
+	}
+	if capture != nil {
+		if srv.Debug != nil {
+			srv.Debug = io.MultiWriter(srv.Debug, capture)
+		} else {
+			srv.Debug = capture
+		}
+	}
+	if debugFile != nil {
+		if srv.Debug != nil {
+			srv.Debug = io.MultiWriter(srv.Debug, debugFile)
+		} else {
+			srv.Debug = debugFile
+		}
+	}
+	if srv.Debug != nil {
+		srv.Debug = newRedactingWriter(srv.Debug)
+	}
+	srv.Serve(&oneConnListener{conn: tc, done: done})
+}
+
+// refuseConn sends a final response in place of the SMTP greeting, and closes the connection
+func refuseConn(c net.Conn, code int, msg string) {
+	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(c, "%d %s\r\n", code, msg)
+	c.Close()
+}
+
+// connBackend creates the Session for a single client connection
+type connBackend struct {
+	bkd    *Backend
+	id     string // Session ID
+	remote net.Addr
+	mu     sync.Mutex
+	sess   *Session
+	tls    *tls.ConnectionState // Inbound TLS state, once negotiated
+	conn   *trackedConn
+
+	relaying int32 // A message is being relayed (atomic)
+	draining int32 // End the session as soon as it's not relaying a message (atomic)
+}
+
+// Init the session for this connection's client
+func (cb *connBackend) Init() (smtpproxy.Session, error) {
+	s, err := cb.bkd.newSession(cb.id, cb.remote)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = cb
+	cb.mu.Lock()
+	cb.sess = s
+	cb.mu.Unlock()
+	return cb.bkd.clientSession(s), nil
+}
+
+// verifyConnection records the inbound TLS connection state. It does no verification of its own.
+func (cb *connBackend) verifyConnection(cs tls.ConnectionState) error {
+	cb.mu.Lock()
+	cb.tls = &cs
+	cb.mu.Unlock()
+	return nil
+}
+
+// inboundTLS returns the client connection's TLS state, if it is encrypted
+func (cb *connBackend) inboundTLS() (tls.ConnectionState, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.tls == nil {
+		return tls.ConnectionState{}, false
+	}
+	return *cb.tls, true
+}
+
+// hangup ends the session once the current response has been sent
+func (cb *connBackend) hangup() {
+	atomic.StoreInt32(&cb.conn.hungUp, 1)
+}
+
+// closed is called once, when the client connection closes. Returns the user the session authenticated as, if any.
+func (cb *connBackend) closed() string {
+	cb.mu.Lock()
+	s := cb.sess
+	cb.mu.Unlock()
+	if s == nil {
+		return ""
+	}
+	s.logout()
+	return s.authUser
+}
+
+// trackedConn calls onClose the first time the connection is closed
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+	hungUp  int32 // Reads give EOF, so the server ends the session (atomic)
+
+	sniffHelo bool   // Note the client's EHLO / HELO name, until the first MAIL or STARTTLS
+	heloLine  []byte // Start of a command line not yet completely read
+	heloMu    sync.Mutex
+	helo      string
+}
+
+// heloLineMax is the longest command line sniffed for EHLO / HELO (RFC 5321 section 4.5.3.1.4)
+const heloLineMax = 512
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.hungUp) != 0 {
+		return 0, io.EOF
+	}
+	n, err := c.Conn.Read(b)
+	if c.sniffHelo && n > 0 {
+		c.noteHelo(b[:n])
+	}
+	return n, err
+}
+
+// noteHelo looks for an EHLO or HELO command in data read from the client. The server doesn't pass the client's
+// name to the backend, so this is how we learn it. A command may arrive split across reads, so an incomplete line is
+// kept for the next. Sniffing stops at the first MAIL, so message content can't change the name, and at STARTTLS, as
+// the connection only sees ciphertext after it; the name is the one given before.
+func (c *trackedConn) noteHelo(data []byte) {
+	c.heloLine = append(c.heloLine, data...)
+	for {
+		i := bytes.IndexByte(c.heloLine, '\n')
+		if i < 0 {
+			break
+		}
+		f := strings.Fields(string(c.heloLine[:i]))
+		c.heloLine = c.heloLine[i+1:]
+		if len(f) == 0 {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "EHLO", "HELO":
+			if len(f) == 2 {
+				c.heloMu.Lock()
+				c.helo = f[1]
+				c.heloMu.Unlock()
+			}
+		case "MAIL", "STARTTLS":
+			c.sniffHelo = false
+			c.heloLine = nil
+			return
+		}
+	}
+	if len(c.heloLine) > heloLineMax {
+		c.sniffHelo = false // not an SMTP client, or not one worth learning a name from
+		c.heloLine = nil
+		return
+	}
+	c.heloLine = append([]byte(nil), c.heloLine...)
+}
+
+// heloName returns the name the client last gave in EHLO or HELO, if known
+func (c *trackedConn) heloName() string {
+	c.heloMu.Lock()
+	defer c.heloMu.Unlock()
+	return c.helo
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.onClose)
+	return err
+}
+
+var errConnServed = errors.New("connection already served")
+
+// oneConnListener hands out a single connection, then blocks until that connection is done
+type oneConnListener struct {
+	conn   net.Conn
+	done   chan struct{}
+	served bool
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if !l.served {
+		l.served = true
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, errConnServed
+}
+
+func (l *oneConnListener) Close() error {
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestNoteHelo(t *testing.T) {
+	cases := []struct {
+		name  string
+		reads []string
+		want  string
+	}{
+		{"ehlo", []string{"EHLO client.example.com\r\n"}, "client.example.com"},
+		{"helo lower case", []string{"helo client.example.com\r\n"}, "client.example.com"},
+		{"split across reads", []string{"EH", "LO client.exa", "mple.com\r\n"}, "client.example.com"},
+		{"repeated before MAIL", []string{"EHLO one.example\r\nRSET\r\nEHLO two.example\r\n"}, "two.example"},
+		{"ignored in DATA", []string{"EHLO real.example\r\nMAIL FROM:<a@example.com>\r\n", "DATA\r\nEHLO forged.example\r\n.\r\n"}, "real.example"},
+		{"ignored after STARTTLS", []string{"EHLO real.example\r\nSTARTTLS\r\n", "EHLO forged.example\r\n"}, "real.example"},
+		{"incomplete line", []string{"EHLO partial.example"}, ""},
+	}
+	for _, tc := range cases {
+		c := &trackedConn{sniffHelo: true}
+		for _, r := range tc.reads {
+			if c.sniffHelo {
+				c.noteHelo([]byte(r))
+			}
+		}
+		if got := c.heloName(); got != tc.want {
+			t.Errorf("%s: heloName() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
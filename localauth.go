@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//-----------------------------------------------------------------------------
+// Local client authentication
+//
+// With local_auth_file, clients authenticate against the proxy's own user list rather than the upstream's: an
+// htpasswd-style file of "user:hash" lines, with bcrypt hashes (htpasswd -B). The proxy then authenticates upstream
+// as the upstream_user service account, if set, so clients never hold the upstream credentials. Client usernames are
+// still what's logged and counted against per-user limits.
+//-----------------------------------------------------------------------------
+
+const localAuthFailCode = 535
+const localAuthFailMsg = "5.7.8 Authentication credentials invalid"
+
+// loadLocalUsers reads a local_auth_file
+func loadLocalUsers(file string) (map[string]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.SplitN(line, ":", 2)
+		if len(f) != 2 || !strings.HasPrefix(f[1], "$2") {
+			return nil, fmt.Errorf("%s line %d: not user:bcrypt-hash", file, i+1)
+		}
+		users[f[0]] = f[1]
+	}
+	return users, nil
+}
+
+// checkLocalUser validates the client's credentials against local_auth_file
+func (s *Session) checkLocalUser(cr credentials) (int, string, error) {
+	hash, ok := s.bkd.localUsers[cr.user]
+	if ok && bcrypt.CompareHashAndPassword([]byte(hash), []byte(cr.secret)) == nil {
+		s.logger("\tLocal AUTH succeeded for", cr.user)
+		return 0, "", nil
+	}
+	s.logger("\tLocal AUTH failed for", cr.user)
+	return localAuthFailCode, localAuthFailMsg, errors.New(localAuthFailMsg)
+}
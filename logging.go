@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Log formats
+//
+// With log_format json, each log line is a JSON object, for log shippers. Session log lines carry the session's
+// details in fields of their own; other lines (startup, alerts etc.) have just time, event "log" and msg. In text
+// format, session log lines start with the session ID in brackets, so one session can be picked out of many with grep.
+//-----------------------------------------------------------------------------
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logEntry is a log line in JSON format
+type logEntry struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"` // command, response, session, info or log
+	Session    string    `json:"session,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	User       string    `json:"auth_user,omitempty"`
+	MailFrom   string    `json:"mailfrom,omitempty"`
+	RcptCount  int       `json:"rcpt_count,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Msg        string    `json:"msg,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// logLineWriter turns the log package's text lines into JSON entries
+type logLineWriter struct {
+	j *jsonLog
+}
+
+func (w logLineWriter) Write(p []byte) (int, error) {
+	err := w.j.write(logEntry{Time: time.Now(), Event: "log", Msg: strings.TrimSpace(string(p))})
+	return len(p), err
+}
+
+// setLogFormat directs the log package's output to stderr in the given format, returning the JSON writer if any
+func setLogFormat(format string) (*jsonLog, error) {
+	switch format {
+	case logFormatText:
+		return nil, nil
+	case logFormatJSON:
+		j := &jsonLog{w: os.Stderr}
+		log.SetFlags(0)
+		log.SetOutput(logLineWriter{j})
+		return j, nil
+	}
+	return nil, fmt.Errorf("unknown log_format %q", format)
+}
+
+// logger logs a verbose line about the session. The first argument may be a flow marker (see cmdTwiddle), or a
+// "---" heading; in JSON format these give the event type.
+func (s *Session) logger(args ...interface{}) {
+	if !s.bkd.verbose {
+		return
+	}
+	if s.bkd.logJSON == nil {
+		log.Println(append([]interface{}{"[" + s.id + "]"}, args...)...)
+		return
+	}
+	e := logEntry{
+		Time:      time.Now(),
+		Event:     "info",
+		Session:   s.id,
+		User:      s.authUser,
+		MailFrom:  s.mailfrom,
+		RcptCount: len(s.rcptto),
+		Upstream:  s.upstreamHost,
+	}
+	if s.remoteAddr != nil {
+		e.RemoteAddr = s.remoteAddr.String()
+	}
+	var msg []string
+	for i, a := range args {
+		if err, ok := a.(error); ok && e.Error == "" {
+			e.Error = err.Error()
+			continue
+		}
+		text := strings.TrimSpace(fmt.Sprint(a))
+		if i == 0 {
+			switch {
+			case text == "->" || text == "~>":
+				e.Event = "command"
+				continue
+			case text == "<-" || text == "<~":
+				e.Event = "response"
+				continue
+			case strings.HasPrefix(text, "---"):
+				e.Event = "session"
+				text = strings.TrimLeft(text, "-")
+			}
+		}
+		if text != "" {
+			msg = append(msg, text)
+		}
+	}
+	e.Msg = strings.Join(msg, " ")
+	if err := s.bkd.logJSON.write(e); err != nil {
+		log.Println("Log write error", err)
+	}
+}
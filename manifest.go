@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Startup manifest: the effective configuration, for auditing what's actually running
+//-----------------------------------------------------------------------------
+
+// Flags whose names contain any of these have their values redacted
+var redactedFlagWords = []string{"pass", "secret", "token", "webhook"}
+
+const redacted = "(redacted)"
+
+type manifest struct {
+	Time        time.Time         `json:"time"`
+	Flags       map[string]string `json:"flags"`
+	CertSubject string            `json:"cert_subject,omitempty"`
+	Domain      string            `json:"domain"`
+	Features    []string          `json:"features"`
+}
+
+// flagValues returns every flag's resolved value, with secrets redacted
+func flagValues() map[string]string {
+	m := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		for _, w := range redactedFlagWords {
+			if v != "" && strings.Contains(f.Name, w) {
+				v = redacted
+			}
+		}
+		m[f.Name] = v
+	})
+	return m
+}
+
+// features lists the optional features that are enabled
+func (bkd *Backend) features(startTLS bool) []string {
+	f := []string{}
+	add := func(on bool, name string) {
+		if on {
+			f = append(f, name)
+		}
+	}
+	add(startTLS, "inbound_starttls")
+	add(bkd.requireUpstreamTLS, "require_upstream_tls")
+	add(bkd.upstreamImplicitTLS, "upstream_implicit_tls")
+	add(bkd.upstreamCAs != nil, "upstream_ca")
+	add(bkd.upstreamInsecure, "upstream_insecure")
+	add(bkd.upstreamAuth != authPassthru, "proxy_auth")
+	add(bkd.fixLineEndings, "fix_line_endings")
+	add(bkd.verp != "", "verp")
+	add(bkd.splitRecipients, "split_recipients")
+	add(len(bkd.rcptRoutes) > 0, "recipient_routes")
+	add(bkd.storeAndForward, "store_and_forward")
+	add(bkd.sink, "sink")
+	add(bkd.dataRetries > 0, "data_retries")
+	add(bkd.xclient, "xclient")
+	add(bkd.forwardHelo, "forward_helo")
+	add(bkd.pipelineRcpt, "pipeline_rcpt")
+	add(bkd.adminToken != "", "admin_token")
+	add(bkd.suppression != nil, "suppression_list")
+	add(bkd.pool != nil, "pool")
+	add(bkd.archiveRelay != "", "archive_relay")
+	add(bkd.archiveMode == archiveModeRcpt, "archive_rcpt")
+	add(len(bkd.archiveMap) > 0, "archive_map")
+	add(bkd.proxyProtocol, "proxy_protocol")
+	add(bkd.forceMessageID, "force_message_id")
+	add(bkd.spf != spfOff, "spf")
+	add(bkd.captureDir != "", "capture")
+	add(bkd.debugDir != "", "debug_dir")
+	add(bkd.authAlarm != nil && bkd.authAlarm.threshold > 0, "auth_alerts")
+	add(bkd.userConns.max > 0, "max_conns_per_user")
+	add(bkd.dataSlots != nil, "max_concurrent_data")
+	add(bkd.connSlots != nil, "max_connections")
+	add(bkd.accessLog != nil, "access_log")
+	add(bkd.allowInsecureAuth, "allow_insecure_auth")
+	add(bkd.addReceivedHeader, "add_received_header")
+	add(bkd.maxHops > 0, "max_hops")
+	add(bkd.addTLSHeader, "add_tls_header")
+	add(bkd.traceEnvelopes, "trace_envelopes")
+	add(bkd.generateDSN, "generate_dsn")
+	add(bkd.upstreamTTL > 0, "upstream_conn_ttl")
+	add(bkd.upstreamReconnect, "upstream_reconnect")
+	add(bkd.upstreamProxy != nil, "upstream_proxy")
+	add(bkd.dialLimiter != nil, "max_upstream_dials_per_sec")
+	add(bkd.fcrdns != fcrdnsOff, "require_fcrdns")
+	add(len(bkd.allowNetworks) > 0, "allow_networks")
+	add(bkd.policy != nil, "policy_script")
+	add(bkd.rspamdAddr != "", "rspamd")
+	add(bkd.allowSenders != nil, "allow_senders")
+	add(bkd.rewrites != nil, "rewrite_map")
+	add(len(bkd.denyRcpts) > 0, "deny_rcpt")
+	add(bkd.dkim != nil, "dkim")
+	add(bkd.headerRules != nil, "header_rules")
+	add(bkd.stripMsysAPI, "strip_msys_api")
+	add(bkd.maxSize > 0, "max_size")
+	add(bkd.maxRcpts > 0, "max_rcpts")
+	add(bkd.rateLimiter != nil, "rate_limit")
+	add(bkd.greylist != nil, "greylist")
+	add(bkd.localUsers != nil, "local_auth")
+	add(bkd.serviceCreds != nil, "upstream_service_account")
+	add(bkd.tokens != nil, "token_refresh")
+	add(bkd.maskErrors, "mask_errors")
+	add(bkd.errorMessages != nil, "error_messages")
+	add(bkd.allowedCommands != nil, "allowed_commands")
+	add(bkd.usageLog != nil, "usage_log")
+	add(bkd.messageLog != nil, "message_log")
+	return f
+}
+
+// writeManifest writes m as JSON to the named file, or to stdout if name is "-"
+func writeManifest(name string, m manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if name == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(name, b, 0600)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// Error response masking
+//
+// Upstream rejections can name internal hosts. With mask_errors, the text of every failure response (4xx and 5xx)
+// sent to clients is replaced with a generic message, keeping the reply code and any enhanced status code. With
+// error_messages, a file of "code message" lines (# comments allowed), responses with a listed code get that message
+// instead, whether or not mask_errors is set. The original text is still logged.
+//-----------------------------------------------------------------------------
+
+const maskedTempMsg = "Temporary failure, try again later"
+const maskedPermMsg = "Request refused"
+
+var enhancedCodePattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// loadErrorMessages reads an error_messages file
+func loadErrorMessages(file string) (map[int]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[int]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.SplitN(line, " ", 2)
+		code, err := strconv.Atoi(f[0])
+		if err != nil || code < 400 || code > 599 || len(f) != 2 {
+			return nil, fmt.Errorf("%s line %d: not a 4xx/5xx code and message", file, i+1)
+		}
+		m[code] = strings.TrimSpace(f[1])
+	}
+	return m, nil
+}
+
+// maskResponse returns the text to send a client with a response code, per mask_errors and error_messages
+func (bkd *Backend) maskResponse(code int, msg string) string {
+	if code < 400 {
+		return msg
+	}
+	text, ok := bkd.errorMessages[code]
+	if !ok {
+		if !bkd.maskErrors {
+			return msg
+		}
+		text = maskedPermMsg
+		if code < 500 {
+			text = maskedTempMsg
+		}
+	}
+	if enhanced := enhancedCodePattern.FindString(msg); enhanced != "" {
+		return enhanced + " " + text
+	}
+	return text
+}
+
+// maskedSession passes each response a Session gives the client through maskResponse
+type maskedSession struct {
+	*Session
+}
+
+func (m maskedSession) Greet(helotype string) ([]string, int, string, error) {
+	caps, code, msg, err := m.Session.Greet(helotype)
+	return caps, code, m.bkd.maskResponse(code, msg), err
+}
+
+func (m maskedSession) StartTLS() (int, string, error) {
+	return m.mask(m.Session.StartTLS())
+}
+
+func (m maskedSession) Auth(expectcode int, cmd, arg string) (int, string, error) {
+	return m.mask(m.Session.Auth(expectcode, cmd, arg))
+}
+
+func (m maskedSession) Mail(expectcode int, cmd, arg string) (int, string, error) {
+	return m.mask(m.Session.Mail(expectcode, cmd, arg))
+}
+
+func (m maskedSession) Rcpt(expectcode int, cmd, arg string) (int, string, error) {
+	return m.mask(m.Session.Rcpt(expectcode, cmd, arg))
+}
+
+func (m maskedSession) Reset(expectcode int, cmd, arg string) (int, string, error) {
+	return m.mask(m.Session.Reset(expectcode, cmd, arg))
+}
+
+func (m maskedSession) Quit(expectcode int, cmd, arg string) (int, string, error) {
+	return m.mask(m.Session.Quit(expectcode, cmd, arg))
+}
+
+func (m maskedSession) Unknown(expectcode int, cmd, arg string) (int, string, error) {
+	return m.mask(m.Session.Unknown(expectcode, cmd, arg))
+}
+
+func (m maskedSession) DataCommand() (io.WriteCloser, int, string, error) {
+	w, code, msg, err := m.Session.DataCommand()
+	return w, code, m.bkd.maskResponse(code, msg), err
+}
+
+func (m maskedSession) Data(r io.Reader, w io.WriteCloser) (int, string, error) {
+	return m.mask(m.Session.Data(r, w))
+}
+
+func (m maskedSession) mask(code int, msg string, err error) (int, string, error) {
+	return code, m.bkd.maskResponse(code, msg), err
+}
+
+// clientSession returns s as the client should see it
+func (bkd *Backend) clientSession(s *Session) smtpproxy.Session {
+	if bkd.maskErrors || bkd.errorMessages != nil {
+		return maskedSession{s}
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+)
+
+//-----------------------------------------------------------------------------
+// Message parsing
+//-----------------------------------------------------------------------------
+
+// Header blocks longer than this are not parsed; the message is still relayed intact
+const maxHeaderBytes = 1024 * 1024
+
+// readHeader reads the message header block from r, up to and including the blank line that ends it. Returns the
+// header bytes, and a reader for the remainder of the message (the body).
+func readHeader(r io.Reader) ([]byte, io.Reader, error) {
+	br := bufio.NewReader(r)
+	var hdr []byte
+	midLine := false // the last read ended partway through a long line
+	for len(hdr) < maxHeaderBytes {
+		line, err := br.ReadSlice('\n')
+		hdr = append(hdr, line...)
+		if err == bufio.ErrBufferFull {
+			midLine = true
+			continue
+		}
+		if err == io.EOF {
+			break // message is all header
+		}
+		if err != nil {
+			return hdr, br, err
+		}
+		if !midLine && (string(line) == "\r\n" || string(line) == "\n") {
+			break
+		}
+		midLine = false
+	}
+	return hdr, br, nil
+}
+
+// parseHeader returns the header fields from a header block. Malformed blocks give whatever could be parsed.
+func parseHeader(hdr []byte) textproto.MIMEHeader {
+	h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(hdr))).ReadMIMEHeader()
+	if h == nil {
+		h = make(textproto.MIMEHeader)
+	}
+	return h
+}
+
+const correlationHeader = "X-Correlation-Id"
+const maxCorrelationLen = 128
+
+// correlationID returns the client's correlation ID from the message header, if present and sane
+func correlationID(h textproto.MIMEHeader) string {
+	id := headerSafe(h.Get(correlationHeader))
+	if len(id) > maxCorrelationLen {
+		id = id[:maxCorrelationLen]
+	}
+	return id
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+)
+
+//-----------------------------------------------------------------------------
+// Message-ID generation
+//
+// With force_message_id, messages arriving without a Message-ID header get one, in the add stage, made from a random
+// UUID and the proxy's domain. Messages that already have one, in any letter case, are left alone.
+//-----------------------------------------------------------------------------
+
+// hasMessageID tells whether the message header includes a Message-ID field
+func hasMessageID(msg []byte) bool {
+	hdr, _, _ := readHeader(bytes.NewReader(msg))
+	fields, _ := headerFields(hdr)
+	for _, f := range fields {
+		if fieldName(f) == "message-id" {
+			return true
+		}
+	}
+	return false
+}
+
+// newMessageID returns a Message-ID of the form <uuid@domain>, using a version 4 UUID
+func newMessageID(domain string) string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("<%x-%x-%x-%x-%x@%s>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:], domain)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Message transform pipeline
+//
+// Content features that edit or judge a buffered message run as stages, in transform_order. Order matters: e.g. a
+// scan placed after add sees the proxy's added headers, and a signature must come after every header edit. Every
+// stage is listed exactly once; stages whose feature is not enabled pass the message through unchanged.
+//
+// Messages that are streamed rather than buffered only get the add stage, prepended as the message is relayed.
+//-----------------------------------------------------------------------------
+
+// Transform stages
+const (
+	transformAdd     = "add"     // Add the proxy's headers, e.g. add_tls_header, and any missing Message-ID
+	transformHeaders = "headers" // Apply header_rules
+	transformScan    = "scan"    // Check the message with policy_script, then rspamd_addr
+	transformSign    = "sign"    // DKIM-sign the message
+)
+
+var transformStages = []string{transformAdd, transformHeaders, transformScan, transformSign}
+
+const defaultTransformOrder = "add,headers,scan,sign"
+
+// A transformFunc returns the message, possibly changed, or a non-zero code to reject it
+type transformFunc func(s *Session, msg []byte) ([]byte, int, string, error)
+
+var transformFuncs = map[string]transformFunc{
+	transformAdd:     (*Session).transformAdd,
+	transformHeaders: (*Session).transformHeaders,
+	transformScan:    (*Session).transformScan,
+	transformSign:    (*Session).transformSign,
+}
+
+// transformRules are ordering constraints: the first stage, where listed, must come before the second
+var transformRules = [][2]string{
+	{transformAdd, transformSign},
+	{transformHeaders, transformSign},
+}
+
+// parseTransformOrder checks a comma-separated stage list names every stage once, in a permitted order
+func parseTransformOrder(list string) ([]string, error) {
+	var order []string
+	pos := make(map[string]int)
+	for _, t := range strings.Split(list, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if !Contains(transformStages, t) {
+			return nil, fmt.Errorf("unknown transform stage %q", t)
+		}
+		if _, dup := pos[t]; dup {
+			return nil, fmt.Errorf("transform stage %q listed twice", t)
+		}
+		pos[t] = len(order)
+		order = append(order, t)
+	}
+	for _, t := range transformStages {
+		if _, ok := pos[t]; !ok {
+			return nil, fmt.Errorf("transform stage %q missing", t)
+		}
+	}
+	for _, r := range transformRules {
+		if pos[r[0]] > pos[r[1]] {
+			return nil, fmt.Errorf("transform stage %q must come before %q", r[0], r[1])
+		}
+	}
+	return order, nil
+}
+
+// transform runs the buffered message through each stage in turn. A non-zero code means a stage rejected it.
+func (s *Session) transform(msg []byte) ([]byte, int, string, error) {
+	for _, t := range s.bkd.transformOrder {
+		var (
+			code    int
+			respMsg string
+			err     error
+		)
+		msg, code, respMsg, err = transformFuncs[t](s, msg)
+		if code != 0 {
+			return msg, code, respMsg, err
+		}
+	}
+	return msg, 0, "", nil
+}
+
+func (s *Session) transformAdd(msg []byte) ([]byte, int, string, error) {
+	hdr := s.addedHeaders()
+	if s.bkd.forceMessageID && !hasMessageID(msg) {
+		id := newMessageID(s.bkd.domain())
+		s.logger("\tAdding Message-ID:", id)
+		hdr += "Message-ID: " + id + "\r\n"
+	}
+	if hdr == "" {
+		return msg, 0, "", nil
+	}
+	return append([]byte(hdr), msg...), 0, "", nil
+}
+
+func (s *Session) transformScan(msg []byte) ([]byte, int, string, error) {
+	if s.bkd.policy != nil {
+		hdr, _, _ := readHeader(bytes.NewReader(msg))
+		if code, respMsg, err := s.checkPolicy(policyData, "", parseHeader(hdr)); code != 0 {
+			return msg, code, respMsg, err
+		}
+	}
+	if s.bkd.rspamdAddr == "" {
+		return msg, 0, "", nil
+	}
+	return s.rspamdScan(msg)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTransformOrder(t *testing.T) {
+	cases := []struct {
+		list    string
+		wantErr string // empty for a valid order
+	}{
+		{defaultTransformOrder, ""},
+		{"scan,add,headers,sign", ""},
+		{"headers, ADD ,scan,sign", ""},
+		{"add,scan,sign,headers", `"headers" must come before "sign"`},
+		{"sign,add,headers,scan", `"add" must come before "sign"`},
+		{"add,headers,scan", `"sign" missing`},
+		{"add,headers,scan,sign,add", `"add" listed twice`},
+		{"add,headers,scan,sign,compress", `unknown transform stage "compress"`},
+	}
+	for _, tc := range cases {
+		order, err := parseTransformOrder(tc.list)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", tc.list, err)
+			} else if len(order) != len(transformStages) {
+				t.Errorf("%q: got %q", tc.list, order)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%q: got error %v, want %q", tc.list, err, tc.wantErr)
+		}
+	}
+}
+
+func TestTransformRunsInOrder(t *testing.T) {
+	rule, err := parseHeaderRule("remove Message-ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("Subject: test\r\n\r\nHello\r\n")
+	cases := []struct {
+		order  string
+		wantID bool
+	}{
+		{"add,headers,scan,sign", false}, // the added Message-ID is then removed
+		{"headers,add,scan,sign", true},  // the Message-ID is added after the rules have run
+	}
+	for _, tc := range cases {
+		order, err := parseTransformOrder(tc.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Session{bkd: &Backend{transformOrder: order, forceMessageID: true, headerRules: []headerRule{rule}}}
+		out, code, _, _ := s.transform(msg)
+		if code != 0 {
+			t.Fatalf("%s: rejected with %d", tc.order, code)
+		}
+		if got := hasMessageID(out); got != tc.wantID {
+			t.Errorf("%s: Message-ID present = %v, want %v\n%s", tc.order, got, tc.wantID, out)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+//-----------------------------------------------------------------------------
+// Policy script
+//
+// With policy_script, a CEL expression (https://github.com/google/cel-go) is evaluated for each RCPT TO, and again at
+// the end of DATA, as the "scan" transform stage (see pipeline.go). It sees these variables:
+//   stage     "rcpt" or "data"
+//   mailfrom  envelope sender
+//   rcpt      the recipient being added (empty at the "data" stage)
+//   rcpts     recipients accepted so far
+//   client_ip client IP address
+//   auth_user authenticated username, if known
+//   headers   message header fields, first value of each, keyed by canonical name (empty at the "rcpt" stage)
+// The expression returns either a bool (true to accept, false to reject with 550), or a string: empty to accept, or an
+// SMTP reply such as "550 5.7.1 Not from here" to reject with.
+//
+// e.g. stage == "rcpt" && rcpt.endsWith("@example.com") ? "550 5.7.1 Relay to example.com not allowed" : ""
+//-----------------------------------------------------------------------------
+
+// Policy stages
+const (
+	policyRcpt = "rcpt"
+	policyData = "data"
+)
+
+const policyRejectCode = 550
+const policyRejectMsg = "5.7.1 Rejected by policy"
+const policyErrorCode = 451
+const policyErrorMsg = "4.3.0 Policy check failed, try again later"
+
+type policy struct {
+	prg cel.Program
+}
+
+// loadPolicy compiles the policy expression in the named file
+func loadPolicy(name string) (*policy, error) {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	env, err := cel.NewEnv(
+		cel.Variable("stage", cel.StringType),
+		cel.Variable("mailfrom", cel.StringType),
+		cel.Variable("rcpt", cel.StringType),
+		cel.Variable("rcpts", cel.ListType(cel.StringType)),
+		cel.Variable("client_ip", cel.StringType),
+		cel.Variable("auth_user", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(string(src))
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &policy{prg: prg}, nil
+}
+
+// eval runs the policy. Returns code 0 to accept, else the rejection to give the client.
+func (p *policy) eval(vars map[string]interface{}) (int, string, error) {
+	out, _, err := p.prg.Eval(vars)
+	if err != nil {
+		return 0, "", err
+	}
+	switch v := out.Value().(type) {
+	case bool:
+		if v {
+			return 0, "", nil
+		}
+		return policyRejectCode, policyRejectMsg, nil
+	case string:
+		if v == "" {
+			return 0, "", nil
+		}
+		return parsePolicyReply(v)
+	default:
+		return 0, "", fmt.Errorf("policy returned %T, want bool or string", v)
+	}
+}
+
+// parsePolicyReply splits "550 5.7.1 text" into code and message. Only 4xx and 5xx codes can be used to reject.
+func parsePolicyReply(reply string) (int, string, error) {
+	f := strings.SplitN(strings.TrimSpace(reply), " ", 2)
+	code, err := strconv.Atoi(f[0])
+	if err != nil || code < 400 || code > 599 {
+		return 0, "", errors.New("policy reply must start with a 4xx or 5xx code: " + reply)
+	}
+	msg := policyRejectMsg
+	if len(f) > 1 {
+		msg = headerSafe(f[1])
+	}
+	return code, msg, nil
+}
+
+// checkPolicy evaluates the policy script, if any, at the given stage. Returns code 0 if the command may proceed,
+// else the response to give the client. Script errors fail safe, with a temporary error.
+func (s *Session) checkPolicy(stage, rcpt string, h textproto.MIMEHeader) (int, string, error) {
+	if s.bkd.policy == nil {
+		return 0, "", nil
+	}
+	headers := make(map[string]string, len(h))
+	for k, v := range h {
+		if len(v) > 0 {
+			headers[k] = v[0]
+		}
+	}
+	rcpts := s.rcptto
+	if rcpts == nil {
+		rcpts = []string{}
+	}
+	code, msg, err := s.bkd.policy.eval(map[string]interface{}{
+		"stage":     stage,
+		"mailfrom":  s.mailfrom,
+		"rcpt":      rcpt,
+		"rcpts":     rcpts,
+		"client_ip": remoteHost(s.remoteAddr),
+		"auth_user": s.authUser,
+		"headers":   headers,
+	})
+	if err != nil {
+		s.logger("\tPolicy script error at", stage, "stage:", err)
+		return policyErrorCode, policyErrorMsg, errors.New(policyErrorMsg)
+	}
+	if code != 0 {
+		s.logger("\tPolicy rejected at", stage, "stage:", code, msg)
+		return code, msg, errors.New(msg)
+	}
+	return 0, "", nil
+}
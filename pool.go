@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// Upstream connection pool
+//
+// With pool_size, authenticated upstream connections are kept when their client session ends, and handed to a later
+// session that authenticates with exactly the same credentials, saving the upstream a TLS handshake and AUTH. Pooled
+// connections are keyed by a hash of the credentials, so a client can only be given a connection that was
+// authenticated with its own. Sessions that end mid-transaction don't return their connection, and each one is checked
+// with RSET before reuse. The new session's own upstream connection is closed in favour of the pooled one.
+//
+// A session that will be pooled answers the client's QUIT itself, rather than relaying it and ending the upstream
+// connection it's about to hand on. Connections left idle for poolIdleTimeout are closed by a reaper, whether or not
+// their key is asked for again.
+//
+// Pooling can't be combined with xclient: a pooled connection carries the XCLIENT identity of the client that opened
+// it, and sending XCLIENT again would reset the upstream session, losing the AUTH that pooling saves.
+//-----------------------------------------------------------------------------
+
+const poolIdleTimeout = 2 * time.Minute // Upstream servers typically drop idle clients after a few minutes
+
+const poolQuitCode = 221
+const poolQuitMsg = "2.0.0 Bye"
+
+type pooledConn struct {
+	c     *smtpproxy.Client
+	host  string    // host:port of the upstream
+	since time.Time // When the connection was made
+	idle  time.Time // When it was returned to the pool
+}
+
+type connPool struct {
+	max  int // Idle connections held, in total
+	mu   sync.Mutex
+	idle map[string][]pooledConn
+	n    int
+}
+
+// poolKey identifies a set of credentials, without keeping them
+func poolKey(parts ...string) string {
+	h := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+// put offers an idle connection to the pool. Returns false if the pool is full, and the caller should close it.
+func (p *connPool) put(key, host string, c *smtpproxy.Client, since time.Time) bool {
+	if p == nil || key == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.n >= p.max {
+		return false
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]pooledConn)
+	}
+	p.idle[key] = append(p.idle[key], pooledConn{c: c, host: host, since: since, idle: time.Now()})
+	p.n++
+	return true
+}
+
+// get returns a live pooled connection for key, if there is one. Stale and dead connections are discarded.
+func (p *connPool) get(key string, ttl time.Duration) (*pooledConn, bool) {
+	if p == nil {
+		return nil, false
+	}
+	for {
+		p.mu.Lock()
+		conns := p.idle[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil, false
+		}
+		pc := conns[len(conns)-1] // most recently used, so most likely still alive
+		if len(conns) == 1 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = conns[:len(conns)-1]
+		}
+		p.n--
+		p.mu.Unlock()
+
+		stale := time.Since(pc.idle) > poolIdleTimeout || (ttl > 0 && time.Since(pc.since) > ttl)
+		if !stale {
+			if _, _, err := pc.c.MyCmd(250, "RSET"); err == nil {
+				return &pc, true
+			}
+		}
+		pc.c.Close()
+	}
+}
+
+// reap closes connections that have been idle for longer than poolIdleTimeout
+func (p *connPool) reap() {
+	var stale []*smtpproxy.Client
+	p.mu.Lock()
+	for key, conns := range p.idle {
+		var kept []pooledConn
+		for _, pc := range conns {
+			if time.Since(pc.idle) > poolIdleTimeout {
+				stale = append(stale, pc.c)
+			} else {
+				kept = append(kept, pc)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = kept
+		}
+	}
+	p.n -= len(stale)
+	p.mu.Unlock()
+	for _, c := range stale {
+		c.Quit()
+	}
+}
+
+// runReaper reaps idle connections periodically. It never returns.
+func (p *connPool) runReaper() {
+	for range time.Tick(poolIdleTimeout / 2) {
+		p.reap()
+	}
+}
+
+// size returns the number of idle pooled connections
+func (p *connPool) size() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.n
+}
+
+// fromPool swaps the session's upstream connection for a pooled one authenticated with the same credentials, if
+// there is one. The key is remembered either way, so the connection can be pooled when the session ends.
+func (s *Session) fromPool(key string) bool {
+	if s.bkd.pool == nil {
+		return false
+	}
+	pc, ok := s.bkd.pool.get(key, s.bkd.upstreamTTL)
+	if !ok {
+		return false
+	}
+	s.logger("\tUsing pooled upstream connection to", pc.host, "age", time.Since(pc.since).Round(time.Second))
+	old := s.upstream
+	s.upstream = pc.c
+	s.upstreamHost = pc.host
+	s.upstreamSince = pc.since
+	s.caps = pc.c.Capabilities()
+	if old != nil {
+		old.Quit()
+	}
+	s.poolKey = key
+	return true
+}
+
+// poolable tells whether the session's upstream connection is in a fit state to be pooled
+func (s *Session) poolable() bool {
+	return s.bkd.pool != nil && s.poolKey != "" && s.upstream != nil && !s.blockUpstream && !s.inTransaction &&
+		!s.inData && !s.upstreamExpired()
+}
+
+// toPool returns the session's upstream connection to the pool, if it's in a fit state to be reused
+func (s *Session) toPool() bool {
+	if !s.poolable() {
+		return false
+	}
+	if !s.bkd.pool.put(s.poolKey, s.upstreamHost, s.upstream, s.upstreamSince) {
+		return false
+	}
+	s.logger("---Upstream connection returned to pool")
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Spool priority
+//
+// Store-and-forward messages are relayed highest priority first. A message's priority comes from the authenticated
+// user's tier (priority_users) if set, else its priority_header. To stop a steady flow of high priority mail starving
+// the rest, a waiting message gains a level for every priority_aging it has been in the spool.
+//-----------------------------------------------------------------------------
+
+// Priority levels
+const (
+	priorityLow    = 0
+	priorityNormal = 1
+	priorityHigh   = 2
+)
+
+var priorityNames = map[string]int{"low": priorityLow, "normal": priorityNormal, "high": priorityHigh}
+
+// priorities derives message priorities
+type priorities struct {
+	header string         // Header to read, e.g. X-Priority. Empty to ignore headers.
+	users  map[string]int // Priority by authenticated user
+	aging  time.Duration  // Waiting time that raises a message one level, 0 = no aging
+}
+
+// parsePriorityUsers parses a comma-separated list of user=low|normal|high
+func parsePriorityUsers(list string) (map[string]int, error) {
+	m := make(map[string]int)
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		f := strings.SplitN(u, "=", 2)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%q is not user=level", u)
+		}
+		p, ok := priorityNames[strings.ToLower(f[1])]
+		if !ok {
+			return nil, fmt.Errorf("unknown priority level %q", f[1])
+		}
+		m[f[0]] = p
+	}
+	return m, nil
+}
+
+// of returns the priority of a message from user, with header h
+func (p *priorities) of(user string, h textproto.MIMEHeader) int {
+	if pri, ok := p.users[user]; ok && user != "" {
+		return pri
+	}
+	if p.header == "" {
+		return priorityNormal
+	}
+	// X-Priority style: 1 (highest) to 5 (lowest), possibly followed by a description, e.g. "1 (Highest)"
+	v := strings.Fields(h.Get(p.header))
+	if len(v) == 0 {
+		return priorityNormal
+	}
+	switch n, err := strconv.Atoi(v[0]); {
+	case err != nil:
+		if pri, ok := priorityNames[strings.ToLower(v[0])]; ok {
+			return pri
+		}
+		return priorityNormal
+	case n <= 2:
+		return priorityHigh
+	case n >= 4:
+		return priorityLow
+	default:
+		return priorityNormal
+	}
+}
+
+// effective returns a spooled message's priority, raised by how long it has waited
+func (p *priorities) effective(env *spoolEnvelope, now time.Time) int {
+	pri := env.Priority
+	if p.aging > 0 {
+		pri += int(now.Sub(env.Received) / p.aging)
+	}
+	return pri
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// PROXY protocol
+//
+// With proxy_protocol, each client connection must begin with a PROXY protocol v1 (text) or v2 (binary) header, as
+// sent by load balancers such as AWS NLB and HAProxy. The client address it carries replaces the load balancer's, so
+// the real client is what's checked, logged, and passed upstream in XCLIENT and Received headers. Connections without
+// a valid header are dropped. v2 LOCAL headers (e.g. load balancer health checks) keep the connection's own address.
+//-----------------------------------------------------------------------------
+
+const proxyHeaderTimeout = 10 * time.Second
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a client connection whose PROXY protocol header has been read
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader // Holds anything the client sent after the header
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads the PROXY protocol header from the start of c, and returns c with the client address it gives
+func readProxyHeader(c net.Conn) (net.Conn, error) {
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	r := bufio.NewReader(c)
+	var remote net.Addr
+	var err error
+	if sig, _ := r.Peek(len(proxyV2Signature)); bytes.Equal(sig, proxyV2Signature) {
+		remote, err = readProxyV2(r)
+	} else if p, _ := r.Peek(len(proxyV1Prefix)); bytes.Equal(p, proxyV1Prefix) {
+		remote, err = readProxyV1(r)
+	} else {
+		err = errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = c.RemoteAddr()
+	}
+	return &proxyConn{Conn: c, r: r, remote: remote}, nil
+}
+
+// readProxyV1 parses a header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // longest valid v1 header, including CRLF
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long or not CRLF terminated")
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("bad PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("bad PROXY v1 source address %s %s", f[2], f[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses a binary header: signature, version/command, family/protocol, length, then the addresses
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unknown PROXY v2 command %d", hdr[12]&0x0f)
+	}
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET: src addr, dst addr, src port, dst port
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil // AF_UNSPEC or AF_UNIX: no usable client address
+}
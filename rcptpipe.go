@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+)
+
+//-----------------------------------------------------------------------------
+// RCPT pipelining
+//
+// With pipeline_rcpt, and an upstream that offers PIPELINING, recipients are not passed upstream one round-trip at a
+// time. Those the proxy's own checks (deny lists, suppression, policy, greylisting) allow are accepted from the client
+// straight away, and all are sent upstream in one batch when the client issues DATA, their responses read together.
+// Held recipients (e.g. split_recipients, store-and-forward) are replayed the same way. Recipients the upstream then
+// refuses are logged and suppressed as usual, and counted in the final response to the client; if it refuses them all,
+// DATA is refused with its last response. Not used with VERP, where each recipient has its own transaction.
+//-----------------------------------------------------------------------------
+
+// pipeliningRcpts tells whether RCPT TO goes upstream in a batch at DATA, rather than one at a time
+func (s *Session) pipeliningRcpts() bool {
+	if !s.bkd.pipelineRcpt || s.bkd.verp != "" || s.bkd.sink || s.upstream == nil {
+		return false
+	}
+	ok, _ := capability(s.caps, "PIPELINING")
+	return ok
+}
+
+// sendRcpts sends RCPT TO upstream for each of rcpts, pipelined if the upstream allows. Returns the recipients
+// accepted, and the response to the last one refused.
+func (s *Session) sendRcpts(rcpts []string) ([]string, int, string, error) {
+	var (
+		accepted []string
+		code     int
+		m        string
+		err      error
+	)
+	if !s.pipeliningRcpts() {
+		for _, rcpt := range rcpts {
+			if code, m, err = s.Passthru(25, "RCPT", "TO:<"+rcpt+">"+s.rcptParams[rcpt]); err == nil {
+				accepted = append(accepted, rcpt)
+			} else {
+				s.noteUndelivered([]string{rcpt}, code, m, err)
+			}
+		}
+		return accepted, code, m, err
+	}
+	// Write every command, then read the responses in order. Each command written must have its response read, even
+	// after an error, so the connection's request / response sequencing stays in step.
+	t := s.upstream.Text
+	ids := make([]uint, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		arg := "TO:<" + rcpt + ">" + s.rcptParams[rcpt]
+		s.logger(cmdTwiddle(s), "RCPT", arg, "(pipelined)")
+		id, werr := t.Cmd("RCPT %s", arg)
+		if werr != nil {
+			s.logger(respTwiddle(s), "RCPT write error", werr)
+			code, m, err = 451, "4.4.2 Error relaying recipients", werr
+			break
+		}
+		ids = append(ids, id)
+	}
+	for i, id := range ids {
+		t.StartResponse(id)
+		rcode, rmsg, rerr := t.ReadResponse(25)
+		t.EndResponse(id)
+		s.logger(respTwiddle(s), rcode, rmsg)
+		if rerr == nil {
+			accepted = append(accepted, rcpts[i])
+			continue
+		}
+		code, m, err = rcode, rmsg, rerr
+		s.noteUndelivered([]string{rcpts[i]}, rcode, rmsg, rerr)
+		s.suppressRefused(rcpts[i], rcode, rmsg)
+	}
+	if code == 0 && err != nil {
+		code, m = 451, "4.4.2 Error relaying recipients"
+	}
+	return accepted, code, m, err
+}
+
+// flushRcpts sends the recipients collected by pipeline_rcpt upstream, as DATA is issued. Returns a response to give
+// DATA, if no recipient is left.
+func (s *Session) flushRcpts() (int, string, error) {
+	pending := s.pendingRcpts
+	if len(pending) == 0 {
+		return 0, "", nil
+	}
+	s.pendingRcpts = nil
+	accepted, code, msg, err := s.sendRcpts(pending)
+	s.rcptto = append(s.rcptto, accepted...)
+	s.refusedRcpts += len(pending) - len(accepted)
+	if len(s.rcptto) > 0 {
+		return 0, "", nil
+	}
+	return code, msg, err
+}
+
+// refusedNote adds the number of recipients the upstream refused at DATA to a final response
+func (s *Session) refusedNote(msg string) string {
+	if s.refusedRcpts == 0 {
+		return msg
+	}
+	return fmt.Sprintf("%s (%d of %d recipients refused)", msg, s.refusedRcpts, s.refusedRcpts+len(s.rcptto))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Credential redaction
+//
+// AUTH exchanges carry credentials as base64, which is no protection. They are masked in verbose log lines, and in
+// the server_debug and capture_dir transcripts: the initial response on an AUTH line, and each client line following
+// a 334 challenge.
+//-----------------------------------------------------------------------------
+
+// redactCommand returns a client command line for logging, with any AUTH initial response masked
+func redactCommand(cmd, arg string) string {
+	line := strings.TrimSpace(cmd + " " + arg)
+	if !strings.EqualFold(cmd, "AUTH") {
+		return line
+	}
+	f := strings.Fields(arg)
+	if len(f) < 2 {
+		return line
+	}
+	return cmd + " " + f[0] + " " + redacted
+}
+
+// redactingWriter masks credentials in an SMTP transcript written to w. It holds back partial lines, so it needs its
+// own instance per connection.
+type redactingWriter struct {
+	w        io.Writer
+	partial  []byte
+	saslNext bool // The next client line is a response to a 334 challenge
+}
+
+func newRedactingWriter(w io.Writer) *redactingWriter {
+	return &redactingWriter{w: w}
+}
+
+func (r *redactingWriter) Write(b []byte) (int, error) {
+	r.partial = append(r.partial, b...)
+	var out bytes.Buffer
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			break
+		}
+		out.WriteString(r.redactLine(string(r.partial[:i+1])))
+		r.partial = r.partial[i+1:]
+	}
+	if out.Len() > 0 {
+		if _, err := r.w.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// redactLine masks a transcript line (including its line ending) if it carries credentials
+func (r *redactingWriter) redactLine(line string) string {
+	text := strings.TrimRight(line, "\r\n")
+	end := line[len(text):]
+	switch {
+	case strings.HasPrefix(text, "334"):
+		r.saslNext = true
+		return line
+	case r.saslNext && !isResponseLine(text):
+		r.saslNext = false
+		if text == "*" { // client cancelled the exchange
+			return line
+		}
+		return redacted + end
+	}
+	r.saslNext = false
+	if f := strings.SplitN(text, " ", 2); len(f) == 2 && strings.EqualFold(f[0], "AUTH") {
+		return redactCommand(f[0], f[1]) + end
+	}
+	return line
+}
+
+// isResponseLine tells whether a transcript line looks like a server response, e.g. "235 2.7.0 ..." or "250-SIZE"
+func isResponseLine(text string) bool {
+	if len(text) < 3 || (len(text) > 3 && text[3] != ' ' && text[3] != '-') {
+		return false
+	}
+	for _, c := range text[:3] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	plain := b64("\x00alice\x00s3cret")
+	user, pass := b64("alice"), b64("s3cret")
+	cases := []struct {
+		name    string
+		writes  []string
+		secrets []string
+		keep    []string // must still appear
+	}{
+		{"AUTH PLAIN initial response",
+			[]string{"EHLO client\r\n", "250 fake\r\n", "AUTH PLAIN " + plain + "\r\n", "235 2.7.0 Ok\r\n"},
+			[]string{plain}, []string{"AUTH PLAIN " + redacted, "235 2.7.0 Ok"}},
+		{"AUTH LOGIN exchange",
+			[]string{"AUTH LOGIN\r\n", "334 VXNlcm5hbWU6\r\n", user + "\r\n", "334 UGFzc3dvcmQ6\r\n", pass + "\r\n", "235 2.7.0 Ok\r\n", "MAIL FROM:<a@example.com>\r\n"},
+			[]string{user, pass}, []string{"AUTH LOGIN", "334 VXNlcm5hbWU6", "MAIL FROM:<a@example.com>"}},
+		{"line split across writes",
+			[]string{"AUTH PLAIN " + plain[:7], plain[7:] + "\r", "\n"},
+			[]string{plain, plain[:7], plain[7:]}, []string{"AUTH PLAIN " + redacted}},
+		{"continuation split across writes",
+			[]string{"334 \r\n", pass[:3], pass[3:] + "\r\n"},
+			[]string{pass, pass[3:]}, []string{redacted}},
+		{"cancelled",
+			[]string{"AUTH LOGIN\r\n", "334 VXNlcm5hbWU6\r\n", "*\r\n", "501 5.7.0 Cancelled\r\n"},
+			nil, []string{"*\r\n", "501 5.7.0 Cancelled"}},
+	}
+	for _, tc := range cases {
+		var out bytes.Buffer
+		w := newRedactingWriter(&out)
+		for _, s := range tc.writes {
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Fatalf("%s: Write = %d, %v", tc.name, n, err)
+			}
+		}
+		for _, secret := range tc.secrets {
+			if strings.Contains(out.String(), secret) {
+				t.Errorf("%s: %q reached the debug writer:\n%s", tc.name, secret, out.String())
+			}
+		}
+		for _, k := range tc.keep {
+			if !strings.Contains(out.String(), k) {
+				t.Errorf("%s: %q missing from the transcript:\n%s", tc.name, k, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Store-and-forward retry schedules
+//
+// retry_schedule sets the delays between attempts according to the upstream's last temporary failure code, e.g.
+//   421:1m,5m,15m; 451:15m,1h; default:5m,30m,2h
+// Attempt n+1 is made the n'th delay after attempt n. Once a schedule is exhausted the message is bounced. Failures
+// with no response code (e.g. connection refused), and codes without their own schedule, use the default schedule.
+// Without retry_schedule, delays double from spoolRetryBase up to spoolRetryMax, until spool_max_age.
+//-----------------------------------------------------------------------------
+
+const retryDefault = "default"
+
+const spoolRetryBase = 5 * time.Minute
+const spoolRetryMax = 4 * time.Hour
+
+type retrySchedules map[string][]time.Duration
+
+// parseRetrySchedule parses schedules in the form "code:delay,delay...; code:delay...". Empty gives nil.
+func parseRetrySchedule(spec string) (retrySchedules, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	r := make(retrySchedules)
+	for _, sched := range strings.Split(spec, ";") {
+		if sched = strings.TrimSpace(sched); sched == "" {
+			continue
+		}
+		f := strings.SplitN(sched, ":", 2)
+		key := strings.ToLower(strings.TrimSpace(f[0]))
+		if len(f) != 2 {
+			return nil, fmt.Errorf("schedule %q is not code:delays", sched)
+		}
+		if code, err := strconv.Atoi(key); key != retryDefault && (err != nil || code < 400 || code > 499) {
+			return nil, fmt.Errorf("schedule %q: key must be a 4xx code or %q", sched, retryDefault)
+		}
+		var delays []time.Duration
+		for _, d := range strings.Split(f[1], ",") {
+			delay, err := time.ParseDuration(strings.TrimSpace(d))
+			if err != nil || delay <= 0 {
+				return nil, fmt.Errorf("schedule %q: bad delay %q", sched, d)
+			}
+			delays = append(delays, delay)
+		}
+		r[key] = delays
+	}
+	return r, nil
+}
+
+// next returns the delay before the next attempt, after the given number of attempts, the last failing with code.
+// Returns false if there should be no more attempts.
+func (r retrySchedules) next(code, attempts int) (time.Duration, bool) {
+	delays, ok := r[strconv.Itoa(code)]
+	if !ok {
+		delays, ok = r[retryDefault]
+	}
+	if !ok {
+		return retryDelay(attempts), true
+	}
+	if attempts > len(delays) {
+		return 0, false
+	}
+	return delays[attempts-1], true
+}
+
+// retryDelay returns how long to wait after the given number of attempts, doubling each time up to spoolRetryMax
+func retryDelay(attempts int) time.Duration {
+	d := spoolRetryBase
+	for i := 1; i < attempts && d < spoolRetryMax; i++ {
+		d *= 2
+	}
+	if d > spoolRetryMax {
+		d = spoolRetryMax
+	}
+	return d
+}
+
+//-----------------------------------------------------------------------------
+// Upstream DATA retries
+//
+// With data_retries, messages are buffered, and if the upstream refuses one with a temporary (4xx) failure, or the
+// connection fails, it is sent again on a fresh upstream connection, with MAIL FROM and RCPT TO re-issued. Delays
+// double from dataRetryBase. Permanent (5xx) failures go straight back to the client.
+//-----------------------------------------------------------------------------
+
+const dataRetryBase = time.Second
+
+// sendDataRetrying sends msg in the session's upstream transaction, to rcpts, retrying temporary failures
+func (s *Session) sendDataRetrying(rcpts []string, msg []byte) (int, string, error) {
+	code, m, err := s.sendData(s.upstream, msg)
+	delay := dataRetryBase
+	for attempt := 1; attempt <= s.bkd.dataRetries && err != nil && code < 500; attempt++ {
+		s.logger("\tUpstream DATA failed:", code, m, "- retry", attempt, "of", s.bkd.dataRetries, "in", delay)
+		time.Sleep(delay)
+		delay *= 2
+		if rerr := s.renewUpstream(); rerr != nil {
+			s.logger("\tUpstream reconnect failed:", rerr)
+			continue
+		}
+		from := s.mailfrom
+		if s.bkd.verp != "" && from != "" && len(rcpts) == 1 {
+			from = verpAddress(s.bkd.verp, s.mailfrom, rcpts[0])
+		}
+		code, m, err = s.transact(from, s.mailParams, rcpts, msg)
+	}
+	if err == nil {
+		s.noteQueueID(m)
+	}
+	return code, m, err
+}
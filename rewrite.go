@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Address rewriting
+//
+// rewrite_map is a file of "from -> to" lines, with # comments, canonicalizing envelope addresses before they're
+// relayed:
+//   support@old.example -> support@new.example   # one address
+//   @old.example -> @new.example                 # every address in a domain, keeping the local part
+// Matching is case-insensitive, and a full-address entry wins over its domain's. MAIL FROM is rewritten after the
+// sender checks (allow_senders, SPF), which concern the address the client gave; RCPT TO before the recipient checks,
+// so deny lists, suppression, policy and routes all see the address the message is actually relayed to.
+//-----------------------------------------------------------------------------
+
+type addressRewrites struct {
+	addrs   map[string]string // By lower-cased address
+	domains map[string]string // By lower-cased domain
+}
+
+// loadRewriteMap reads a rewrite_map file
+func loadRewriteMap(file string) (*addressRewrites, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := &addressRewrites{addrs: make(map[string]string), domains: make(map[string]string)}
+	for i, line := range strings.Split(string(b), "\n") {
+		if c := strings.Index(line, "#"); c >= 0 {
+			line = line[:c]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		f := strings.SplitN(line, "->", 2)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s line %d: not from -> to", file, i+1)
+		}
+		from, to := strings.TrimSpace(f[0]), strings.TrimSpace(f[1])
+		switch {
+		case strings.HasPrefix(from, "@") && strings.HasPrefix(to, "@") && len(from) > 1 && len(to) > 1:
+			r.domains[strings.ToLower(from[1:])] = to[1:]
+		case strings.Contains(from, "@") && strings.Contains(to, "@") && !strings.HasPrefix(from, "@") && !strings.HasPrefix(to, "@"):
+			r.addrs[strings.ToLower(from)] = to
+		default:
+			return nil, fmt.Errorf("%s line %d: map an address to an address, or @domain to @domain", file, i+1)
+		}
+	}
+	return r, nil
+}
+
+// rewrite returns the canonical form of addr, or addr unchanged if it isn't mapped
+func (r *addressRewrites) rewrite(addr string) string {
+	if r == nil || addr == "" {
+		return addr
+	}
+	if to, ok := r.addrs[strings.ToLower(addr)]; ok {
+		return to
+	}
+	local, domain := splitAddress(addr)
+	if to, ok := r.domains[strings.ToLower(domain)]; ok && domain != "" {
+		return local + "@" + to
+	}
+	return addr
+}
+
+func (r *addressRewrites) size() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.addrs) + len(r.domains)
+}
+
+// rewritePath applies rewrite_map to the address in a MAIL or RCPT argument. Returns the address and argument to relay.
+func (s *Session) rewritePath(addr, params, prefix, arg string) (string, string) {
+	to := s.bkd.rewrites.rewrite(addr)
+	if to == addr {
+		return addr, arg
+	}
+	s.logger("\tAddress", addr, "rewritten to", to)
+	return to, prefix + "<" + to + ">" + params
+}
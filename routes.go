@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// Per-recipient routing
+//
+// With recipient_routes, recipients in the listed domains (and their subdomains) are held locally at RCPT, and relayed
+// at the end of DATA to the route's upstream, in one transaction per route. Other recipients go to out_hostport as
+// usual. Routes can also be kept in a routes file, one "domain host:port" per line, with # comments; those given in
+// recipient_routes are checked first. Routed upstreams are used without AUTH, as they're typically internal relays; STARTTLS is used if offered.
+// The client gets a single response, aggregated as for split_recipients (see split.go).
+//-----------------------------------------------------------------------------
+
+type rcptRoute struct {
+	domain   string
+	hostPort string
+}
+
+// parseRoutes parses a comma-separated list of domain=host:port
+func parseRoutes(list string) ([]rcptRoute, error) {
+	var routes []rcptRoute
+	for _, r := range strings.Split(list, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		f := strings.SplitN(r, "=", 2)
+		if len(f) != 2 || f[0] == "" {
+			return nil, fmt.Errorf("route %q is not domain=host:port", r)
+		}
+		route, err := newRoute(f[0], f[1])
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %v", r, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// loadRoutes reads a routes file, of "domain host:port" lines
+func loadRoutes(file string) ([]rcptRoute, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var routes []rcptRoute
+	for i, line := range strings.Split(string(b), "\n") {
+		if c := strings.Index(line, "#"); c >= 0 {
+			line = line[:c]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s line %d: not domain host:port", file, i+1)
+		}
+		route, err := newRoute(f[0], f[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", file, i+1, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func newRoute(domain, hostPort string) (rcptRoute, error) {
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return rcptRoute{}, err
+	}
+	return rcptRoute{domain: strings.ToLower(strings.Trim(domain, ".")), hostPort: hostPort}, nil
+}
+
+// routeFor returns the upstream host:port for rcpt, or "" to use out_hostport. The first matching route wins.
+func (bkd *Backend) routeFor(rcpt string) string {
+	_, domain := splitAddress(rcpt)
+	domain = strings.ToLower(domain)
+	for _, r := range bkd.rcptRoutes {
+		if domain == r.domain || strings.HasSuffix(domain, "."+r.domain) {
+			return r.hostPort
+		}
+	}
+	return ""
+}
+
+// routing tells whether recipients may be routed to upstreams other than out_hostport
+func (s *Session) routing() bool {
+	return len(s.bkd.rcptRoutes) > 0
+}
+
+// defaultRcpts returns the recipients of the current transaction that go to out_hostport
+func (s *Session) defaultRcpts() []string {
+	var rcpts []string
+	for _, r := range s.rcptto {
+		if s.bkd.routeFor(r) == "" {
+			rcpts = append(rcpts, r)
+		}
+	}
+	return rcpts
+}
+
+// relayBuffered relays the buffered message to all its recipients, returning the aggregated response
+func (s *Session) relayBuffered(msg []byte) (int, string, error) {
+	if s.bkd.sink {
+		return 250, sinkAcceptMsg, nil
+	}
+	if s.bkd.storeAndForward {
+		return s.spoolMessage(msg)
+	}
+	if len(s.routed) == 0 {
+		if s.splitting() {
+			return s.splitData(s.rcptto, msg)
+		}
+		return s.sendDataRetrying(s.rcptto, msg)
+	}
+	var (
+		relayed  int
+		lastCode int
+		lastMsg  string
+		lastErr  error
+	)
+	tally := func(rcpts []string, code int, m string, err error) {
+		if err != nil {
+			s.logger("\tRecipients", rcpts, "failed:", code, m)
+			s.noteUndelivered(rcpts, code, m, err)
+			lastCode, lastMsg, lastErr = code, m, err
+			return
+		}
+		for _, r := range rcpts {
+			if _, refused := s.undelivered[r]; !refused { // e.g. refused at RCPT by a routed upstream
+				relayed++
+			}
+		}
+	}
+	if rcpts := s.defaultRcpts(); len(rcpts) > 0 {
+		var (
+			code int
+			m    string
+			err  error
+		)
+		if s.splitting() {
+			code, m, err = s.splitData(rcpts, msg)
+		} else {
+			code, m, err = s.sendDataRetrying(rcpts, msg)
+		}
+		tally(rcpts, code, m, err)
+	} else if !s.splitting() && !s.mailDeferred {
+		s.Passthru(250, "RSET", "") // MAIL FROM went upstream, but there's nothing to send there
+	}
+	for hostPort, rcpts := range s.routed {
+		code, m, err := s.relayTo(hostPort, rcpts, msg)
+		tally(rcpts, code, m, err)
+	}
+	switch {
+	case relayed == len(s.rcptto):
+		return 250, s.withQueueIDs(fmt.Sprintf("2.0.0 Ok: relayed to %d recipients", relayed)), nil
+	case relayed == 0:
+		return lastCode, lastMsg, lastErr
+	default:
+		return 250, s.withQueueIDs(fmt.Sprintf("2.0.0 Ok: relayed to %d of %d recipients", relayed, len(s.rcptto))), nil
+	}
+}
+
+// relayTo sends msg to rcpts in a single transaction on the given upstream
+func (s *Session) relayTo(hostPort string, rcpts []string, msg []byte) (int, string, error) {
+	s.logger("---Connecting to routed upstream", hostPort)
+	c, err := s.bkd.dialRelay(hostPort)
+	if err != nil {
+		s.logger("\tRouted upstream", hostPort, "error:", err)
+		return 451, "4.4.1 Unable to reach upstream for some recipients", err
+	}
+	defer c.Close()
+	if code, m, err := c.MyCmd(250, "MAIL FROM:<%s>%s", s.mailfrom, s.mailParams); err != nil {
+		return code, m, err
+	}
+	var (
+		accepted int
+		code     int
+		m        string
+	)
+	for _, rcpt := range rcpts {
+		if code, m, err = c.MyCmd(25, "RCPT TO:<%s>%s", rcpt, s.rcptParams[rcpt]); err != nil {
+			s.logger("\tRouted upstream", hostPort, "refused recipient", rcpt, code, m)
+			s.noteUndelivered([]string{rcpt}, code, m, err)
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return code, m, err
+	}
+	code, m, err = s.sendData(c, msg)
+	if err == nil {
+		s.noteQueueID(m)
+		c.Quit()
+	}
+	return code, m, err
+}
+
+// dialRelay connects and says EHLO to a relay other than out_hostport, securing the connection with STARTTLS per
+// upstream_starttls: with required (or require_upstream_tls), a relay that doesn't offer STARTTLS is an error, as
+// for out_hostport, rather than being used in plaintext. Unix socket relays are local, so are exempt unless
+// require_upstream_tls is set.
+func (bkd *Backend) dialRelay(addr string) (*smtpproxy.Client, error) {
+	conn, err := bkd.dialConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	host := upstreamName(addr)
+	c, err := smtpproxy.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if code, msg, err := c.Hello(host); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("EHLO: %d %s %v", code, msg, err)
+	}
+	offered, _ := capability(c.Capabilities(), "STARTTLS")
+	required := bkd.requireUpstreamTLS || (bkd.upstreamStartTLS == startTLSRequired && !isUnixSocket(addr))
+	if !offered && required {
+		c.Close()
+		return nil, errors.New("STARTTLS required, but not offered")
+	}
+	if offered && bkd.wantStartTLS(addr, c.Capabilities()) {
+		if code, msg, err := c.StartTLS(bkd.upstreamTLSConfig(host)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("STARTTLS: %d %s %v", code, msg, err)
+		}
+		bkd.noteUpstreamCert(host, c)
+	}
+	return c, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// routedSession returns a session relaying to main, with example.org routed to other
+func routedSession(t *testing.T, main, other *fakeUpstream, rcpts ...string) *Session {
+	t.Helper()
+	route, err := newRoute("example.org", other.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testSession(t, main, &Backend{rcptRoutes: []rcptRoute{route}})
+	if code, msg, err := s.Mail(250, "MAIL", "FROM:<sender@example.com>"); err != nil {
+		t.Fatalf("MAIL: %d %s %v", code, msg, err)
+	}
+	for _, r := range rcpts {
+		if code, msg, err := s.Rcpt(250, "RCPT", "TO:<"+r+">"); err != nil {
+			t.Fatalf("RCPT %s: %d %s %v", r, code, msg, err)
+		}
+	}
+	return s
+}
+
+func TestRelayBufferedTwoUpstreams(t *testing.T) {
+	main, other := newFakeUpstream(t, nil), newFakeUpstream(t, nil)
+	s := routedSession(t, main, other, "a@example.net", "b@example.org", "c@sub.example.org")
+
+	code, msg, err := sendMessage(t, s, testMessage)
+	if err != nil || code != 250 || !strings.Contains(msg, "relayed to 3 recipients") {
+		t.Fatalf("got %d %s %v, want 250 relayed to 3 recipients", code, msg, err)
+	}
+	if rcpts := main.commands("RCPT"); len(rcpts) != 1 || rcpts[0] != "RCPT TO:<a@example.net>" {
+		t.Errorf("main upstream RCPT commands %q", rcpts)
+	}
+	if rcpts := other.commands("RCPT"); len(rcpts) != 2 {
+		t.Errorf("routed upstream RCPT commands %q, want both example.org recipients", rcpts)
+	}
+	if len(main.messages()) != 1 || len(other.messages()) != 1 {
+		t.Errorf("messages received: main %d, routed %d, want 1 each", len(main.messages()), len(other.messages()))
+	}
+}
+
+func TestRelayBufferedPartial(t *testing.T) {
+	cases := []struct {
+		name   string
+		refuse func(main, other *fakeUpstream)
+		want   string
+	}{
+		{"routed upstream refuses all", func(main, other *fakeUpstream) {
+			other.reply = func(line string) (int, string) {
+				if strings.HasPrefix(line, "RCPT") {
+					return 550, "5.1.1 No such user"
+				}
+				return 0, ""
+			}
+		}, "relayed to 1 of 3 recipients"},
+		{"routed upstream refuses one", func(main, other *fakeUpstream) {
+			other.rejectRcpt("b@example.org", 550)
+		}, "relayed to 2 of 3 recipients"},
+		{"main upstream refuses DATA", func(main, other *fakeUpstream) {
+			main.reply = func(line string) (int, string) {
+				if line == "DATA" {
+					return 554, "5.6.0 Rejected"
+				}
+				return 0, ""
+			}
+		}, "relayed to 2 of 3 recipients"},
+	}
+	for _, tc := range cases {
+		main, other := newFakeUpstream(t, nil), newFakeUpstream(t, nil)
+		tc.refuse(main, other)
+		s := routedSession(t, main, other, "a@example.net", "b@example.org", "c@example.org")
+		code, msg, err := sendMessage(t, s, testMessage)
+		if err != nil || code != 250 || !strings.Contains(msg, tc.want) {
+			t.Errorf("%s: got %d %s %v, want 250 %s", tc.name, code, msg, err, tc.want)
+		}
+	}
+}
+
+func TestRelayBufferedAllFail(t *testing.T) {
+	main, other := newFakeUpstream(t, nil), newFakeUpstream(t, nil)
+	refuse := func(line string) (int, string) {
+		if line == "DATA" {
+			return 451, "4.3.0 Try again later"
+		}
+		return 0, ""
+	}
+	main.reply, other.reply = refuse, refuse
+	s := routedSession(t, main, other, "a@example.net", "b@example.org")
+	if code, msg, err := sendMessage(t, s, testMessage); err == nil || code != 451 {
+		t.Errorf("got %d %s %v, want the upstreams' 451", code, msg, err)
+	}
+}
+
+func TestDialRelayStartTLSPolicy(t *testing.T) {
+	f := newFakeUpstream(t, nil) // doesn't offer STARTTLS
+	cases := []struct {
+		mode    string
+		require bool
+		wantErr bool
+	}{
+		{startTLSRequired, false, true},
+		{startTLSOpportunistic, true, true},
+		{startTLSOpportunistic, false, false},
+		{startTLSNone, false, false},
+	}
+	for _, tc := range cases {
+		bkd := &Backend{upstreamStartTLS: tc.mode, requireUpstreamTLS: tc.require}
+		c, err := bkd.dialRelay(f.addr)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("upstream_starttls %s, require_upstream_tls %v: got error %v, want error %v", tc.mode, tc.require, err, tc.wantErr)
+		}
+		if c != nil {
+			c.Quit()
+		}
+	}
+}
+
+func TestRelayBufferedRouteNeedsTLS(t *testing.T) {
+	main, other := newFakeUpstream(t, nil), newFakeUpstream(t, nil)
+	route, _ := newRoute("example.org", other.addr)
+	s := testSession(t, main, &Backend{rcptRoutes: []rcptRoute{route}, upstreamStartTLS: startTLSRequired})
+	s.Mail(250, "MAIL", "FROM:<sender@example.com>")
+	s.Rcpt(250, "RCPT", "TO:<a@example.net>")
+	s.Rcpt(250, "RCPT", "TO:<b@example.org>")
+	code, msg, err := sendMessage(t, s, testMessage)
+	if err != nil || !strings.Contains(msg, "relayed to 1 of 2 recipients") {
+		t.Errorf("got %d %s %v, want 250 relayed to 1 of 2 recipients", code, msg, err)
+	}
+	if n := len(other.commands("MAIL")); n != 0 {
+		t.Errorf("routed upstream saw %d MAIL commands in plaintext, want none", n)
+	}
+}
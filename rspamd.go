@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// rspamd content scanning
+//
+// With rspamd_addr, each message is buffered and submitted to rspamd's HTTP protocol (/checkv2) with its envelope,
+// client IP, EHLO name (with forward_helo) and authenticated user, as part of the "scan" transform stage (see
+// pipeline.go). The message is only relayed once the verdict is known:
+//   reject                         refused with 550
+//   soft reject, greylist          refused with 451, for the client to try again later
+//   add header, rewrite subject    relayed with X-Spam: Yes and the score added
+//   no action                      relayed unchanged
+// If rspamd can't be reached, or gives no verdict, the message is refused with 451 rather than relayed unscanned.
+//-----------------------------------------------------------------------------
+
+const rspamdTimeout = 30 * time.Second
+
+const rspamdRejectCode = 550
+const rspamdRejectMsg = "5.7.1 Message rejected as spam"
+const rspamdSoftRejectCode = 451
+const rspamdSoftRejectMsg = "4.7.1 Message deferred by content filter, try again later"
+const rspamdErrorCode = 451
+const rspamdErrorMsg = "4.3.0 Content scan failed, try again later"
+
+// rspamd actions
+const (
+	rspamdNoAction       = "no action"
+	rspamdAddHeader      = "add header"
+	rspamdRewriteSubject = "rewrite subject"
+	rspamdGreylist       = "greylist"
+	rspamdSoftReject     = "soft reject"
+	rspamdReject         = "reject"
+)
+
+type rspamdResult struct {
+	Action        string  `json:"action"`
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+}
+
+var rspamdClient = &http.Client{Timeout: rspamdTimeout}
+
+// rspamdCheck submits msg to rspamd, along with the session's envelope and client details
+func (s *Session) rspamdCheck(msg []byte) (*rspamdResult, error) {
+	req, err := http.NewRequest(http.MethodPost, "http://"+s.bkd.rspamdAddr+"/checkv2", bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("From", s.mailfrom)
+	for _, rcpt := range s.rcptto {
+		req.Header.Add("Rcpt", rcpt)
+	}
+	if s.remoteAddr != nil {
+		req.Header.Set("IP", remoteHost(s.remoteAddr))
+	}
+	if s.heloName != "" {
+		req.Header.Set("Helo", s.heloName)
+	}
+	if s.authUser != "" {
+		req.Header.Set("User", s.authUser)
+	}
+	req.Header.Set("Queue-Id", s.correlationID)
+	resp, err := rspamdClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd returned %s", resp.Status)
+	}
+	var r rspamdResult
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	if r.Action == "" {
+		return nil, errors.New("rspamd gave no action")
+	}
+	return &r, nil
+}
+
+// rspamdScan acts on rspamd's verdict for msg. Returns the message, possibly with headers added, or a non-zero code
+// to reject it.
+func (s *Session) rspamdScan(msg []byte) ([]byte, int, string, error) {
+	r, err := s.rspamdCheck(msg)
+	if err != nil {
+		s.logger("\trspamd error:", err)
+		return msg, rspamdErrorCode, rspamdErrorMsg, errors.New(rspamdErrorMsg)
+	}
+	s.logger("\trspamd:", r.Action, "score", r.Score, "/", r.RequiredScore)
+	switch r.Action {
+	case rspamdNoAction:
+		return msg, 0, "", nil
+	case rspamdAddHeader, rspamdRewriteSubject:
+		hdr := fmt.Sprintf("X-Spam: Yes\r\nX-Spam-Score: %.2f / %.2f\r\n", r.Score, r.RequiredScore)
+		return append([]byte(hdr), msg...), 0, "", nil
+	case rspamdGreylist, rspamdSoftReject:
+		return msg, rspamdSoftRejectCode, rspamdSoftRejectMsg, errors.New(rspamdSoftRejectMsg)
+	case rspamdReject:
+		return msg, rspamdRejectCode, rspamdRejectMsg, errors.New(rspamdRejectMsg)
+	}
+	s.logger("\trspamd: unknown action", r.Action)
+	return msg, rspamdErrorCode, rspamdErrorMsg, errors.New(rspamdErrorMsg)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Server certificate reloading
+//
+// The certificate offered to clients is reloaded from certfile and privkeyfile when either file changes (checked at
+// most every certCheckInterval, as clients connect), or at once on SIGHUP, so a renewed certificate is picked up
+// without a restart. Unless ehlo_domain is set, the name the proxy advertises follows the certificate's subject. If a reload fails, the
+// certificate already loaded stays in use.
+//-----------------------------------------------------------------------------
+
+const certCheckInterval = 10 * time.Second
+
+type serverCert struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	subject  string    // Common name of the certificate, or its first DNS name if it has none
+	modTime  time.Time // Latest modification time of the two files, when loaded
+	checked  time.Time
+}
+
+// loadServerCert loads the certificate and key
+func loadServerCert(certFile, keyFile string) (*serverCert, error) {
+	c := &serverCert{certFile: certFile, keyFile: keyFile}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c, c.loadLocked()
+}
+
+// filesModTime returns the latest modification time of the certificate and key files
+func (c *serverCert) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// loadLocked (re)loads the files. Call with c.mu held.
+func (c *serverCert) loadLocked() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cer, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cer.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cer.Leaf = leaf
+	subject := leaf.Subject.CommonName
+	if subject == "" && len(leaf.DNSNames) > 0 {
+		subject = leaf.DNSNames[0] // Certificates may carry the name only as a SAN
+	}
+	c.cert, c.subject, c.modTime, c.checked = &cer, subject, modTime, time.Now()
+	return nil
+}
+
+// reload loads the files again if they have changed since they were loaded, or if forced
+func (c *serverCert) reload(force bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Now()
+	if !force {
+		if modTime, err := c.filesModTime(); err != nil || !modTime.After(c.modTime) {
+			return
+		}
+	}
+	old := c.subject
+	if err := c.loadLocked(); err != nil {
+		log.Println("Certificate reload failed, keeping the current one:", err)
+		return
+	}
+	log.Println("Reloaded certificate", c.certFile, "subject", c.subject, "expires", c.cert.Leaf.NotAfter.Format(time.RFC3339))
+	if c.subject != old {
+		log.Println("Proxy will now advertise itself as", c.subject)
+	}
+}
+
+// current returns the certificate and its subject, reloading first if the files may have changed
+func (c *serverCert) current() (*tls.Certificate, string) {
+	c.mu.Lock()
+	due := time.Since(c.checked) > certCheckInterval
+	c.mu.Unlock()
+	if due {
+		c.reload(false)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, c.subject
+}
+
+// getCertificate is the tls.Config callback
+func (c *serverCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := c.current()
+	return cert, nil
+}
+
+// reloadOnSignal reloads the certificate whenever the process gets SIGHUP
+func (c *serverCert) reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Println("Received SIGHUP, reloading certificate")
+		c.reload(true)
+	}
+}
+
+// domain returns the name the proxy advertises: ehlo_domain if set, else the current certificate's subject, if there
+// is one
+func (bkd *Backend) domain() string {
+	if bkd.ehloDomain != "" {
+		return bkd.ehloDomain
+	}
+	if bkd.serverCert != nil {
+		_, subject := bkd.serverCert.current()
+		return subject
+	}
+	return bkd.hostname
+}
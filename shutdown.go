@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Graceful shutdown
+//
+// On SIGINT or SIGTERM, the proxy stops accepting connections. Sessions not relaying a message are ended at once; a
+// transaction that hasn't reached DATA is abandoned, and the client will retry it. Sessions relaying a message finish
+// it, and are ended once the client has the response. The proxy exits when all sessions have ended, or after
+// shutdown_timeout. Messages still in store_and_forward's spool are relayed when the proxy next starts.
+//-----------------------------------------------------------------------------
+
+const shutdownCode = 421
+const shutdownMsg = "4.3.2 Service shutting down, try again later"
+
+// stopOnSignal closes the listeners when the process is told to stop, so that serve returns
+func (bkd *Backend) stopOnSignal(ls ...net.Listener) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Println("Received", <-sig, "- no longer accepting connections")
+	atomic.StoreInt32(&bkd.stopping, 1)
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// isStopping tells whether shutdown has begun
+func (bkd *Backend) isStopping() bool {
+	return atomic.LoadInt32(&bkd.stopping) != 0
+}
+
+// track records an active client connection, so it can be drained at shutdown. A connection accepted as shutdown
+// begins is drained at once.
+func (bkd *Backend) track(cb *connBackend) {
+	bkd.connsMu.Lock()
+	defer bkd.connsMu.Unlock()
+	if bkd.conns == nil {
+		bkd.conns = make(map[*connBackend]struct{})
+	}
+	bkd.conns[cb] = struct{}{}
+	if bkd.isStopping() {
+		cb.drain()
+	}
+}
+
+func (bkd *Backend) untrack(cb *connBackend) {
+	bkd.connsMu.Lock()
+	defer bkd.connsMu.Unlock()
+	delete(bkd.conns, cb)
+}
+
+// shutdown drains every client connection, and waits for them to close, for up to timeout
+func (bkd *Backend) shutdown(timeout time.Duration) {
+	n := bkd.drainAll()
+	log.Println("Shutting down, waiting up to", timeout, "for", n, "sessions to end")
+	done := make(chan struct{})
+	go func() {
+		bkd.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("All sessions ended")
+	case <-time.After(timeout):
+		bkd.connsMu.Lock()
+		log.Println("Shutdown timeout reached,", len(bkd.conns), "sessions still active")
+		bkd.connsMu.Unlock()
+	}
+}
+
+// drainAll drains every client connection, returning how many there were
+func (bkd *Backend) drainAll() int {
+	bkd.connsMu.Lock()
+	defer bkd.connsMu.Unlock()
+	for cb := range bkd.conns {
+		cb.drain()
+	}
+	return len(bkd.conns)
+}
+
+// drain ends the connection's session now if it's not relaying a message, otherwise once the message is answered
+func (cb *connBackend) drain() {
+	atomic.StoreInt32(&cb.draining, 1)
+	if atomic.LoadInt32(&cb.relaying) == 0 {
+		cb.hangup()
+		cb.conn.SetReadDeadline(time.Now()) // Wake the session, if it's waiting for a command
+	}
+}
+
+// startMessage marks the session as relaying a message. Returns false if the session is being drained.
+func (cb *connBackend) startMessage() bool {
+	if cb == nil {
+		return true
+	}
+	atomic.StoreInt32(&cb.relaying, 1)
+	if atomic.LoadInt32(&cb.draining) != 0 {
+		atomic.StoreInt32(&cb.relaying, 0)
+		cb.hangup()
+		return false
+	}
+	return true
+}
+
+// endMessage marks the session as no longer relaying a message, ending it if it's being drained
+func (cb *connBackend) endMessage() {
+	if cb == nil {
+		return
+	}
+	atomic.StoreInt32(&cb.relaying, 0)
+	if atomic.LoadInt32(&cb.draining) != 0 {
+		cb.hangup()
+	}
+}
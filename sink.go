@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Sink mode
+//
+// With sink, the proxy never connects upstream, for load testing and staging. Clients get a normal session: STARTTLS
+// is handled by the proxy alone, any credentials are accepted, and each message is read in full, run through the
+// transform stages, answered 250, and discarded.
+//-----------------------------------------------------------------------------
+
+const sinkAcceptMsg = "2.0.0 Ok: message discarded"
+
+// sinkGreet answers HELO / EHLO, with the capabilities the proxy can support by itself
+func (s *Session) sinkGreet() ([]string, int, string, error) {
+	caps := []string{"8BITMIME", "AUTH " + strings.Join(inboundAuthMechs, " ")}
+	return withSize(caps, s.bkd.maxSize), 250, s.bkd.domain(), nil
+}
+
+// sinkReply answers a command that would otherwise be passed upstream
+func (s *Session) sinkReply(cmd string) (int, string, error) {
+	switch strings.ToUpper(cmd) {
+	case "QUIT":
+		return 221, "2.0.0 Bye", nil
+	case "RSET", "NOOP":
+		return 250, "2.0.0 Ok", nil
+	}
+	msg := "5.5.1 Command not implemented"
+	return 502, msg, errors.New(msg)
+}
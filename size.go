@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Message size limit
+//
+// With max_size, the proxy advertises SIZE (RFC 1870), lowered to the upstream's own SIZE if that is smaller, so
+// clients aren't told we'll take mail the upstream will refuse. A MAIL FROM declaring a larger SIZE= is refused, as is
+// any message that turns out larger as it is read. A streamed message is already partly relayed by then, so the upstream
+// connection is dropped rather than completing the message, and a fresh one made for the rest of the session.
+//-----------------------------------------------------------------------------
+
+const sizeLimitCode = 552
+const sizeLimitMsg = "5.3.4 Message size exceeds fixed maximum message size"
+
+var errTooLarge = errors.New(sizeLimitMsg)
+
+// sizeLimit returns the largest message the session accepts, or 0 for no limit
+func (s *Session) sizeLimit() int64 {
+	limit := s.bkd.maxSize
+	if limit <= 0 {
+		return 0
+	}
+	if _, param := capability(s.caps, "SIZE"); param != "" {
+		if up, err := strconv.ParseInt(param, 10, 64); err == nil && up > 0 && up < limit {
+			limit = up
+		}
+	}
+	return limit
+}
+
+// withSize sets the SIZE capability advertised to limit, if there is one
+func withSize(caps []string, limit int64) []string {
+	if limit <= 0 {
+		return caps
+	}
+	return append(withoutCapability(caps, "SIZE"), "SIZE "+strconv.FormatInt(limit, 10))
+}
+
+// declaredSize returns the SIZE= parameter of MAIL FROM, or 0 if none
+func declaredSize(params string) int64 {
+	for _, p := range strings.Fields(params) {
+		if f := strings.SplitN(p, "=", 2); len(f) == 2 && strings.EqualFold(f[0], "SIZE") {
+			n, _ := strconv.ParseInt(f[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// sizeLimitReader returns errTooLarge once more than n bytes have been read
+type sizeLimitReader struct {
+	r io.Reader
+	n int64 // bytes remaining
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1] // read one byte past the limit, to tell whether it's exceeded
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), errTooLarge
+	}
+	return n, err
+}
+
+// tooLarge refuses the message being read. The upstream transaction is abandoned: reset if DATA wasn't yet issued,
+// otherwise the connection is dropped, so the partial message is never completed.
+func (s *Session) tooLarge() (int, string, error) {
+	s.logger(respTwiddle(s), sizeLimitCode, sizeLimitMsg)
+	s.abandonData()
+	return sizeLimitCode, sizeLimitMsg, errTooLarge
+}
+
+// abandonData ends the upstream transaction for a message that won't be relayed after all
+func (s *Session) abandonData() {
+	if s.buffering() {
+		if !s.holding() {
+			s.Passthru(250, "RSET", "")
+		}
+	} else {
+		s.upstream.Close()
+		if err := s.renewUpstream(); err != nil {
+			s.logger("\tUpstream reconnect failed:", err)
+			s.blockUpstream = true
+		}
+	}
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/dkim"
 	"github.com/tuck1s/go-smtpproxy"
 )
 
@@ -24,16 +33,152 @@ func Contains(a []string, x string) bool {
 	return false
 }
 
+// capability tells whether the named SMTP extension is present in caps, returning its parameters (if any)
+func capability(caps []string, name string) (bool, string) {
+	for _, c := range caps {
+		f := strings.SplitN(c, " ", 2)
+		if strings.EqualFold(f[0], name) {
+			if len(f) > 1 {
+				return true, f[1]
+			}
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
 //-----------------------------------------------------------------------------
 // Backend handlers
 //-----------------------------------------------------------------------------
 
 // The Backend implements SMTP server methods.
 type Backend struct {
-	outHostPort        string
-	verbose            bool
-	requireUpstreamTLS bool
-	upstreamDebug      io.WriteCloser
+	upstreams            *upstreamSet // out_hostport hosts
+	verbose              bool
+	requireUpstreamTLS   bool
+	upstreamCAs          *x509.CertPool // Upstream certificate authorities, nil = system pool
+	upstreamInsecure     bool           // Skip upstream certificate verification
+	upstreamStartTLS     string         // When to STARTTLS upstream - see startTLSRequired etc.
+	upstreamImplicitTLS  bool           // Connect upstream with TLS from the start (SMTPS), rather than STARTTLS
+	upstreamCertName     string         // Name to verify the upstream certificate against, if not the out_hostport host
+	upstreamDebug        io.WriteCloser
+	upstreamTimeout      time.Duration     // Limit on upstream dials and each read/write, 0 = none
+	dialTimeout          time.Duration     // Limit on upstream dials, overriding upstreamTimeout, 0 = use that
+	upstreamKeepAlive    time.Duration     // TCP keepalive period on upstream connections, negative = off
+	upstreamProxy        *url.URL          // SOCKS5 or HTTP CONNECT proxy to reach upstreams through, if set
+	upstreamAuth         string            // How to authenticate upstream - see authPassthru etc.
+	allowInsecureAuth    bool              // Clients may AUTH before STARTTLS
+	localUsers           map[string]string // Client bcrypt password hashes by user, if authenticating clients locally
+	serviceCreds         *credentials      // Upstream service account, used in place of client credentials if set
+	tokens               *tokenRefresher   // Service account OAuth2 token source, with token_refresh_cmd
+	maskErrors           bool              // Replace failure response text sent to clients with generic text
+	errorMessages        map[int]string    // Failure response text sent to clients, by reply code
+	fixLineEndings       bool              // Normalize bare LF / bare CR to CRLF in the DATA stream
+	verp                 string            // VERP return path template, if set
+	splitRecipients      bool              // Relay each recipient in its own upstream transaction
+	archiveRelay         string            // host:port to relay a duplicate of each message to, if set
+	archiveRelayRcpt     string            // Archive relay recipient, instead of the original envelope recipients
+	archiveMap           []archiveMapping  // Archive relay recipients by sender domain
+	archiveRelayRequired bool              // Reject the message if the archive copy can't be relayed
+	archiveMode          string            // How messages are archived - see archiveModeRelay etc.
+	archiveFailures      int64             // Archive copies that failed to relay (atomic)
+	relayedMessages      int64             // Messages accepted upstream since startup (atomic)
+	relayedBytes         int64             // Their total size, as received from clients (atomic)
+	usageLog             *jsonLog
+	messageLog           *jsonLog
+	accessLog            *accessLog
+	logJSON              *jsonLog // Log lines as JSON, if log_format is json
+	captureDir           string   // Directory for per-session captures, if enabled
+	debugDir             string   // Directory for per-connection debug transcripts, if enabled
+	captureFilter        []string // Only keep captures for these client IPs / users (empty = all)
+	captureUsers         bool     // captureFilter contains usernames
+	authAlarm            *authAlarm
+	userConns            userConns     // Active sessions per authenticated user
+	dataSlots            chan struct{} // Limits concurrent DATA transfers, if non-nil
+	activeData           int64         // Sessions currently in DATA (atomic)
+	connSlots            chan struct{} // Limits concurrent client connections, if non-nil
+	activeConns          int64         // Client connections open (atomic)
+
+	addReceivedHeader bool // Add a Received header to relayed messages
+	maxHops           int  // Received headers a message may already have, more means a loop, 0 = no limit
+	addTLSHeader      bool // Add X-Proxy-TLS header to relayed messages
+	traceEnvelopes    bool // Print a one-line envelope trace per message to stdout
+	generateDSN       bool // Report recipients refused upstream after acceptance to the sender - see dsn.go
+
+	upstreamTTL       time.Duration // Maximum age of an upstream connection, 0 = unlimited
+	upstreamReconnect bool          // Reconnect and replay the transaction once if the upstream connection breaks
+	dialLimiter       *dialLimiter  // Paces new upstream connections, if set
+	certWatch         certWatch     // Upstream certificate expiry
+
+	fcrdns        string // Forward-confirmed reverse DNS policy - see fcrdnsOff etc.
+	fcrdnsCache   fcrdnsCache
+	spf           string      // SPF check on MAIL FROM - see spfOff etc.
+	proxyProtocol bool        // Client connections begin with a PROXY protocol header giving the real client address
+	allowNetworks networkList // If set, the only client networks allowed to connect
+
+	policy         *policy  // Policy script evaluated at RCPT and DATA, if set
+	rspamdAddr     string   // host:port of rspamd, to scan messages before relaying, if set
+	transformOrder []string // Transform stages applied to buffered messages
+
+	dkim           *dkim.SignOptions // DKIM signing, if set
+	headerRules    []headerRule      // Header edits, if set
+	stripMsysAPI   bool              // Remove client X-MSYS-API headers
+	forceMessageID bool              // Add a Message-ID to messages without one
+
+	maxSize     int64         // Largest message accepted, 0 = no limit
+	maxRcpts    int           // Recipients accepted per message, 0 = no limit
+	dataTimeout time.Duration // Time allowed to receive a whole message, 0 = no limit
+
+	sink        bool // Accept and discard messages, never connecting upstream
+	xclient     bool // Pass the client's identity upstream with XCLIENT, if offered
+	forwardHelo bool // Pass the client's EHLO name upstream in XCLIENT, and show it in Received
+
+	pipelineRcpt bool // Send RCPT TO upstream in one pipelined batch at DATA, if the upstream offers PIPELINING
+
+	rateLimiter *rateLimiter // Messages per minute per client IP
+	greylist    *greylist    // Greylisting, if set
+	dataRetries int          // Times to resend a message the upstream refuses temporarily
+
+	sessions sync.WaitGroup // Client connections being served
+	connsMu  sync.Mutex
+	conns    map[*connBackend]struct{}
+	stopping int32 // Shutdown has begun (atomic)
+	paused   int32 // New connections refused, set over the admin API (atomic)
+
+	adminToken string // Bearer token required by the admin API, if set
+
+	readiness readiness // Cached upstream check, for /readyz
+
+	allowedCommands map[string]bool // SMTP verbs clients may use, nil = all
+	badCommandReply string          // Response to unrecognized commands before greeting
+	maxBadCommands  int             // Drop the connection after this many, 0 = never
+
+	rcptRoutes []rcptRoute // Recipient domains relayed to other upstreams
+
+	allowSenders addrList         // If set, the only senders accepted
+	denyRcpts    addrList         // Recipients refused
+	rewrites     *addressRewrites // Envelope address canonicalization, if set
+
+	storeAndForward bool   // Spool messages and accept them at once, relaying later
+	spool           *spool // If storeAndForward
+	forwarder       forwarder
+	priorities      priorities
+	retrySchedules  retrySchedules
+
+	suppression *suppressionList // Hard-bounced recipients, if enabled
+
+	pool       *connPool   // Idle authenticated upstream connections, if enabled
+	hostname   string      // The name the proxy advertises, for messages it originates and Received headers - see domain()
+	serverCert *serverCert // Certificate offered to clients, if any
+	ehloDomain string      // Name to advertise regardless of the certificate, if set
+
+	// Upstream TLS renegotiation policy. Go's TLS server never renegotiates and never accepts TLS 1.3 0-RTT early data,
+	// so inbound, no SMTP command can arrive in replayable early data; this only governs the upstream client side.
+	upstreamRenegotiation tls.RenegotiationSupport
+
+	tlsMinVersion uint16 // Inbound and upstream TLS version limits, 0 = Go's default
+	tlsMaxVersion uint16
+	tlsCiphers    []uint16 // Permitted TLS 1.0-1.2 cipher suites, nil = Go's default
 }
 
 func (bkd *Backend) logger(args ...interface{}) {
@@ -44,15 +189,35 @@ func (bkd *Backend) logger(args ...interface{}) {
 
 // Init the backend. Here we establish the upstream connection
 func (bkd *Backend) Init() (smtpproxy.Session, error) {
+	s, err := bkd.newSession(newSessionID(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newSession establishes the upstream connection for a client connecting from remote (nil if unknown)
+func (bkd *Backend) newSession(id string, remote net.Addr) (*Session, error) {
 	var s Session
+	if bkd.sink {
+		s.bkd, s.id, s.remoteAddr, s.start = bkd, id, remote, time.Now()
+		bkd.logger("---Sink mode, not connecting upstream")
+		return &s, nil
+	}
 	bkd.logger("---Connecting upstream")
-	c, err := smtpproxy.Dial(bkd.outHostPort)
-	s.bkd = bkd    // just for logging
-	s.upstream = c // keep record of the upstream Client connection
+	c, hostPort, err := bkd.dialUpstream()
 	if err != nil {
-		bkd.logger(respTwiddle(&s), "Connection error", bkd.outHostPort, err)
+		bkd.logger("\t<-", "Connection error", bkd.upstreams.hosts, err)
+		return nil, err
 	}
-	bkd.logger(respTwiddle(&s), "Connection success", bkd.outHostPort)
+	s.bkd = bkd    // just for logging
+	s.upstream = c // keep record of the upstream Client connection
+	s.upstreamHost = hostPort
+	s.upstreamSince = time.Now()
+	s.id = id
+	s.remoteAddr = remote
+	s.start = time.Now()
+	s.logger(respTwiddle(&s), "Connection success", hostPort)
 	return &s, nil
 }
 
@@ -62,9 +227,46 @@ func (bkd *Backend) Init() (smtpproxy.Session, error) {
 
 // A Session is returned after successful login. Here hold information that needs to persist across message phases.
 type Session struct {
-	bkd           *Backend          // The backend that created this session. Allows session methods to e.g. log
-	upstream      *smtpproxy.Client // the upstream client this backend is driving
-	blockUpstream bool              // Flag to prevent any further use of this session
+	bkd           *Backend            // The backend that created this session. Allows session methods to e.g. log
+	upstream      *smtpproxy.Client   // the upstream client this backend is driving
+	upstreamSince time.Time           // When the upstream connection was made
+	blockUpstream bool                // Flag to prevent any further use of this session
+	caps          []string            // Upstream capabilities, as reported at EHLO
+	authPending   string              // SASL mechanism awaiting a client continuation line, when the proxy handles AUTH itself
+	authLoginUser string              // Username received so far in an AUTH LOGIN exchange
+	authRelayMech string              // SASL mechanism of a relayed AUTH exchange in progress
+	authRelayUser string              // Username seen so far in a relayed AUTH exchange
+	authUser      string              // Username the client authenticated as, if known
+	authReplay    authReplayFunc      // Repeats a successful upstream AUTH on a new connection
+	upstreamHost  string              // host:port of the upstream connection
+	poolKey       string              // Identifies the upstream credentials, once authenticated, for pooling
+	id            string              // Session ID
+	remoteAddr    net.Addr            // The client's address, if known
+	conn          *connBackend        // The client connection, if known
+	start         time.Time           // When the session began
+	greeted       bool                // Client has sent a successful HELO / EHLO
+	ehlo          bool                // ... and it was EHLO
+	heloName      string              // The name the client gave in EHLO / HELO, with forward_helo
+	badCommands   int                 // Unrecognized commands sent before greeting
+	inTransaction bool                // MAIL FROM has been accepted, and the transaction not yet ended
+	mailfrom      string              // Envelope sender of the current transaction
+	mailParams    string              // ESMTP parameters given with MAIL FROM
+	mailDeferred  bool                // MAIL FROM not yet sent upstream (VERP)
+	rcptto        []string            // Recipients accepted in the current transaction
+	rcptParams    map[string]string   // ESMTP parameters given with RCPT TO (e.g. DSN NOTIFY, ORCPT), by recipient
+	pendingRcpts  []string            // Recipients not yet sent upstream, with pipeline_rcpt
+	refusedRcpts  int                 // Recipients accepted from the client but refused upstream at DATA
+	reconnected   bool                // Upstream connection replaced after a break in this transaction
+	undelivered   map[string]refusal  // Recipients accepted from the client but not relayed, with why, for generate_dsn
+	spfResult     spf.Result          // SPF result for the current sender, if checked
+	queueIDs      []string            // Upstream queue IDs of the current message
+	routed        map[string][]string // Recipients in rcptto held for other upstreams, by host:port
+	correlationID string              // Client's X-Correlation-ID for the current message, else the session ID
+	messages      int                 // Messages relayed in this session
+	bytes         int64               // Message bytes relayed in this session
+	recipients    int                 // Recipients of messages relayed in this session
+	inData        bool                // Session holds a DATA slot
+	countedUser   string              // User this session is counted against in the per-user connection limit
 }
 
 const upstreamBlockMsg = "Unable to handle messages at the moment, sorry"
@@ -72,6 +274,9 @@ const upstreamBlockCode = 500
 
 // cmdTwiddle returns different flow markers depending on whether connection is secure (like Swaks does)
 func cmdTwiddle(s *Session) string {
+	if s.upstream == nil {
+		return "->"
+	}
 	if _, isTLS := s.upstream.TLSConnectionState(); isTLS {
 		return "~>"
 	}
@@ -80,6 +285,9 @@ func cmdTwiddle(s *Session) string {
 
 // respTwiddle returns different flow markers depending on whether connection is secure (like Swaks does)
 func respTwiddle(s *Session) string {
+	if s.upstream == nil {
+		return "\t<-"
+	}
 	if _, isTLS := s.upstream.TLSConnectionState(); isTLS {
 		return "\t<~"
 	}
@@ -93,25 +301,47 @@ func (s *Session) Greet(helotype string) ([]string, int, string, error) {
 		code int
 		msg  string
 	)
-	s.bkd.logger(cmdTwiddle(s), helotype)
-	host, _, _ := net.SplitHostPort(s.bkd.outHostPort)
+	if code, msg, err := s.denyCommand(helotype, ""); code != 0 {
+		return nil, code, msg, err
+	}
+	s.logger(cmdTwiddle(s), helotype)
+	if s.bkd.forwardHelo && s.conn != nil {
+		s.heloName = s.conn.conn.heloName()
+	}
+	if s.bkd.sink {
+		s.greeted = true
+		s.ehlo = strings.EqualFold(helotype, "EHLO")
+		return s.sinkGreet()
+	}
+	host := upstreamName(s.upstreamHost)
 	code, msg, err = s.upstream.Hello(host)
 	if err != nil {
-		s.bkd.logger(respTwiddle(s), helotype, "error", err)
+		s.logger(respTwiddle(s), helotype, "error", err)
 		return nil, code, msg, err
 	}
-	s.bkd.logger(respTwiddle(s), helotype, "success")
+	s.logger(respTwiddle(s), helotype, "success")
+	s.greeted = true
+	s.ehlo = strings.EqualFold(helotype, "EHLO")
+	if err := s.sendXClient(s.upstream, host); err != nil {
+		log.Println("Upstream", err)
+	}
 	caps := s.upstream.Capabilities()
-	s.bkd.logger("\tUpstream capabilities:", caps)
+	s.logger("\tUpstream capabilities:", caps)
+	s.caps = caps
+	caps = withoutCapability(caps, "CHUNKING") // BDAT can't be relayed
+	caps = withSize(caps, s.sizeLimit())
+	if s.bkd.upstreamAuth != authPassthru {
+		caps = advertiseAuth(caps)
+	}
 
 	// Check for "eager" upstream TLS mode
 	if _, isTLS := s.upstream.TLSConnectionState(); !isTLS && s.bkd.requireUpstreamTLS {
-		s.bkd.logger("\tTrying immediate upstream STARTTLS")
+		s.logger("\tTrying immediate upstream STARTTLS")
 		code, msg, err = s.StartTLS()
 		if err != nil {
 			code = upstreamBlockCode
 			msg = upstreamBlockMsg
-			s.bkd.logger("\t", msg)
+			s.logger("\t", msg)
 			err = errors.New(msg)
 			s.blockUpstream = true // Prevent any further use of this session
 		}
@@ -121,65 +351,301 @@ func (s *Session) Greet(helotype string) ([]string, int, string, error) {
 
 // StartTLS command
 func (s *Session) StartTLS() (int, string, error) {
+	if s.bkd.sink {
+		s.logger(cmdTwiddle(s), "STARTTLS", "(sink)")
+		return 220, "2.0.0 Ready to start TLS", nil
+	}
 	if _, isTLS := s.upstream.TLSConnectionState(); isTLS {
 		// Handle the case where we are already secure upstream with "eager" option
 		code := 220
 		msg := "2.0.0 Ready to start TLS, upstream is already secure"
-		s.bkd.logger(respTwiddle(s), code, msg)
+		s.logger(respTwiddle(s), code, msg)
 		return code, msg, nil
 	}
 
-	host, _, _ := net.SplitHostPort(s.bkd.outHostPort)
-	// Try the upstream server, it will report error if unsupported
-	tlsconfig := &tls.Config{
-		InsecureSkipVerify: false,
-		ServerName:         host,
+	if !s.bkd.wantStartTLS(s.upstreamHost, s.caps) {
+		code := 220
+		msg := "2.0.0 Ready to start TLS"
+		s.logger("\tSTARTTLS handled by the proxy, upstream stays plaintext")
+		return code, msg, nil
 	}
-	s.bkd.logger(cmdTwiddle(s), "STARTTLS")
+	host := upstreamName(s.upstreamHost)
+	// Try the upstream server, it will report error if unsupported
+	tlsconfig := s.bkd.outTLSConfig(s.upstreamHost)
+	s.logger(cmdTwiddle(s), "STARTTLS")
 	if s.blockUpstream {
-		s.bkd.logger("\t", upstreamBlockMsg)
+		s.logger("\t", upstreamBlockMsg)
 		return upstreamBlockCode, "4.0.0 " + upstreamBlockMsg, errors.New(upstreamBlockMsg)
 	}
 	code, msg, err := s.upstream.StartTLS(tlsconfig)
-	s.bkd.logger(respTwiddle(s), code, msg)
+	s.logger(respTwiddle(s), code, msg)
+	if err == nil {
+		s.bkd.noteUpstreamCert(host, s.upstream)
+	}
 	return code, msg, err
 }
 
 //Auth command backend handler
 func (s *Session) Auth(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	if strings.EqualFold(cmd, "AUTH") { // not a SASL continuation line
+		if code, msg, err := s.denyCommand(cmd, ""); code != 0 {
+			return code, msg, err
+		}
+		if s.insecureAuth() {
+			s.logger(cmdTwiddle(s), cmd, "(before STARTTLS, not relayed)")
+			s.logger("\t", insecureAuthCode, insecureAuthMsg)
+			return insecureAuthCode, insecureAuthMsg, errors.New(insecureAuthMsg)
+		}
+	}
+	if s.bkd.upstreamAuth == authPassthru && !s.bkd.sink {
+		if u := s.relayedAuthUser(cmd, arg); u != "" {
+			if code, msg, err := s.loginAllowed(u); err != nil {
+				if !strings.EqualFold(cmd, "AUTH") {
+					s.upstream.MyCmd(501, "*") // cancel the exchange upstream
+				}
+				return code, msg, err
+			}
+		}
+		user, _ := plainAuthUser(arg) // only set for a single-line exchange
+		joined := cmd + " " + arg     // for a single-line exchange, can be repeated verbatim
+		if user != "" && s.fromPool(poolKey(joined)) {
+			s.loginDone(true)
+			s.authUser = user
+			s.authReplay = func(c *smtpproxy.Client) (int, string, error) {
+				return c.MyCmd(235, "%s", joined)
+			}
+			s.logger(cmdTwiddle(s), cmd, "(credentials match pooled connection)")
+			return 235, "2.7.0 Authentication successful", nil
+		}
+		logLine := redacted // a continuation line is all credentials
+		if strings.EqualFold(cmd, "AUTH") {
+			logLine = redactCommand(cmd, arg)
+		}
+		code, msg, err := s.passthruLogged(expectcode, cmd, arg, logLine)
+		if code == 334 { // the exchange continues
+			return code, msg, err
+		}
+		s.loginDone(err == nil)
+		if err == nil {
+			s.authUser = s.authRelayUser
+		}
+		if user != "" && err == nil {
+			s.poolKey = poolKey(joined)
+			s.authReplay = func(c *smtpproxy.Client) (int, string, error) {
+				return c.MyCmd(235, "%s", joined)
+			}
+		}
+		s.bkd.authAlarm.record(s.authIdentity(s.authRelayUser), err == nil, code, msg, s.upstreamHost)
+		return code, msg, err
+	}
+	return s.proxyAuth(cmd, arg)
 }
 
 //Mail command backend handler
 func (s *Session) Mail(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	if code, msg, err := s.denyCommand(cmd, arg); code != 0 {
+		return code, msg, err
+	}
+	if s.inTransaction {
+		// Out of sequence. Answer it here, the upstream's view of the transaction may differ from the client's
+		msg := "5.5.1 Sender already specified"
+		s.logger(cmdTwiddle(s), cmd, arg, "(not relayed)")
+		s.logger("\t", msg)
+		return 503, msg, errors.New(msg)
+	}
+	if code, msg, err := s.rateAllowed(); code != 0 {
+		s.logger(cmdTwiddle(s), cmd, arg, "(not relayed)")
+		return code, msg, err
+	}
+	s.resetTransaction()
+	s.checkUpstreamAge()
+	addr, params, ok := parsePath(arg, "FROM:")
+	if ok && s.bkd.allowSenders != nil && !s.bkd.allowSenders.matches(addr) {
+		s.logger(cmdTwiddle(s), cmd, arg, "(sender not allowed, not relayed)")
+		return addrListCode, senderDeniedMsg, errors.New(senderDeniedMsg)
+	}
+	if code, msg, err := s.checkSPF(addr); code != 0 {
+		s.logger(cmdTwiddle(s), cmd, arg, "(SPF fail, not relayed)")
+		return code, msg, err
+	}
+	if ok {
+		addr, arg = s.rewritePath(addr, params, "FROM:", arg)
+		s.mailfrom, s.mailParams = addr, params
+	}
+	if limit := s.sizeLimit(); limit > 0 && declaredSize(params) > limit {
+		s.logger(cmdTwiddle(s), cmd, arg, "(not relayed)")
+		s.logger("\t", sizeLimitCode, sizeLimitMsg)
+		return sizeLimitCode, sizeLimitMsg, errTooLarge
+	}
+	if s.holding() {
+		s.logger(cmdTwiddle(s), cmd, arg, "(held until DATA)")
+		if !ok {
+			return 501, "5.1.7 Bad sender address syntax", errors.New("bad MAIL FROM syntax")
+		}
+		s.inTransaction = true
+		return 250, "2.1.0 Ok", nil
+	}
+	if s.bkd.verp != "" && s.mailfrom != "" {
+		// The return path depends on the recipient, so hold back MAIL FROM until we see the RCPT
+		s.logger(cmdTwiddle(s), cmd, arg, "(deferred until RCPT for VERP)")
+		s.mailDeferred = true
+		s.inTransaction = true
+		return 250, "2.1.0 Ok", nil
+	}
+	code, msg, err := s.Passthru(expectcode, cmd, arg)
+	s.inTransaction = err == nil
+	return code, msg, err
 }
 
 //Rcpt command backend handler
 func (s *Session) Rcpt(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	if code, msg, err := s.denyCommand(cmd, arg); code != 0 {
+		return code, msg, err
+	}
+	if code, msg, err := s.checkRcptLimit(); code != 0 {
+		s.logger(cmdTwiddle(s), cmd, arg, "(recipient limit reached, not relayed)")
+		return code, msg, err
+	}
+	addr, params, ok := parsePath(arg, "TO:")
+	if ok {
+		addr, arg = s.rewritePath(addr, params, "TO:", arg)
+	}
+	if ok && addr != "" {
+		if s.bkd.denyRcpts.matches(addr) {
+			s.logger(cmdTwiddle(s), cmd, arg, "(recipient denied, not relayed)")
+			return addrListCode, rcptDeniedMsg, errors.New(rcptDeniedMsg)
+		}
+		if s.bkd.suppression.suppressed(addr) {
+			s.logger(cmdTwiddle(s), cmd, arg, "(suppressed, not relayed)")
+			return suppressedCode, suppressedMsg, errors.New(suppressedMsg)
+		}
+		if code, msg, err := s.checkPolicy(policyRcpt, addr, nil); code != 0 {
+			s.logger(cmdTwiddle(s), cmd, arg, "(not relayed)")
+			return code, msg, err
+		}
+		if code, msg, err := s.checkGreylist(addr); code != 0 {
+			s.logger(cmdTwiddle(s), cmd, arg, "(greylisted, not relayed)")
+			return code, msg, err
+		}
+	}
+	if route := s.bkd.routeFor(addr); ok && addr != "" && route != "" {
+		s.logger(cmdTwiddle(s), cmd, arg, "(held until DATA, routed to "+route+")")
+		if s.routed == nil {
+			s.routed = make(map[string][]string)
+		}
+		s.routed[route] = append(s.routed[route], addr)
+		s.addRcpt(addr, params)
+		return 250, "2.1.5 Ok", nil
+	}
+	if s.holding() {
+		s.logger(cmdTwiddle(s), cmd, arg, "(held until DATA)")
+		if !ok || addr == "" {
+			return 501, "5.1.3 Bad recipient address syntax", errors.New("bad RCPT TO syntax")
+		}
+		s.addRcpt(addr, params)
+		return 250, "2.1.5 Ok", nil
+	}
+	if s.pipeliningRcpts() {
+		s.logger(cmdTwiddle(s), cmd, arg, "(sent upstream at DATA)")
+		if !ok || addr == "" {
+			return 501, "5.1.3 Bad recipient address syntax", errors.New("bad RCPT TO syntax")
+		}
+		s.pendingRcpts = append(s.pendingRcpts, addr)
+		s.setRcptParams(addr, params)
+		return 250, "2.1.5 Ok", nil
+	}
+	if s.bkd.verp != "" && s.mailfrom != "" {
+		if len(s.rcptto) > 0 {
+			// Each recipient needs its own return path, so its own transaction
+			msg := "4.5.3 One recipient per message with VERP, send the others separately"
+			s.logger("\t", msg)
+			return 452, msg, errors.New(msg)
+		}
+		if s.mailDeferred {
+			verpFrom := verpAddress(s.bkd.verp, s.mailfrom, addr)
+			code, msg, err := s.Passthru(250, "MAIL", "FROM:<"+verpFrom+">"+s.mailParams)
+			if err != nil {
+				return code, msg, err
+			}
+			s.mailDeferred = false
+		}
+	}
+	code, msg, err := s.Passthru(expectcode, cmd, arg)
+	if err == nil {
+		s.addRcpt(addr, params)
+	} else {
+		s.suppressRefused(addr, code, msg)
+	}
+	if err != nil && s.bkd.verp != "" && s.mailfrom != "" {
+		// That return path was for this recipient; start over for the next one
+		s.Passthru(250, "RSET", "")
+		s.mailDeferred = true
+	}
+	return code, msg, err
 }
 
 //Reset command backend handler
 func (s *Session) Reset(expectcode int, cmd, arg string) (int, string, error) {
+	if code, msg, err := s.denyCommand(cmd, arg); code != 0 {
+		return code, msg, err
+	}
+	s.resetTransaction()
 	return s.Passthru(expectcode, cmd, arg)
 }
 
+// resetTransaction clears the envelope, ready for a new mail transaction
+func (s *Session) resetTransaction() {
+	s.inTransaction = false
+	s.mailfrom, s.mailParams = "", ""
+	s.rcptto = nil
+	s.rcptParams = nil
+	s.pendingRcpts = nil
+	s.refusedRcpts = 0
+	s.reconnected = false
+	s.undelivered = nil
+	s.spfResult = ""
+	s.queueIDs = nil
+	s.routed = nil
+	s.mailDeferred = false
+	s.correlationID = ""
+}
+
 //Quit command backend handler
 func (s *Session) Quit(expectcode int, cmd, arg string) (int, string, error) {
+	if s.poolable() {
+		s.logger("\tQUIT answered locally, keeping upstream connection for the pool")
+		return poolQuitCode, poolQuitMsg, nil
+	}
 	return s.Passthru(expectcode, cmd, arg)
 }
 
 //Unknown command backend handler
 func (s *Session) Unknown(expectcode int, cmd, arg string) (int, string, error) {
+	if code, msg, err := s.denyCommand(cmd, arg); code != 0 {
+		return code, msg, err
+	}
+	if code, msg, err := s.badCommand(cmd, arg); code != 0 {
+		return code, msg, err
+	}
+	if strings.EqualFold(cmd, "BDAT") {
+		return s.rejectBDAT(cmd, arg)
+	}
 	return s.Passthru(expectcode, cmd, arg)
 }
 
 // Passthru a command to the upstream server, logging
 func (s *Session) Passthru(expectcode int, cmd, arg string) (int, string, error) {
-	s.bkd.logger(cmdTwiddle(s), cmd, arg)
+	return s.passthruLogged(expectcode, cmd, arg, redactCommand(cmd, arg))
+}
+
+// passthruLogged is Passthru, logging the command as logLine
+func (s *Session) passthruLogged(expectcode int, cmd, arg, logLine string) (int, string, error) {
+	s.logger(cmdTwiddle(s), logLine)
+	if s.bkd.sink {
+		return s.sinkReply(cmd)
+	}
 	if s.blockUpstream {
-		s.bkd.logger("\t", upstreamBlockMsg)
+		s.logger("\t", upstreamBlockMsg)
 		return upstreamBlockCode, "4.0.0 " + upstreamBlockMsg, errors.New(upstreamBlockMsg)
 	}
 	joined := cmd
@@ -187,105 +653,841 @@ func (s *Session) Passthru(expectcode int, cmd, arg string) (int, string, error)
 		joined = cmd + " " + arg
 	}
 	code, msg, err := s.upstream.MyCmd(expectcode, joined)
-	s.bkd.logger(respTwiddle(s), code, msg)
+	if upstreamLost(err) {
+		code, msg, err = s.onUpstreamLost(expectcode, cmd, joined, err)
+	}
+	s.logger(respTwiddle(s), code, msg)
 	return code, msg, err
 }
 
 // DataCommand pass upstream, returning a place to write the data AND the usual responses
 func (s *Session) DataCommand() (io.WriteCloser, int, string, error) {
-	s.bkd.logger(cmdTwiddle(s), "DATA")
+	if code, msg, err := s.denyCommand("DATA", ""); code != 0 {
+		return nil, code, msg, err
+	}
+	s.logger(cmdTwiddle(s), "DATA")
 	if s.blockUpstream {
-		s.bkd.logger("\t", upstreamBlockMsg)
+		s.logger("\t", upstreamBlockMsg)
 		return nil, upstreamBlockCode, "4.0.0 " + upstreamBlockMsg, errors.New(upstreamBlockMsg)
 	}
+	if code, msg, err := s.flushRcpts(); code != 0 {
+		return nil, code, msg, err
+	}
+	if s.buffering() && len(s.rcptto) == 0 {
+		msg := "5.5.1 No valid recipients"
+		return nil, 503, msg, errors.New(msg)
+	}
+	if !s.holding() && len(s.defaultRcpts()) > 0 {
+		if code, msg, err := s.addArchiveRcpt(); code != 0 {
+			return nil, code, msg, err
+		}
+	}
+	if !s.conn.startMessage() {
+		s.logger("\t", shutdownMsg)
+		return nil, shutdownCode, shutdownMsg, errors.New(shutdownMsg)
+	}
+	if !s.acquireDataSlot() {
+		s.conn.endMessage()
+		s.logger("\t", dataBusyMsg)
+		return nil, dataBusyCode, dataBusyMsg, errors.New(dataBusyMsg)
+	}
+	if s.buffering() {
+		// Upstream DATA is issued later, once we have the whole message
+		return &bufferCloser{}, 354, "Start mail input; end with <CRLF>.<CRLF>", nil
+	}
 	w, code, msg, err := s.upstream.Data()
+	if upstreamLost(err) {
+		w, code, msg, err = s.dataAfterLoss(err)
+	}
 	if err != nil {
-		s.bkd.logger(respTwiddle(s), "DATA error", err)
+		s.logger(respTwiddle(s), "DATA error", err)
+		s.releaseDataSlot()
+		s.conn.endMessage()
 	}
 	return w, code, msg, err
 }
 
 // Data body (dot delimited) pass upstream, returning the usual responses
 func (s *Session) Data(r io.Reader, w io.WriteCloser) (int, string, error) {
-	var w2 io.Writer // If upstream debugging, tee off a copy into the debug file.
-	if s.bkd.upstreamDebug != nil {
-		w2 = io.MultiWriter(w, s.bkd.upstreamDebug)
-	} else {
-		w2 = w
+	defer s.conn.endMessage()
+	defer s.releaseDataSlot()
+	defer s.resetTransaction()
+	if s.bkd.fixLineEndings {
+		r = newCRLFReader(r)
+	}
+	if limit := s.sizeLimit(); limit > 0 {
+		r = &sizeLimitReader{r: r, n: limit}
+	}
+	r, stopTimer := s.withDataTimeout(r)
+	defer stopTimer()
+	msgHeader, body, err := readHeader(r)
+	if errors.Is(err, errTooLarge) {
+		return s.tooLarge()
+	}
+	if errors.Is(err, errDataTimeout) {
+		return s.dataTimedOut()
 	}
-	bytesWritten, err := smtpproxy.MailCopy(w2, r)
 	if err != nil {
-		msg := "DATA io.Copy error"
-		s.bkd.logger(respTwiddle(s), msg, err)
+		msg := "DATA header read error"
+		s.logger(respTwiddle(s), msg, err)
 		return 0, msg, err
 	}
-	err = w.Close()
-	code := s.upstream.DataResponseCode
-	msg := s.upstream.DataResponseMsg
+	if s.bkd.stripMsysAPI {
+		if _, found := parseHeader(msgHeader)["X-Msys-Api"]; found {
+			s.logger("\tClient X-MSYS-API header removed")
+			msgHeader = applyHeaderRules(stripMsysAPI, msgHeader)
+		}
+	}
+	if code, msg, err := s.checkHops(msgHeader); code != 0 {
+		s.abandonData()
+		return code, msg, err
+	}
+	r = io.MultiReader(bytes.NewReader(msgHeader), body)
+	s.correlationID = correlationID(parseHeader(msgHeader))
+	if s.correlationID == "" {
+		s.correlationID = s.id
+	}
+	s.logger("\tMessage correlation ID", s.correlationID)
+	var (
+		code         int
+		msg          string
+		bytesWritten int64
+	)
+	var buf bytes.Buffer // Message copy, when we need the whole thing
+	hash := sha256.New() // Of the message as sent upstream
+	if s.buffering() {
+		bytesWritten, err = io.Copy(&buf, r)
+		if errors.Is(err, errTooLarge) {
+			return s.tooLarge()
+		}
+		if errors.Is(err, errDataTimeout) {
+			return s.dataTimedOut()
+		}
+		if err != nil {
+			msg := "DATA io.Copy error"
+			s.logger(respTwiddle(s), msg, err)
+			return 0, msg, err
+		}
+		out, tcode, tmsg, terr := s.transform(buf.Bytes())
+		if tcode != 0 {
+			if !s.holding() {
+				s.Passthru(250, "RSET", "")
+			}
+			return tcode, tmsg, terr
+		}
+		buf.Reset()
+		buf.Write(out)
+		if s.archiving() && s.bkd.archiveRelayRequired {
+			// Archive first, so that if it fails the primary is never relayed
+			if aerr := s.archiveCopy(buf.Bytes()); aerr != nil {
+				s.archiveFailed(aerr)
+				if !s.holding() {
+					s.Passthru(250, "RSET", "")
+				}
+				return archiveFailCode, archiveFailMsg, errors.New(archiveFailMsg)
+			}
+		}
+		hash.Write(buf.Bytes())
+		code, msg, err = s.relayBuffered(buf.Bytes())
+	} else {
+		var w2 io.Writer // If upstream debugging, tee off a copy into the debug file.
+		if s.bkd.upstreamDebug != nil {
+			w2 = io.MultiWriter(w, s.bkd.upstreamDebug)
+		} else {
+			w2 = w
+		}
+		if s.archiving() {
+			w2 = io.MultiWriter(w2, &buf)
+		}
+		w2 = io.MultiWriter(w2, hash)
+		if hdr := s.addedHeaders(); hdr != "" {
+			if _, err := io.WriteString(w2, hdr); err != nil {
+				msg := "DATA header write error"
+				s.logger(respTwiddle(s), msg, err)
+				return 0, msg, err
+			}
+		}
+		bytesWritten, err = smtpproxy.MailCopy(w2, r)
+		if errors.Is(err, errTooLarge) {
+			return s.tooLarge()
+		}
+		if errors.Is(err, errDataTimeout) {
+			return s.dataTimedOut()
+		}
+		if err != nil {
+			msg := "DATA io.Copy error"
+			s.logger(respTwiddle(s), msg, err)
+			return 0, msg, err
+		}
+		err = w.Close()
+		code = s.upstream.DataResponseCode
+		msg = s.upstream.DataResponseMsg
+		if code == 0 && upstreamLost(err) {
+			code, msg = upstreamLostCode, upstreamLostMsg
+		}
+		if err == nil {
+			s.noteQueueID(msg)
+		}
+	}
 	if err != nil {
-		s.bkd.logger(respTwiddle(s), "DATA Close error", err, ", bytes written =", bytesWritten)
+		s.logger(respTwiddle(s), "DATA Close error", err, ", bytes written =", bytesWritten, ", correlation ID =", s.correlationID)
 	} else {
-		s.bkd.logger(respTwiddle(s), "DATA accepted, bytes written =", bytesWritten)
-		s.bkd.logger(respTwiddle(s), code, msg)
+		s.logger(respTwiddle(s), "DATA accepted, bytes written =", bytesWritten, ", correlation ID =", s.correlationID)
+		s.logger(respTwiddle(s), code, msg)
+		sum := hex.EncodeToString(hash.Sum(nil))
+		s.logger("\tMessage SHA-256", sum)
+		s.logMessage(bytesWritten, sum, code, msg)
+		s.messages++
+		s.bytes += bytesWritten
+		s.bkd.countRelayed(bytesWritten)
+		s.recipients += len(s.rcptto)
+		if s.archiving() && !s.bkd.archiveRelayRequired {
+			if aerr := s.archiveCopy(buf.Bytes()); aerr != nil {
+				s.archiveFailed(aerr)
+			}
+		}
+		s.sendDSN(msgHeader)
+	}
+	if err == nil {
+		msg = s.refusedNote(msg)
+	}
+	s.logAccess(bytesWritten, code, msg)
+	if s.bkd.traceEnvelopes {
+		fmt.Printf("%s -> [%s] (%d bytes) => %d %s [%s]\n", s.mailfrom, strings.Join(s.rcptto, " "), bytesWritten, code, msg, s.correlationID)
 	}
 	return code, msg, err
 }
 
+// logout is called when the client connection closes, however the session ended
+func (s *Session) logout() {
+	pooled := s.toPool()
+	s.releaseDataSlot()
+	if s.countedUser != "" {
+		s.bkd.userConns.release(s.countedUser)
+	}
+	if s.upstream != nil && !pooled {
+		s.upstream.Close()
+	}
+	if s.bkd.usageLog != nil {
+		client := ""
+		if s.remoteAddr != nil {
+			client = s.remoteAddr.String()
+		}
+		err := s.bkd.usageLog.write(usageEvent{
+			Time:       time.Now(),
+			Event:      "session_usage",
+			Client:     client,
+			User:       s.authUser,
+			Messages:   s.messages,
+			Bytes:      s.bytes,
+			Recipients: s.recipients,
+			Duration:   time.Since(s.start).Seconds(),
+		})
+		if err != nil {
+			log.Println("Usage log error", err)
+		}
+	}
+}
+
+// logMessage writes a relayed message's audit event, if message_log is enabled
+func (s *Session) logMessage(size int64, sum string, code int, msg string) {
+	if s.bkd.messageLog == nil {
+		return
+	}
+	client := ""
+	if s.remoteAddr != nil {
+		client = s.remoteAddr.String()
+	}
+	err := s.bkd.messageLog.write(messageEvent{
+		Time:          time.Now(),
+		Event:         "message_relayed",
+		Session:       s.id,
+		CorrelationID: s.correlationID,
+		Client:        client,
+		User:          s.authUser,
+		MailFrom:      s.mailfrom,
+		RcptTo:        s.rcptto,
+		Bytes:         size,
+		SHA256:        sum,
+		Code:          code,
+		Response:      msg,
+		QueueIDs:      s.queueIDs,
+	})
+	if err != nil {
+		log.Println("Message log error", err)
+	}
+}
+
 //-----------------------------------------------------------------------------
 
+var renegotiationPolicies = map[string]tls.RenegotiationSupport{
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
 func main() {
 	inHostPort := flag.String("in_hostport", "localhost:587", "Port number to serve incoming SMTP requests")
-	outHostPort := flag.String("out_hostport", "smtp.sparkpostmail.com:587", "host:port for onward routing of SMTP requests")
+	outHostPort := flag.String("out_hostport", "smtp.sparkpostmail.com:587", "host:port for onward routing of SMTP requests, or unix:/path for a Unix socket. Give a comma-separated list to share load round-robin, and fail over")
 	verboseOpt := flag.Bool("verbose", false, "print out lots of messages")
 	certfile := flag.String("certfile", "", "Certificate file for this server")
 	privkeyfile := flag.String("privkeyfile", "", "Private key file for this server")
 	serverDebug := flag.String("server_debug", "", "File to write downstream server SMTP conversation for debugging")
 	upstreamDebug := flag.String("upstream_debug", "", "File to write upstream proxy SMTP conversation for debugging")
 	requireUpstreamTLS := flag.Bool("require_upstream_tls", false, "Force upstream server to TLS (raise error if it can't)")
+	upstreamImplicitTLS := flag.Bool("upstream_implicit_tls", false, "Connect to the upstream server with TLS from the start (SMTPS, usually port 465) instead of STARTTLS")
+	fixLineEndings := flag.Bool("fix_line_endings", false, "Normalize bare LF and bare CR line endings to CRLF in message DATA")
+	upstreamRenegotiation := flag.String("upstream_tls_renegotiation", "never", "Upstream TLS renegotiation policy: never, once or freely")
+	authAlertThreshold := flag.Int("auth_alert_threshold", 5, "Alert after this many consecutive upstream AUTH failures across different users (0 to disable)")
+	authAlertInterval := flag.Duration("auth_alert_interval", 15*time.Minute, "Minimum interval between upstream AUTH failure alerts")
+	authAlertWebhook := flag.String("auth_alert_webhook", "", "URL to POST a JSON alert to when upstream AUTH is failing repeatedly")
+	maxConcurrentData := flag.Int("max_concurrent_data", 0, "Maximum sessions streaming DATA at once, others get a transient error (0 = unlimited)")
+	statsAddr := flag.String("stats_addr", "", "host:port to serve JSON stats on, at /stats")
+	verp := flag.String("verp", "", "Rewrite MAIL FROM to a VERP address per recipient, e.g. \"{sender_local}+{rcpt_local}={rcpt_domain}@{sender_domain}\". Limits messages to one recipient each, unless split_recipients is set")
+	splitRecipients := flag.Bool("split_recipients", false, "Buffer each message and relay it in a separate upstream transaction per recipient")
+	maxConnsPerUser := flag.Int("max_conns_per_user", 0, "Maximum concurrent sessions per authenticated user (0 = unlimited)")
+	captureDir := flag.String("capture_dir", "", "Directory to write each inbound SMTP session's transcript to, one file per session ID")
+	captureFilter := flag.String("capture_filter", "", "Comma-separated client IPs and/or usernames to capture (default all sessions)")
+	archiveRelay := flag.String("archive_relay", "", "host:port of an archive MX to relay a full duplicate of each accepted message to")
+	archiveRelayRcpt := flag.String("archive_relay_rcpt", "", "Recipient address for archive_relay copies (default: the original envelope recipients), or the blind recipient added with archive_mode rcpt")
+	archiveRelayRequired := flag.Bool("archive_relay_required", false, "Reject messages whose archive_relay copy fails, rather than just logging the failure")
+	addReceivedHeader := flag.Bool("add_received_header", true, "Add a Received header to each message, tracing its passage through the proxy")
+	addTLSHeader := flag.Bool("add_tls_header", false, "Add an X-Proxy-TLS header to each message, recording the inbound TLS version and cipher")
+	requireFCrDNS := flag.String("require_fcrdns", fcrdnsOff, "Check clients have forward-confirmed reverse DNS: \"log\" failures, or \"enforce\" by rejecting them")
+	reusePort := flag.Bool("reuse_port", false, "Set SO_REUSEPORT on the listener, so several proxy processes can share in_hostport")
+	listenBacklog := flag.Int("listen_backlog", 0, "Listen queue length for connections not yet accepted (0 = system default)")
+	traceEnvelopes := flag.Bool("trace_envelopes", false, "Print one line per message to stdout: sender, recipients, size and upstream response")
+	upstreamConnTTL := flag.Duration("upstream_conn_ttl", 0, "Retire and redial upstream connections older than this, between transactions (0 = never)")
+	policyScript := flag.String("policy_script", "", "File containing a CEL expression to accept or reject each recipient and message (see policy.go)")
+	messageLog := flag.String("message_log", "", "File to append a JSON event to for each relayed message, with the envelope, SHA-256 of the content sent upstream, and upstream response")
+	allowedCommands := flag.String("allowed_commands", "", "Comma-separated SMTP verbs clients may use, e.g. EHLO,HELO,STARTTLS,AUTH,MAIL,RCPT,DATA,RSET,NOOP. Others get 502 (default all)")
+	maxUpstreamDials := flag.Float64("max_upstream_dials_per_sec", 0, "Maximum rate of new upstream connections; clients queue for a turn (0 = unlimited)")
+	upstreamDialMaxWait := flag.Duration("upstream_dial_max_wait", 5*time.Second, "Longest a client waits for a max_upstream_dials_per_sec turn, before being refused with 421")
+	transformOrder := flag.String("transform_order", defaultTransformOrder, "Order of the transform stages applied to buffered messages, listing each once: "+strings.Join(transformStages, ", "))
+	configDump := flag.String("config_dump", "", "Write a JSON manifest of the effective configuration to this file at startup (\"-\" for stdout), with secrets redacted")
+	recipientRoutes := flag.String("recipient_routes", "", "Comma-separated domain=host:port routes, relaying recipients in those domains (and subdomains) to other upstreams")
+	upstreamCertWarnDays := flag.Int("upstream_cert_warn_days", 14, "Log a warning (once a day per host) when an upstream server's certificate expires within this many days (0 = never)")
+	badCommandReply := flag.String("bad_command_reply", "5.5.2 Command unrecognized", "Response text (code 500) to unrecognized commands sent before HELO/EHLO, as from scanners")
+	maxBadCommands := flag.Int("max_bad_commands", 0, "Drop the connection after this many unrecognized commands before HELO/EHLO (0 = never)")
+	upstreamCertName := flag.String("upstream_expected_cert_name", "", "Verify the out_hostport upstream's certificate against this name (also sent as SNI), e.g. when dialling it by IP address")
+	storeAndForward := flag.Bool("store_and_forward", false, "Accept each message to the spool with 250 at once, and relay it to the upstream afterwards, retrying as needed")
+	spoolDir := flag.String("spool_dir", "spool", "Directory for store_and_forward messages awaiting relay")
+	spoolMaxAge := flag.Duration("spool_max_age", 5*24*time.Hour, "Bounce store_and_forward messages not delivered within this time")
+	forwardWorkers := flag.Int("forward_workers", 4, "Number of store_and_forward messages relayed at once")
+	forwardMaxPerUpstream := flag.Int("forward_max_per_upstream", 0, "Maximum store_and_forward connections to any one upstream (0 = unlimited)")
+	priorityHeader := flag.String("priority_header", "X-Priority", "Header giving store_and_forward message priority: 1-2 high, 3 normal, 4-5 low (empty to ignore)")
+	priorityUsers := flag.String("priority_users", "", "Comma-separated user=low|normal|high store_and_forward priorities for authenticated users, overriding priority_header")
+	priorityAging := flag.Duration("priority_aging", 10*time.Minute, "Raise a waiting store_and_forward message one priority level for each period this long (0 = never)")
+	retrySchedule := flag.String("retry_schedule", "", "store_and_forward retry delays by upstream failure code, e.g. \"421:1m,5m,15m; 451:15m,1h; default:5m,30m,2h\" (default: doubling from 5m to 4h)")
+	suppressionTTL := flag.Duration("suppression_ttl", 0, "Refuse RCPT TO recipients that hard bounced, for this long (0 = no suppression list)")
+	suppressionFile := flag.String("suppression_file", "suppression.json", "File to keep the suppression list in, across restarts")
+	poolSize := flag.Int("pool_size", 0, "Keep up to this many idle authenticated upstream connections, for reuse by sessions with the same credentials (0 = no pooling)")
+	dkimDomain := flag.String("dkim_domain", "", "Domain (d=) to DKIM-sign messages for. Needs dkim_selector and dkim_key")
+	dkimSelector := flag.String("dkim_selector", "", "DKIM selector (s=)")
+	dkimKey := flag.String("dkim_key", "", "File containing the PEM-encoded DKIM private key (RSA or Ed25519)")
+	maxSize := flag.Int("max_size", 0, "Largest message accepted, in bytes, advertised as SIZE (lowered to the upstream's SIZE if smaller). 0 = no limit")
+	shutdownTimeout := flag.Duration("shutdown_timeout", 30*time.Second, "On SIGINT or SIGTERM, how long to wait for messages being relayed before exiting")
+	readTimeout := flag.Duration("read_timeout", 60*time.Second, "How long to wait for each read from a client, e.g. a command or a chunk of DATA")
+	writeTimeout := flag.Duration("write_timeout", 60*time.Second, "How long to wait for each write to a client")
+	upstreamTimeout := flag.Duration("upstream_timeout", 0, "How long to wait for an upstream connection to be made, and for each read and write on it (0 = no limit)")
+	logFormat := flag.String("log_format", logFormatText, "Log line format: text, or json (one object per line, with session details as fields)")
+	routesFile := flag.String("routes", "", "File of \"domain host:port\" lines, relaying recipients in those domains (and subdomains) to other upstreams, as for recipient_routes")
+	rateLimit := flag.Float64("rate_limit", 0, "Messages per minute allowed from each client IP address, with bursts up to the same number. Over this, MAIL FROM gets 450 (0 = unlimited)")
+	headerRules := flag.String("header_rules", "", "File of add / remove / replace directives applied to message headers (see headerrules.go)")
+	upstreamStartTLS := flag.String("upstream_starttls", startTLSRequired, "When a client uses STARTTLS: \"required\" to STARTTLS upstream too, \"opportunistic\" to do so only if the upstream offers it, or \"none\" to keep the upstream plaintext")
+	upstreamCA := flag.String("upstream_ca", "", "PEM file of CA certificates to verify upstream servers against, instead of the system's")
+	upstreamInsecure := flag.Bool("upstream_insecure", false, "Don't verify upstream server certificates. For testing only")
+	sink := flag.Bool("sink", false, "Accept messages and discard them, without connecting upstream. For load testing")
+	allowSenders := flag.String("allow_senders", "", "File of sender address patterns (address, @domain or glob). If given, other senders are refused")
+	denyRcpts := flag.String("deny_rcpt", "", "File of recipient address patterns (address, @domain or glob) to refuse")
+	xclient := flag.Bool("xclient", false, "Pass each client's address and name to the upstream with XCLIENT, if it offers it (e.g. Postfix smtpd_authorized_xclient_hosts)")
+	dataRetries := flag.Int("data_retries", 0, "Resend a message up to this many times, on a fresh upstream connection, if the upstream fails it temporarily (4xx). Messages are buffered")
+	ehloDomain := flag.String("ehlo_domain", "", "Name the proxy advertises in its greeting and EHLO response. Default: the certificate's subject, or the hostname if no certificate")
+	healthAddr := flag.String("health_addr", "", "host:port to serve health checks on: /healthz (process up) and /readyz (upstream reachable)")
+	stripMsysAPIHeader := flag.Bool("strip_msys_api", false, "Remove any X-MSYS-API header from client messages, so clients can't change how SparkPost handles them")
+	archiveMap := flag.String("archive_map", "", "File of \"senderdomain address\" lines, choosing the archive_relay recipient by sender domain (default: archive_relay_rcpt)")
+	proxyProtocol := flag.Bool("proxy_protocol", false, "Expect a PROXY protocol v1/v2 header on each client connection, e.g. from a load balancer, and use the client address it gives")
+	forceMessageID := flag.Bool("force_message_id", false, "Add a Message-ID header to messages that arrive without one")
+	configFile := flag.String("config", "", "YAML file of option values, by flag name. Flags given on the command line override it")
+	spfMode := flag.String("spf", spfOff, "SPF check on the MAIL FROM domain against the client IP: \"soft\" adds a Received-SPF header, \"enforce\" also rejects hard fails")
+	maxConnections := flag.Int("max_connections", 0, "Maximum client connections at once, others are refused with 421 (0 = unlimited)")
+	accessLogFile := flag.String("access_log", "", "File to append a line to for each transaction: client, user, envelope, size, upstream queue ID and status")
+	smtpsHostPort := flag.String("smtps_hostport", "", "Also serve SMTPS (implicit TLS, usually port 465) on this host:port, with the same certificate")
+	allowInsecureAuth := flag.Bool("allow_insecure_auth", false, "Allow clients to AUTH on a plaintext connection, before STARTTLS. Otherwise they get 538")
+	greylistOn := flag.Bool("greylist", false, "Temporarily refuse the first attempt from each client IP, sender and recipient, accepting retries after greylist_delay")
+	greylistDelay := flag.Duration("greylist_delay", 5*time.Minute, "How long a greylisted client must wait before retrying")
+	localAuthFile := flag.String("local_auth_file", "", "htpasswd-style file of user:bcrypt-hash lines to authenticate clients against, rather than the upstream")
+	upstreamUser := flag.String("upstream_user", "", "Service account to authenticate upstream as, in place of the client's credentials (needs local_auth_file)")
+	upstreamPass := flag.String("upstream_pass", "", "Password for upstream_user")
+	maskErrors := flag.Bool("mask_errors", false, "Replace the text of failure responses to clients with a generic message, keeping the reply and enhanced status codes")
+	errorMessages := flag.String("error_messages", "", "File of \"code message\" lines, giving the text of failure responses to clients by reply code")
+	dataTimeout := flag.Duration("data_timeout", 0, "Time allowed for a client to send a whole message, after which it gets 451 and is disconnected (0 = no limit, just read_timeout)")
+	tlsMinVersion := flag.String("tls_min_version", "1.2", "Lowest TLS version accepted from clients and upstreams: 1.0, 1.1, 1.2 or 1.3")
+	tlsMaxVersion := flag.String("tls_max_version", "", "Highest TLS version used with clients and upstreams (default: the highest Go supports)")
+	tlsCiphers := flag.String("tls_ciphers", "", "Comma-separated TLS 1.0-1.2 cipher suites to allow, by Go name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (default: Go's secure list)")
+	forwardHelo := flag.Bool("forward_helo", false, "Pass the client's EHLO/HELO name upstream (XCLIENT HELO=, with xclient) and show it in the Received header")
+	pipelineRcpt := flag.Bool("pipeline_rcpt", false, "Accept recipients that pass local checks straight away, and send them upstream in one pipelined batch at DATA, if the upstream offers PIPELINING")
+	adminAddr := flag.String("admin_addr", "", "host:port to serve the admin API on: POST /pause (?drain=1 to also drain sessions) and POST /resume")
+	adminToken := flag.String("admin_token", "", "Bearer token the admin API requires, if set")
+	rewriteMap := flag.String("rewrite_map", "", "File of \"from -> to\" lines rewriting envelope addresses before relaying: address -> address, or @domain -> @domain")
+	maxRcpts := flag.Int("max_rcpts", 100, "Recipients accepted per message, further RCPT TO refused with 452 without asking the upstream (0 = no limit)")
+	rspamdAddr := flag.String("rspamd_addr", "", "host:port of an rspamd HTTP listener (e.g. localhost:11333), to scan each message and act on its verdict before relaying")
+	dialTimeout := flag.Duration("dial_timeout", 30*time.Second, "How long to wait for an upstream connection to be made, overriding upstream_timeout for the dial (0 = use upstream_timeout)")
+	upstreamKeepAlive := flag.Duration("upstream_keepalive", 30*time.Second, "TCP keepalive probe interval on upstream connections, to detect ones that silently drop (negative = off)")
+	archiveMode := flag.String("archive_mode", archiveModeRelay, "How messages are archived: relay (a duplicate sent to archive_relay) or rcpt (archive_relay_rcpt added as a blind envelope recipient in the upstream transaction)")
+	maxHops := flag.Int("max_hops", 30, "Received headers a message may already have; messages with more are refused with 554 as a routing loop (0 = no limit)")
+	tokenRefreshCmd := flag.String("token_refresh_cmd", "", "Shell command printing a fresh OAuth2 access token for upstream_user, run when the upstream refuses the current one, then XOAUTH2 AUTH is retried once")
+	upstreamReconnect := flag.Bool("upstream_reconnect", false, "If the upstream connection breaks at MAIL, RCPT or DATA, reconnect and replay the transaction once before giving the client 451")
+	allowNetworks := flag.String("allow_networks", "", "Comma-separated IPv4/IPv6 CIDRs clients may connect from, others refused with 554 before TLS or AUTH (default: any)")
+	debugDir := flag.String("debug_dir", "", "Directory to write each connection's server_debug transcript to, in its own file named by start time, client IP and session ID")
+	generateDSN := flag.Bool("generate_dsn", false, "Send the sender an RFC 3464 delivery status notification for recipients accepted at RCPT but then refused upstream, when the message itself was accepted")
+	upstreamProxy := flag.String("upstream_proxy", "", "Reach upstreams and relays through this proxy: socks5://[user:pass@]host:port or http://[user:pass@]host:port (CONNECT)")
+	forwardWithoutAuth := flag.Bool("forward_without_auth", false, "Let store_and_forward relay without upstream_user, as the upstream accepts relaying from the proxy's IP address")
+	usageLog := flag.String("usage_log", "", "File to append a JSON usage event (messages, bytes, recipients, duration) to as each session ends")
+	upstreamAuth := flag.String("upstream_auth", authPassthru, "Upstream AUTH handling: empty to pass client AUTH through unchanged, \"auto\" to choose the strongest mechanism the upstream offers, or one of plain, login, cram-md5, xoauth2 (password used as the access token)")
 	flag.Parse()
+	if err := loadEnv(); err != nil {
+		log.Fatal("Can't read environment: ", err)
+	}
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			log.Fatal("Can't load config: ", err)
+		}
+	}
+	logJSON, err := setLogFormat(strings.ToLower(*logFormat))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	log.Println("Incoming host:port set to", *inHostPort)
-	log.Println("Outgoing host:port set to", *outHostPort)
+	if *sink {
+		log.Println("Sink mode: messages are accepted and discarded, nothing is relayed upstream")
+	}
+	upstreams := newUpstreamSet(*outHostPort)
+	if len(upstreams.hosts) == 0 {
+		log.Fatal("No out_hostport given")
+	}
+	log.Println("Outgoing host:port set to", strings.Join(upstreams.hosts, ", "))
 
 	// Set up parameters that the backend will use
 	be := &Backend{
-		outHostPort:        *outHostPort,
-		verbose:            *verboseOpt,
-		requireUpstreamTLS: *requireUpstreamTLS,
+		upstreams:            upstreams,
+		logJSON:              logJSON,
+		verbose:              *verboseOpt,
+		requireUpstreamTLS:   *requireUpstreamTLS,
+		upstreamStartTLS:     strings.ToLower(*upstreamStartTLS),
+		upstreamInsecure:     *upstreamInsecure,
+		upstreamImplicitTLS:  *upstreamImplicitTLS,
+		upstreamCertName:     *upstreamCertName,
+		upstreamTimeout:      *upstreamTimeout,
+		dialTimeout:          *dialTimeout,
+		upstreamKeepAlive:    *upstreamKeepAlive,
+		upstreamAuth:         strings.ToLower(*upstreamAuth),
+		fixLineEndings:       *fixLineEndings,
+		verp:                 *verp,
+		splitRecipients:      *splitRecipients,
+		archiveRelay:         *archiveRelay,
+		archiveRelayRcpt:     *archiveRelayRcpt,
+		archiveRelayRequired: *archiveRelayRequired,
+		archiveMode:          strings.ToLower(*archiveMode),
+		authAlarm: &authAlarm{
+			threshold: *authAlertThreshold,
+			interval:  *authAlertInterval,
+			webhook:   *authAlertWebhook,
+		},
+	}
+	if !Contains(upstreamAuthModes, be.upstreamAuth) {
+		log.Fatal("Unknown upstream_auth mode ", *upstreamAuth)
+	}
+	if *localAuthFile != "" {
+		users, err := loadLocalUsers(*localAuthFile)
+		if err != nil {
+			log.Fatal("Can't load local_auth_file: ", err)
+		}
+		be.localUsers = users
+		if be.upstreamAuth == authPassthru {
+			be.upstreamAuth = authAuto // the proxy must see client credentials to check them
+		}
+	}
+	if *upstreamUser != "" {
+		if be.localUsers == nil {
+			log.Fatal("upstream_user needs local_auth_file, or any client could use the service account")
+		}
+		be.serviceCreds = &credentials{user: *upstreamUser, secret: *upstreamPass}
+	}
+	if *tokenRefreshCmd != "" {
+		if be.serviceCreds == nil {
+			log.Fatal("token_refresh_cmd needs upstream_user")
+		}
+		be.tokens = &tokenRefresher{cmd: *tokenRefreshCmd, token: *upstreamPass}
+		if be.tokens.token == "" {
+			if _, err := be.tokens.refresh(""); err != nil {
+				log.Fatal("Can't get upstream token: ", err)
+			}
+		}
+		be.serviceCreds.token, be.serviceCreds.refresh = true, true
+	}
+	if *upstreamCA != "" {
+		pool, err := loadCertPool(*upstreamCA)
+		if err != nil {
+			log.Fatal("Can't load upstream_ca: ", err)
+		}
+		be.upstreamCAs = pool
+	}
+	if *upstreamProxy != "" {
+		u, err := parseUpstreamProxy(*upstreamProxy)
+		if err != nil {
+			log.Fatal("Bad upstream_proxy: ", err)
+		}
+		be.upstreamProxy = u
+		log.Println("Upstream connections via proxy", u.Redacted())
+	}
+	if !Contains(startTLSModes, be.upstreamStartTLS) {
+		log.Fatal("Unknown upstream_starttls mode ", *upstreamStartTLS)
+	}
+	if be.upstreamStartTLS == startTLSNone && be.requireUpstreamTLS {
+		log.Fatal("require_upstream_tls can't be used with upstream_starttls none")
+	}
+	be.userConns.max = *maxConnsPerUser
+	if *poolSize > 0 {
+		if *xclient {
+			log.Fatal("pool_size can't be used with xclient")
+		}
+		be.pool = &connPool{max: *poolSize}
+		go be.pool.runReaper()
+	}
+	be.addReceivedHeader = *addReceivedHeader
+	be.maxHops = *maxHops
+	be.addTLSHeader = *addTLSHeader
+	be.traceEnvelopes = *traceEnvelopes
+	be.generateDSN = *generateDSN
+	be.upstreamTTL = *upstreamConnTTL
+	be.upstreamReconnect = *upstreamReconnect
+	be.certWatch.warnDays = *upstreamCertWarnDays
+	if *maxUpstreamDials > 0 {
+		be.dialLimiter = newDialLimiter(*maxUpstreamDials, *upstreamDialMaxWait)
+	}
+	be.proxyProtocol = *proxyProtocol
+	be.spf = strings.ToLower(*spfMode)
+	if !Contains(spfModes, be.spf) {
+		log.Fatal("Unknown spf mode ", *spfMode)
+	}
+	be.fcrdns = strings.ToLower(*requireFCrDNS)
+	if !Contains(fcrdnsModes, be.fcrdns) {
+		log.Fatal("Unknown require_fcrdns mode ", *requireFCrDNS)
+	}
+	if be.allowNetworks, err = parseNetworks(*allowNetworks); err != nil {
+		log.Fatal("allow_networks: ", err)
+	}
+	be.allowedCommands = parseCommandList(*allowedCommands)
+	if *suppressionTTL > 0 {
+		sl, err := loadSuppressionList(*suppressionFile, *suppressionTTL)
+		if err != nil {
+			log.Fatal("Can't load suppression_file: ", err)
+		}
+		be.suppression = sl
+	}
+	be.badCommandReply = headerSafe(*badCommandReply)
+	be.maxBadCommands = *maxBadCommands
+	routes, err := parseRoutes(*recipientRoutes)
+	if err != nil {
+		log.Fatal("Bad recipient_routes: ", err)
+	}
+	if *routesFile != "" {
+		fileRoutes, err := loadRoutes(*routesFile)
+		if err != nil {
+			log.Fatal("Can't load routes: ", err)
+		}
+		routes = append(routes, fileRoutes...)
+	}
+	be.rcptRoutes = routes
+	order, err := parseTransformOrder(*transformOrder)
+	if err != nil {
+		log.Fatal("Bad transform_order: ", err)
+	}
+	be.transformOrder = order
+	be.captureDir = *captureDir
+	be.debugDir = *debugDir
+	be.captureFilter, be.captureUsers = parseCaptureFilter(*captureFilter)
+	if *maxConnections > 0 {
+		be.connSlots = make(chan struct{}, *maxConnections)
+	}
+	if *maxConcurrentData > 0 {
+		be.dataSlots = make(chan struct{}, *maxConcurrentData)
+	}
+	reneg, ok := renegotiationPolicies[strings.ToLower(*upstreamRenegotiation)]
+	if !ok {
+		log.Fatal("Unknown upstream_tls_renegotiation policy ", *upstreamRenegotiation)
+	}
+	be.upstreamRenegotiation = reneg
+	if be.tlsMinVersion, err = parseTLSVersion(*tlsMinVersion); err != nil {
+		log.Fatal("tls_min_version: ", err)
+	}
+	if be.tlsMaxVersion, err = parseTLSVersion(*tlsMaxVersion); err != nil {
+		log.Fatal("tls_max_version: ", err)
+	}
+	if be.tlsMaxVersion != 0 && be.tlsMaxVersion < be.tlsMinVersion {
+		log.Fatal("tls_max_version is lower than tls_min_version")
+	}
+	if be.tlsCiphers, err = parseCipherSuites(*tlsCiphers); err != nil {
+		log.Fatal("tls_ciphers: ", err)
+	}
+	if *policyScript != "" {
+		p, err := loadPolicy(*policyScript)
+		if err != nil {
+			log.Fatal("Can't load policy_script: ", err)
+		}
+		be.policy = p
+	}
+	be.rspamdAddr = *rspamdAddr
+	if *archiveMap != "" {
+		m, err := loadArchiveMap(*archiveMap)
+		if err != nil {
+			log.Fatal("Can't load archive_map: ", err)
+		}
+		be.archiveMap = m
+	}
+	if !Contains(archiveModes, be.archiveMode) {
+		log.Fatal("Unknown archive_mode ", *archiveMode)
+	}
+	if be.archiveMode == archiveModeRcpt {
+		if be.archiveRelay != "" {
+			log.Fatal("archive_relay can't be used with archive_mode rcpt")
+		}
+		if be.archiveRelayRcpt == "" && len(be.archiveMap) == 0 {
+			log.Fatal("archive_mode rcpt needs archive_relay_rcpt or archive_map")
+		}
+	}
+	if *allowSenders != "" {
+		l, err := loadAddrList(*allowSenders)
+		if err != nil {
+			log.Fatal("Can't load allow_senders: ", err)
+		}
+		if len(l) > 0 {
+			be.allowSenders = l
+			log.Println("Allowed senders:", len(l), "patterns from", *allowSenders)
+		}
+	}
+	if *rewriteMap != "" {
+		r, err := loadRewriteMap(*rewriteMap)
+		if err != nil {
+			log.Fatal("Can't load rewrite_map: ", err)
+		}
+		be.rewrites = r
+		log.Println("Address rewrites:", r.size(), "entries from", *rewriteMap)
+	}
+	if *denyRcpts != "" {
+		l, err := loadAddrList(*denyRcpts)
+		if err != nil {
+			log.Fatal("Can't load deny_rcpt: ", err)
+		}
+		be.denyRcpts = l
+		log.Println("Denied recipients:", len(l), "patterns from", *denyRcpts)
+	}
+	if *headerRules != "" {
+		rules, err := loadHeaderRules(*headerRules)
+		if err != nil {
+			log.Fatal("Can't load header_rules: ", err)
+		}
+		be.headerRules = rules
+	}
+	if *dkimDomain != "" || *dkimSelector != "" || *dkimKey != "" {
+		d, err := loadDKIM(*dkimDomain, *dkimSelector, *dkimKey)
+		if err != nil {
+			log.Fatal("Can't set up DKIM signing: ", err)
+		}
+		be.dkim = d
 	}
 
 	s := smtpproxy.NewServer(be)
 	s.Addr = *inHostPort
-	s.ReadTimeout = 60 * time.Second
-	s.WriteTimeout = 60 * time.Second
+	s.ReadTimeout = *readTimeout
+	s.WriteTimeout = *writeTimeout
+	s.MaxMessageBytes = *maxSize
+	be.maxSize = int64(*maxSize)
+	be.maxRcpts = *maxRcpts
+	be.dataTimeout = *dataTimeout
+	be.sink = *sink
+	be.stripMsysAPI = *stripMsysAPIHeader
+	be.forceMessageID = *forceMessageID
+	be.allowInsecureAuth = *allowInsecureAuth
+	be.maskErrors = *maskErrors
+	if *errorMessages != "" {
+		m, err := loadErrorMessages(*errorMessages)
+		if err != nil {
+			log.Fatal("Can't load error_messages: ", err)
+		}
+		be.errorMessages = m
+	}
+	be.dataRetries = *dataRetries
+	be.xclient = *xclient
+	be.forwardHelo = *forwardHelo
+	be.pipelineRcpt = *pipelineRcpt
+	if *rateLimit > 0 {
+		be.rateLimiter = &rateLimiter{perMin: *rateLimit}
+	}
+	if *greylistOn {
+		be.greylist = &greylist{delay: *greylistDelay}
+	}
 
 	subject, err := os.Hostname() // This is the fallback in case we have no cert / privkey to give us a Subject
+	certSubject := ""
 	if err != nil {
 		log.Fatal("Can't read hostname")
 	}
 
 	// Gather TLS credentials from filesystem. Use these with the server and also set the EHLO server name
+	var serverTLS *tls.Config
 	if *certfile == "" || *privkeyfile == "" {
+		if *smtpsHostPort != "" {
+			log.Fatal("smtps_hostport needs certfile and privkeyfile")
+		}
 		log.Println("Warning: certfile or privkeyfile not specified - proxy will NOT offer STARTTLS to clients")
 	} else {
-		cer, err := tls.LoadX509KeyPair(*certfile, *privkeyfile)
+		sc, err := loadServerCert(*certfile, *privkeyfile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		config := &tls.Config{Certificates: []tls.Certificate{cer}}
-		s.TLSConfig = config
+		be.serverCert = sc
+		go sc.reloadOnSignal()
+		// Early data (0-RTT) is never accepted by Go's TLS server, which matters because SMTP commands in early data could be
+		// replayed by an attacker. Keep it that way: don't swap in a TLS stack that accepts early data without a guard.
+		serverTLS = be.applyTLSLimits(&tls.Config{GetCertificate: sc.getCertificate})
+		s.TLSConfig = serverTLS
 
-		leafCert, err := x509.ParseCertificate(cer.Certificate[0])
-		if err != nil {
-			log.Fatal(err)
+		_, certSubject = sc.current()
+		if certSubject != "" {
+			subject = certSubject
 		}
-		subject = leafCert.Subject.CommonName
 		log.Println("Gathered certificate", *certfile, "and key", *privkeyfile)
 	}
+	if s.TLSConfig != nil && !be.commandAllowed("STARTTLS") {
+		log.Println("STARTTLS is not in allowed_commands - proxy will NOT offer STARTTLS to clients")
+		s.TLSConfig = nil
+	}
 	s.Domain = subject
+	if *ehloDomain != "" {
+		s.Domain = *ehloDomain
+		be.ehloDomain = *ehloDomain
+	}
+	log.Println("Allow client AUTH before STARTTLS:", be.allowInsecureAuth)
+	log.Println("Mask failure responses to clients:", be.maskErrors, "custom messages:", len(be.errorMessages))
 	log.Println("Strictly require upstream server to support STARTTLS:", be.requireUpstreamTLS)
+	log.Println("Upstream STARTTLS:", be.upstreamStartTLS)
+	log.Println("Upstream XCLIENT:", be.xclient, "forward client EHLO name:", be.forwardHelo)
+	log.Println("Pipeline RCPT TO upstream at DATA:", be.pipelineRcpt)
+	if *upstreamCA != "" {
+		log.Println("Upstream certificates verified against CAs in", *upstreamCA)
+	}
+	if be.upstreamInsecure {
+		log.Println("Warning: upstream certificates are NOT verified (upstream_insecure)")
+	}
+	log.Println("Upstream implicit TLS (SMTPS):", be.upstreamImplicitTLS)
+	log.Println("Client read timeout:", s.ReadTimeout, "write timeout:", s.WriteTimeout, "DATA timeout:", be.dataTimeout)
+	if be.upstreamTimeout > 0 {
+		log.Println("Upstream timeout:", be.upstreamTimeout)
+	}
+	log.Println("Upstream dial timeout:", be.upstreamDialTimeout(), "TCP keepalive:", be.upstreamKeepAlive)
+	log.Println("Reconnect if upstream connection breaks mid-transaction:", be.upstreamReconnect)
+	log.Println("Delivery status notifications for recipients refused after acceptance:", be.generateDSN)
+	if be.upstreamCertName != "" {
+		log.Println("Upstream certificate expected name:", be.upstreamCertName)
+	}
 	log.Println("Proxy will advertise itself as", s.Domain)
+	be.hostname = s.Domain
 	log.Println("Backend logging:", be.verbose)
+	log.Println("Normalize DATA line endings to CRLF:", be.fixLineEndings)
+	log.Println("Add Received header:", be.addReceivedHeader, "max hops:", be.maxHops)
+	log.Println("Add X-Proxy-TLS header:", be.addTLSHeader)
+	log.Println("Add missing Message-ID header:", be.forceMessageID)
+	log.Println("PROXY protocol on client connections:", be.proxyProtocol)
+	if len(be.allowNetworks) > 0 {
+		log.Println("Clients allowed from networks:", *allowNetworks)
+	}
+	if be.fcrdns != fcrdnsOff {
+		log.Println("Client FCrDNS check:", be.fcrdns)
+	}
+	if be.spf != spfOff {
+		log.Println("Sender SPF check:", be.spf)
+	}
+	if be.connSlots != nil {
+		log.Println("Maximum client connections:", cap(be.connSlots))
+	}
+	if be.dataSlots != nil {
+		log.Println("Maximum concurrent DATA transfers:", cap(be.dataSlots))
+	}
+	if be.dialLimiter != nil {
+		log.Println("Maximum upstream dials per second:", *maxUpstreamDials, "max wait:", *upstreamDialMaxWait)
+	}
+	if be.pool != nil {
+		log.Println("Upstream connection pool size:", be.pool.max)
+	}
+	if be.userConns.max > 0 {
+		log.Println("Maximum concurrent sessions per user:", be.userConns.max)
+	}
+	log.Println("Split recipients into separate upstream transactions:", be.splitRecipients)
+	if be.verp != "" {
+		log.Println("VERP return path template:", be.verp)
+	}
+	for _, r := range be.rcptRoutes {
+		log.Println("Routing recipients in", r.domain, "to", r.hostPort)
+	}
+	if be.archiveRelay != "" {
+		log.Println("Relaying archive copies of messages to", be.archiveRelay, "required:", be.archiveRelayRequired)
+	}
+	if be.archiveMode == archiveModeRcpt {
+		log.Println("Archiving messages as an extra upstream recipient", be.archiveRelayRcpt, "required:", be.archiveRelayRequired)
+	}
+	if be.archiveRelay != "" || be.archiveMode == archiveModeRcpt {
+		for _, m := range be.archiveMap {
+			log.Println("Archiving messages from", m.domain, "to", m.rcpt)
+		}
+	}
+	log.Println("TLS versions:", tlsVersionName(be.tlsMinVersion), "to", tlsVersionName(be.tlsMaxVersion), "cipher suites:", len(be.tlsCiphers), "(0 = default)")
+	log.Println("Upstream TLS renegotiation:", *upstreamRenegotiation, "; inbound TLS renegotiation and 0-RTT early data: refused")
+	if be.suppression != nil {
+		log.Println("Suppressing hard-bounced recipients for", be.suppression.ttl, "list in", be.suppression.file, "entries:", be.suppression.size())
+	}
+	if be.allowedCommands != nil {
+		log.Println("Client commands allowed:", *allowedCommands, "(and QUIT)")
+	}
+	if be.policy != nil {
+		log.Println("Policy script:", *policyScript, "(messages are buffered, to check them before relaying)")
+	}
+	if be.rspamdAddr != "" {
+		log.Println("rspamd scanning via", be.rspamdAddr, "(messages are buffered, to scan them before relaying)")
+	}
+	if be.dataRetries > 0 {
+		log.Println("Upstream DATA retries:", be.dataRetries, "(messages are buffered, to resend them)")
+	}
+	if be.rateLimiter != nil {
+		log.Println("Rate limit per client IP:", be.rateLimiter.perMin, "messages per minute")
+	}
+	if be.greylist != nil {
+		log.Println("Greylisting, retry delay:", be.greylist.delay)
+	}
+	if be.maxSize > 0 {
+		log.Println("Maximum message size", be.maxSize, "bytes")
+	}
+	if be.maxRcpts > 0 {
+		log.Println("Maximum recipients per message", be.maxRcpts)
+	}
+	log.Println("Remove client X-MSYS-API headers:", be.stripMsysAPI)
+	if be.headerRules != nil {
+		log.Println("Header rules:", *headerRules, len(be.headerRules), "directives (messages are buffered, to apply them)")
+	}
+	if be.dkim != nil {
+		log.Println("DKIM signing as d="+be.dkim.Domain, "s="+be.dkim.Selector, "(messages are buffered, to sign them before relaying)")
+	}
+	if be.localUsers != nil {
+		log.Println("Authenticating clients locally:", len(be.localUsers), "users")
+	}
+	if be.serviceCreds != nil {
+		log.Println("Authenticating upstream as service account", be.serviceCreds.user, "token refresh:", be.tokens != nil)
+	}
+	if be.upstreamAuth != authPassthru {
+		log.Println("Proxy handles client AUTH, upstream mechanism selection:", be.upstreamAuth)
+	}
 
 	if *serverDebug != "" {
 		// Need local ref to the file, to allow Close() and Name() methods which io.Writer doesn't have
@@ -308,8 +1510,141 @@ func main() {
 		be.upstreamDebug = upstreamDbgFile
 		log.Println("Proxy writing upstream DATA to", upstreamDbgFile.Name())
 	}
+	if be.debugDir != "" {
+		if err := os.MkdirAll(be.debugDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Proxy logging each connection's SMTP commands, responses and downstream DATA to its own file in", be.debugDir)
+	}
+	if be.captureDir != "" {
+		if err := os.MkdirAll(be.captureDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Proxy capturing inbound SMTP sessions to", be.captureDir, "filter:", be.captureFilter)
+	}
+	if *usageLog != "" {
+		ul, usageFile, err := openJSONLog(*usageLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer usageFile.Close()
+		be.usageLog = ul
+		log.Println("Proxy writing session usage events to", usageFile.Name())
+	}
+	if *messageLog != "" {
+		ml, messageFile, err := openJSONLog(*messageLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer messageFile.Close()
+		be.messageLog = ml
+		log.Println("Proxy writing relayed message events to", messageFile.Name())
+	}
+	if *accessLogFile != "" {
+		al, accessFile, err := openAccessLog(*accessLogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer accessFile.Close()
+		be.accessLog = al
+		log.Println("Proxy writing access log to", accessFile.Name())
+	}
+
+	if *storeAndForward {
+		if be.serviceCreds == nil && !*forwardWithoutAuth {
+			log.Fatal("store_and_forward needs upstream_user to authenticate upstream, or forward_without_auth if the upstream accepts relaying from the proxy's IP address")
+		}
+		sp, err := openSpool(*spoolDir, *spoolMaxAge)
+		if err != nil {
+			log.Fatal(err)
+		}
+		be.storeAndForward = true
+		be.spool = sp
+		be.forwarder.workers = *forwardWorkers
+		if be.forwarder.workers < 1 {
+			be.forwarder.workers = 1
+		}
+		be.forwarder.perUpstream = *forwardMaxPerUpstream
+		users, err := parsePriorityUsers(*priorityUsers)
+		if err != nil {
+			log.Fatal("Bad priority_users: ", err)
+		}
+		be.retrySchedules, err = parseRetrySchedule(*retrySchedule)
+		if err != nil {
+			log.Fatal("Bad retry_schedule: ", err)
+		}
+		be.priorities = priorities{header: *priorityHeader, users: users, aging: *priorityAging}
+		go be.runForwarder()
+		log.Println("Store and forward via spool", *spoolDir, "max age:", *spoolMaxAge, "workers:", be.forwarder.workers, "max per upstream:", be.forwarder.perUpstream, "authenticated upstream:", be.serviceCreds != nil)
+	}
+
+	if *statsAddr != "" {
+		go be.serveStats(*statsAddr)
+		log.Println("Serving stats on", *statsAddr)
+	}
+	if *healthAddr != "" {
+		go be.serveHealth(*healthAddr)
+		log.Println("Serving health checks on", *healthAddr, "at /healthz and /readyz")
+	}
+	if *adminAddr != "" {
+		be.adminToken = *adminToken
+		go be.serveAdmin(*adminAddr)
+		paths := "/pause and /resume"
+		if be.suppression != nil {
+			paths = "/pause, /resume and /suppression"
+		}
+		log.Println("Serving admin API on", *adminAddr, "at", paths+", token required:", be.adminToken != "")
+	}
+
+	if *configDump != "" {
+		m := manifest{
+			Time:        time.Now(),
+			Flags:       flagValues(),
+			CertSubject: certSubject,
+			Domain:      s.Domain,
+			Features:    be.features(s.TLSConfig != nil),
+		}
+		if err := writeManifest(*configDump, m); err != nil {
+			log.Fatal("Can't write config_dump: ", err)
+		}
+		log.Println("Configuration manifest written to", *configDump)
+	}
 
-	if err := s.ListenAndServe(); err != nil {
+	// Each client connection gets its own Server, configured like s
+	newServer := func(b smtpproxy.Backend) *smtpproxy.Server {
+		srv := smtpproxy.NewServer(b)
+		srv.Addr = s.Addr
+		srv.Domain = be.domain()
+		srv.TLSConfig = s.TLSConfig
+		srv.ReadTimeout = s.ReadTimeout
+		srv.WriteTimeout = s.WriteTimeout
+		srv.MaxMessageBytes = s.MaxMessageBytes
+		srv.AllowInsecureAuth = be.allowInsecureAuth
+		srv.Debug = s.Debug
+		return srv
+	}
+	l, err := listenTCP(s.Addr, *reusePort, *listenBacklog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Listening on", l.Addr(), "reuse_port:", *reusePort, "listen_backlog:", *listenBacklog)
+	listeners := []net.Listener{l}
+	if *smtpsHostPort != "" {
+		sl, err := listenTCP(*smtpsHostPort, *reusePort, *listenBacklog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Listening for SMTPS on", sl.Addr())
+		listeners = append(listeners, sl)
+		go func() {
+			if err := be.serve(sl, newServer, serverTLS); err != nil && !be.isStopping() {
+				log.Fatal(err)
+			}
+		}()
+	}
+	go be.stopOnSignal(listeners...)
+	if err := be.serve(l, newServer, nil); err != nil && !be.isStopping() {
 		log.Fatal(err)
 	}
+	be.shutdown(*shutdownTimeout)
 }
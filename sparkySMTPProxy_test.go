@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestMailOutOfSequence(t *testing.T) {
+	f := newFakeUpstream(t, nil)
+	s := testSession(t, f, nil)
+
+	if code, msg, err := s.Mail(250, "MAIL", "FROM:<first@example.com>"); err != nil {
+		t.Fatalf("first MAIL: %d %s %v", code, msg, err)
+	}
+	code, _, err := s.Mail(250, "MAIL", "FROM:<second@example.com>")
+	if err == nil || code != 503 {
+		t.Errorf("second MAIL got %d %v, want 503", code, err)
+	}
+	mails := f.commands("MAIL")
+	if len(mails) != 1 || mails[0] != "MAIL FROM:<first@example.com>" {
+		t.Errorf("upstream MAIL commands %q, want only the first", mails)
+	}
+
+	// The transaction is still the first one's
+	if code, msg, err := s.Rcpt(250, "RCPT", "TO:<rcpt@example.net>"); err != nil {
+		t.Fatalf("RCPT: %d %s %v", code, msg, err)
+	}
+	if code, msg, err := sendMessage(t, s, testMessage); err != nil {
+		t.Fatalf("DATA: %d %s %v", code, msg, err)
+	}
+	if s.mailfrom != "" || s.inTransaction {
+		t.Error("transaction not reset after DATA")
+	}
+	if code, msg, err := s.Mail(250, "MAIL", "FROM:<second@example.com>"); err != nil {
+		t.Errorf("MAIL after DATA: %d %s %v", code, msg, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"blitiri.com.ar/go/spf"
+)
+
+//-----------------------------------------------------------------------------
+// SPF check on the MAIL FROM domain, against the connecting client's IP
+//
+// In soft mode the result is recorded in a Received-SPF header (RFC 7208 section 9.1) on the relayed message. In
+// enforce mode a hard fail is also refused at MAIL FROM. Null senders (bounces) aren't checked.
+//-----------------------------------------------------------------------------
+
+// SPF modes
+const (
+	spfOff     = "off"
+	spfSoft    = "soft"    // Add a Received-SPF header only
+	spfEnforce = "enforce" // ... and reject senders that fail
+)
+
+var spfModes = []string{spfOff, spfSoft, spfEnforce}
+
+const spfRejectCode = 550
+const spfRejectMsg = "5.7.23 SPF validation failed"
+
+// checkSPF checks the sender against the client's IP, recording the result for the Received-SPF header. Returns a
+// non-zero code if the sender should be refused.
+func (s *Session) checkSPF(sender string) (int, string, error) {
+	s.spfResult = ""
+	if s.bkd.spf == spfOff || sender == "" {
+		return 0, "", nil
+	}
+	ip := net.ParseIP(remoteHost(s.remoteAddr))
+	if ip == nil {
+		return 0, "", nil
+	}
+	result, err := spf.CheckHostWithSender(ip, "", sender)
+	if err != nil {
+		s.logger("\tSPF", result, "for", sender, "from", ip, "error:", err)
+	} else {
+		s.logger("\tSPF", result, "for", sender, "from", ip)
+	}
+	s.spfResult = result
+	if result == spf.Fail && s.bkd.spf == spfEnforce {
+		return spfRejectCode, spfRejectMsg, errors.New(spfRejectMsg)
+	}
+	return 0, "", nil
+}
+
+// spfHeader records the SPF result for the current transaction, if it was checked
+func (s *Session) spfHeader() string {
+	if s.spfResult == "" {
+		return ""
+	}
+	return fmt.Sprintf("Received-SPF: %s (%s: domain of %s) client-ip=%s; envelope-from=%s;\r\n",
+		s.spfResult, s.bkd.domain(), headerSafe(s.mailfrom), remoteHost(s.remoteAddr), headerSafe(s.mailfrom))
+}
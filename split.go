@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// Recipient splitting
+//
+// With split_recipients, MAIL FROM and RCPT TO are accepted locally and the message is buffered. At the end of DATA it
+// is relayed once per recipient, each in its own upstream transaction, so each can have its own MAIL FROM (e.g. VERP)
+// and its own outcome. The client gets a single response:
+//   - all recipients relayed: 250
+//   - none relayed: the last upstream failure, so the client retries (4xx) or bounces (5xx) the whole message
+//   - some relayed: 250, with the failures logged. Reporting 4xx here would duplicate mail to those that succeeded.
+//-----------------------------------------------------------------------------
+
+// bufferCloser collects message DATA in memory
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+// splitting tells whether this session buffers messages and relays them one transaction per recipient
+func (s *Session) splitting() bool {
+	return s.bkd.splitRecipients
+}
+
+// holding tells whether MAIL FROM and RCPT TO are accepted locally, rather than on the session's upstream
+func (s *Session) holding() bool {
+	return s.splitting() || s.bkd.storeAndForward || s.bkd.sink
+}
+
+// buffering tells whether the whole message is collected before upstream DATA is issued
+func (s *Session) buffering() bool {
+	return s.holding() || s.routing() || (s.archiving() && s.bkd.archiveRelayRequired) || s.bkd.policy != nil || s.bkd.rspamdAddr != "" || s.bkd.dkim != nil || s.bkd.headerRules != nil || s.bkd.dataRetries > 0 || s.bkd.forceMessageID
+}
+
+// splitData relays the buffered message to each of rcpts separately, returning the aggregated response
+func (s *Session) splitData(rcpts []string, msg []byte) (int, string, error) {
+	var (
+		relayed  int
+		lastCode int
+		lastMsg  string
+		lastErr  error
+	)
+	for _, rcpt := range rcpts {
+		from := s.mailfrom
+		if s.bkd.verp != "" && from != "" {
+			from = verpAddress(s.bkd.verp, s.mailfrom, rcpt)
+		}
+		code, m, err := s.transact(from, s.mailParams, []string{rcpt}, msg)
+		if err != nil {
+			s.logger("\tRecipient", rcpt, "failed:", code, m)
+			s.noteUndelivered([]string{rcpt}, code, m, err)
+			lastCode, lastMsg, lastErr = code, m, err
+			continue
+		}
+		s.noteQueueID(m)
+		relayed++
+	}
+	switch {
+	case relayed == len(rcpts):
+		return 250, s.withQueueIDs(fmt.Sprintf("2.0.0 Ok: relayed to %d recipients", relayed)), nil
+	case relayed == 0:
+		return lastCode, lastMsg, lastErr
+	default:
+		return 250, s.withQueueIDs(fmt.Sprintf("2.0.0 Ok: relayed to %d of %d recipients", relayed, len(rcpts))), nil
+	}
+}
+
+// transact runs a complete mail transaction upstream for the given envelope and message
+func (s *Session) transact(from, params string, rcpts []string, msg []byte) (int, string, error) {
+	if code, m, err := s.Passthru(250, "MAIL", "FROM:<"+from+">"+params); err != nil {
+		return code, m, err
+	}
+	accepted, code, m, err := s.sendRcpts(rcpts)
+	if len(accepted) == 0 {
+		s.Passthru(250, "RSET", "")
+		return code, m, err
+	}
+	if code, m, err := s.addArchiveRcpt(); code != 0 {
+		s.Passthru(250, "RSET", "")
+		return code, m, err
+	}
+	return s.sendData(s.upstream, msg)
+}
+
+// sendData issues DATA on upstream client c and sends msg, returning the final response
+func (s *Session) sendData(c *smtpproxy.Client, msg []byte) (int, string, error) {
+	s.logger(cmdTwiddle(s), "DATA")
+	w, code, m, err := c.Data()
+	if err != nil {
+		s.logger(respTwiddle(s), "DATA error", err)
+		if code == 0 && upstreamLost(err) {
+			code, m = upstreamLostCode, upstreamLostMsg
+		}
+		return code, m, err
+	}
+	var w2 io.Writer = w
+	if s.bkd.upstreamDebug != nil {
+		w2 = io.MultiWriter(w, s.bkd.upstreamDebug)
+	}
+	if _, err := smtpproxy.MailCopy(w2, bytes.NewReader(msg)); err != nil {
+		s.logger(respTwiddle(s), "DATA io.Copy error", err)
+		w.Close()
+		return 451, "4.4.2 Error relaying message", errors.New("DATA io.Copy error")
+	}
+	err = w.Close()
+	code, m = c.DataResponseCode, c.DataResponseMsg
+	if code == 0 && upstreamLost(err) {
+		code, m = upstreamLostCode, upstreamLostMsg
+	}
+	s.logger(respTwiddle(s), code, m)
+	return code, m, err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func splitSession(t *testing.T, f *fakeUpstream, rcpts ...string) *Session {
+	t.Helper()
+	s := testSession(t, f, &Backend{splitRecipients: true})
+	if code, msg, err := s.Mail(250, "MAIL", "FROM:<sender@example.com>"); err != nil {
+		t.Fatalf("MAIL: %d %s %v", code, msg, err)
+	}
+	for _, r := range rcpts {
+		if code, msg, err := s.Rcpt(250, "RCPT", "TO:<"+r+">"); err != nil {
+			t.Fatalf("RCPT %s: %d %s %v", r, code, msg, err)
+		}
+	}
+	return s
+}
+
+func TestSplitDataPartialFailure(t *testing.T) {
+	f := newFakeUpstream(t, nil)
+	f.rejectRcpt("bad@example.net", 550)
+	s := splitSession(t, f, "one@example.net", "bad@example.net", "two@example.net")
+
+	code, msg, err := sendMessage(t, s, testMessage)
+	if err != nil || code != 250 {
+		t.Fatalf("got %d %s %v, want 250", code, msg, err)
+	}
+	if !strings.Contains(msg, "relayed to 2 of 3 recipients") {
+		t.Errorf("response %q doesn't report 2 of 3 relayed", msg)
+	}
+	if !strings.Contains(msg, "upstream queued as Q1 Q2") {
+		t.Errorf("response %q doesn't give the upstream queue IDs", msg)
+	}
+	if n := len(f.messages()); n != 2 {
+		t.Errorf("upstream received %d messages, want 2", n)
+	}
+	// Each recipient had its own transaction, and the refused one was reset
+	if n := len(f.commands("MAIL")); n != 3 {
+		t.Errorf("upstream saw %d MAIL commands, want 3", n)
+	}
+	if n := len(f.commands("RSET")); n != 1 {
+		t.Errorf("upstream saw %d RSET commands, want 1", n)
+	}
+}
+
+func TestSplitDataAllFail(t *testing.T) {
+	f := newFakeUpstream(t, nil)
+	f.reply = func(line string) (int, string) {
+		if strings.HasPrefix(line, "RCPT") {
+			return 451, "4.3.0 Try again later"
+		}
+		return 0, ""
+	}
+	s := splitSession(t, f, "one@example.net", "two@example.net")
+
+	code, msg, err := sendMessage(t, s, testMessage)
+	if err == nil || code != 451 {
+		t.Fatalf("got %d %s %v, want the upstream's 451", code, msg, err)
+	}
+	if n := len(f.messages()); n != 0 {
+		t.Errorf("upstream received %d messages, want none", n)
+	}
+}
+
+func TestSplitDataAllRelayed(t *testing.T) {
+	f := newFakeUpstream(t, nil)
+	s := splitSession(t, f, "one@example.net", "two@example.net")
+
+	code, msg, err := sendMessage(t, s, testMessage)
+	if err != nil || code != 250 || !strings.Contains(msg, "relayed to 2 recipients") {
+		t.Fatalf("got %d %s %v, want 250 relayed to 2 recipients", code, msg, err)
+	}
+	rcpts := f.commands("RCPT")
+	if len(rcpts) != 2 || rcpts[0] != "RCPT TO:<one@example.net>" || rcpts[1] != "RCPT TO:<two@example.net>" {
+		t.Errorf("upstream RCPT commands %q, want one per transaction", rcpts)
+	}
+}
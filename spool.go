@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Spool: messages held on disk until they can be relayed
+//
+// Each message is two files in the spool directory: <id>.eml holds the message, and <id>.json its envelope and
+// delivery state. The envelope is written last, via a rename, so a message is only in the spool once both are complete.
+//-----------------------------------------------------------------------------
+
+const (
+	spoolMsgExt = ".eml"
+	spoolEnvExt = ".json"
+)
+
+// spoolEnvelope is a spooled message's envelope and delivery state
+type spoolEnvelope struct {
+	ID            string            `json:"id"`
+	MailFrom      string            `json:"mail_from"`
+	MailParams    string            `json:"mail_params,omitempty"`
+	RcptTo        []string          `json:"rcpt_to"`               // Recipients not yet delivered
+	RcptParams    map[string]string `json:"rcpt_params,omitempty"` // ESMTP parameters by recipient, e.g. DSN NOTIFY
+	User          string            `json:"user,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Priority      int               `json:"priority"`
+	Received      time.Time         `json:"received"`
+	Attempts      int               `json:"attempts"`
+	NextAttempt   time.Time         `json:"next_attempt"`
+	LastCode      int               `json:"last_code,omitempty"`
+	LastError     string            `json:"last_error,omitempty"`
+}
+
+type spool struct {
+	dir    string
+	maxAge time.Duration // Give up on messages older than this, bouncing them
+	wake   chan struct{} // Signalled when a message is added
+}
+
+// openSpool creates the spool directory if need be
+func openSpool(dir string, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &spool{dir: dir, maxAge: maxAge, wake: make(chan struct{}, 1)}, nil
+}
+
+func (sp *spool) path(id, ext string) string {
+	return filepath.Join(sp.dir, id+ext)
+}
+
+// put adds a message to the spool
+func (sp *spool) put(env *spoolEnvelope, msg []byte) error {
+	if err := writeFileSync(sp.path(env.ID, spoolMsgExt), msg); err != nil {
+		return err
+	}
+	if err := sp.save(env); err != nil {
+		os.Remove(sp.path(env.ID, spoolMsgExt))
+		return err
+	}
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// save writes a spooled message's envelope, replacing any previous version
+func (sp *spool) save(env *spoolEnvelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	tmp := sp.path(env.ID, spoolEnvExt+".tmp")
+	if err := writeFileSync(tmp, b); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sp.path(env.ID, spoolEnvExt))
+}
+
+// remove deletes a message from the spool
+func (sp *spool) remove(id string) error {
+	if err := os.Remove(sp.path(id, spoolEnvExt)); err != nil {
+		return err
+	}
+	return os.Remove(sp.path(id, spoolMsgExt))
+}
+
+// message returns a spooled message's content
+func (sp *spool) message(id string) ([]byte, error) {
+	return os.ReadFile(sp.path(id, spoolMsgExt))
+}
+
+// load reads a spooled message's envelope
+func (sp *spool) load(id string) (*spoolEnvelope, error) {
+	b, err := os.ReadFile(sp.path(id, spoolEnvExt))
+	if err != nil {
+		return nil, err
+	}
+	var env spoolEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// list returns the envelopes of all spooled messages. Unreadable envelopes are skipped.
+func (sp *spool) list() ([]*spoolEnvelope, error) {
+	entries, err := os.ReadDir(sp.dir)
+	if err != nil {
+		return nil, err
+	}
+	var envs []*spoolEnvelope
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolEnvExt) {
+			continue
+		}
+		env, err := sp.load(strings.TrimSuffix(e.Name(), spoolEnvExt))
+		if err != nil {
+			continue
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// writeFileSync writes a file and flushes it to disk, so it survives a crash once we've said we have it
+func writeFileSync(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
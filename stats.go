@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Stats endpoint, reporting the proxy's current state as JSON
+//-----------------------------------------------------------------------------
+
+type proxyStats struct {
+	ActiveConnections int64 `json:"active_connections"` // Client connections open
+	MaxConnections    int   `json:"max_connections,omitempty"`
+
+	ActiveData int64 `json:"active_data"` // Sessions currently streaming DATA
+	MaxData    int   `json:"max_concurrent_data,omitempty"`
+
+	ArchiveFailures int64 `json:"archive_failures"`
+
+	MessagesRelayed int64 `json:"messages_relayed"` // Since startup
+	BytesRelayed    int64 `json:"bytes_relayed"`
+
+	Paused bool `json:"paused,omitempty"` // New connections refused, over the admin API
+
+	UserConnections map[string]int `json:"user_connections"` // Active sessions per authenticated user
+
+	SpoolDepth      int `json:"spool_depth,omitempty"`       // Messages awaiting store-and-forward relay
+	ForwardInFlight int `json:"forward_in_flight,omitempty"` // Being relayed, or due and waiting for a worker
+
+	SuppressedRecipients int `json:"suppressed_recipients,omitempty"`
+	PooledConnections    int `json:"pooled_connections,omitempty"` // Idle upstream connections
+
+	UpstreamCertHost   string     `json:"upstream_cert_host,omitempty"` // Upstream whose certificate expires soonest
+	UpstreamCertExpiry *time.Time `json:"upstream_cert_expiry,omitempty"`
+}
+
+func (bkd *Backend) stats() proxyStats {
+	st := proxyStats{
+		ActiveConnections: atomic.LoadInt64(&bkd.activeConns),
+		MaxConnections:    cap(bkd.connSlots),
+
+		ActiveData: atomic.LoadInt64(&bkd.activeData),
+		MaxData:    cap(bkd.dataSlots),
+
+		ArchiveFailures: atomic.LoadInt64(&bkd.archiveFailures),
+
+		MessagesRelayed: atomic.LoadInt64(&bkd.relayedMessages),
+		BytesRelayed:    atomic.LoadInt64(&bkd.relayedBytes),
+
+		Paused: bkd.isPaused(),
+
+		UserConnections: bkd.userConns.snapshot(),
+	}
+	st.SuppressedRecipients = bkd.suppression.size()
+	st.PooledConnections = bkd.pool.size()
+	if bkd.storeAndForward {
+		st.SpoolDepth, st.ForwardInFlight = bkd.forwarder.snapshot()
+	}
+	if host, expiry := bkd.certWatch.nearest(); host != "" {
+		st.UpstreamCertHost, st.UpstreamCertExpiry = host, &expiry
+	}
+	return st
+}
+
+// countRelayed adds a message of size bytes to the running totals
+func (bkd *Backend) countRelayed(size int64) {
+	atomic.AddInt64(&bkd.relayedMessages, 1)
+	atomic.AddInt64(&bkd.relayedBytes, size)
+}
+
+func (bkd *Backend) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(bkd.stats()); err != nil {
+		log.Println("Stats error", err)
+	}
+}
+
+// serveStats runs the stats HTTP listener on addr
+func (bkd *Backend) serveStats(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", bkd.statsHandler)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+//-----------------------------------------------------------------------------
+// Concurrent DATA limit
+//-----------------------------------------------------------------------------
+
+const dataBusyCode = 451
+const dataBusyMsg = "4.3.0 Too busy, try again"
+
+// acquireDataSlot claims one of the limited concurrent DATA slots, without waiting. Returns false if all are in use.
+func (s *Session) acquireDataSlot() bool {
+	if s.bkd.dataSlots != nil {
+		select {
+		case s.bkd.dataSlots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	s.inData = true
+	atomic.AddInt64(&s.bkd.activeData, 1)
+	return true
+}
+
+// releaseDataSlot frees the session's DATA slot, if it holds one
+func (s *Session) releaseDataSlot() {
+	if !s.inData {
+		return
+	}
+	s.inData = false
+	atomic.AddInt64(&s.bkd.activeData, -1)
+	if s.bkd.dataSlots != nil {
+		<-s.bkd.dataSlots
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Suppression list
+//
+// Recipients an upstream says don't exist (a 550, 551 or 553 classed as user_unknown by classifyBounce), whether
+// refused at RCPT or by the store-and-forward relay, are suppressed for suppression_ttl: RCPT TO them is refused without asking the upstream, protecting the sender's
+// reputation. The list is kept in suppression_file, so it survives restarts. It can be listed and cleared on the
+// admin API (admin_addr, see admin.go) at /suppression: GET lists it; DELETE clears it, or just ?rcpt=address. Only
+// its size is reported in stats.
+//-----------------------------------------------------------------------------
+
+const suppressedCode = 550
+const suppressedMsg = "5.1.1 Recipient address suppressed after a previous hard bounce"
+
+// suppressible tells whether an upstream's refusal of a recipient means the address should not be tried again
+func suppressible(code int, msg string) bool {
+	switch code {
+	case 550, 551, 553:
+		return classifyBounce(code, msg) == bounceUserUnknown
+	}
+	return false
+}
+
+type suppressionList struct {
+	ttl  time.Duration
+	file string // Where the list is kept, if anywhere
+	mu   sync.Mutex
+	m    map[string]time.Time // Expiry, by lower-cased address
+}
+
+// loadSuppressionList reads the list from file, if it exists
+func loadSuppressionList(file string, ttl time.Duration) (*suppressionList, error) {
+	l := &suppressionList{ttl: ttl, file: file, m: make(map[string]time.Time)}
+	if file == "" {
+		return l, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &l.m); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// add suppresses rcpt, if the upstream's refusal calls for it
+func (l *suppressionList) add(rcpt string, code int, msg string) {
+	if l == nil || !suppressible(code, msg) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.m[strings.ToLower(rcpt)] = time.Now().Add(l.ttl)
+	l.saveLocked()
+}
+
+// suppressRefused suppresses a recipient refused at RCPT, if the refusal calls for it. Only real upstream replies
+// count, never those the proxy makes up itself, e.g. for a blocked session or a lost upstream connection.
+func (s *Session) suppressRefused(rcpt string, code int, msg string) {
+	if s.blockUpstream || s.bkd.sink || msg == upstreamLostMsg {
+		return
+	}
+	s.bkd.suppression.add(rcpt, code, msg)
+}
+
+// suppressed tells whether rcpt is currently suppressed
+func (l *suppressionList) suppressed(rcpt string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := strings.ToLower(rcpt)
+	expiry, ok := l.m[key]
+	if ok && time.Now().After(expiry) {
+		delete(l.m, key)
+		return false
+	}
+	return ok
+}
+
+// clear removes rcpt from the list, or every entry if rcpt is empty. Returns the number removed.
+func (l *suppressionList) clear(rcpt string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.m)
+	if rcpt == "" {
+		l.m = make(map[string]time.Time)
+	} else {
+		delete(l.m, strings.ToLower(rcpt))
+	}
+	n -= len(l.m)
+	l.saveLocked()
+	return n
+}
+
+// snapshot returns the unexpired entries
+func (l *suppressionList) snapshot() map[string]time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	m := make(map[string]time.Time)
+	for k, v := range l.m {
+		if v.After(now) {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func (l *suppressionList) size() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.snapshot())
+}
+
+// saveLocked writes the list to its file, dropping expired entries. Call with l.mu held.
+func (l *suppressionList) saveLocked() {
+	if l.file == "" {
+		return
+	}
+	now := time.Now()
+	for k, v := range l.m {
+		if now.After(v) {
+			delete(l.m, k)
+		}
+	}
+	b, err := json.Marshal(l.m)
+	if err == nil {
+		tmp := l.file + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, l.file)
+		}
+	}
+	if err != nil {
+		log.Println("Suppression list save error", err)
+	}
+}
+
+func (bkd *Backend) suppressionHandler(w http.ResponseWriter, r *http.Request) {
+	if !bkd.adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(bkd.suppression.snapshot()); err != nil {
+			log.Println("Suppression list error", err)
+		}
+	case http.MethodDelete:
+		n := bkd.suppression.clear(r.URL.Query().Get("rcpt"))
+		log.Println("Suppression list: cleared", n, "entries")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"cleared": n})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
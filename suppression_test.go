@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuppressionOnlyUnknownUsers(t *testing.T) {
+	cases := []struct {
+		name     string
+		code     int
+		msg      string
+		block    bool // session blocked by the proxy, so the upstream is never asked
+		suppress bool
+	}{
+		{"user unknown", 550, "5.1.1 <rcpt@example.net>: Recipient address rejected: User unknown", false, true},
+		{"RCPT before MAIL", 503, "5.5.1 Error: need MAIL command", false, false},
+		{"policy", 554, "5.7.1 <rcpt@example.net>: Recipient address rejected: Access denied", false, false},
+		{"other permanent failure", 554, "5.0.0 Transaction failed", false, false},
+		{"temporary", 450, "4.1.1 <rcpt@example.net>: Recipient address rejected: User unknown", false, false},
+		{"blocked session", 0, "", true, false},
+	}
+	for _, tc := range cases {
+		f := newFakeUpstream(t, nil)
+		f.reply = func(line string) (int, string) {
+			if strings.HasPrefix(line, "RCPT") && tc.code != 0 {
+				return tc.code, tc.msg
+			}
+			return 0, ""
+		}
+		list, _ := loadSuppressionList("", time.Hour)
+		s := testSession(t, f, &Backend{suppression: list})
+		s.blockUpstream = tc.block
+		if _, _, err := s.Rcpt(250, "RCPT", "TO:<rcpt@example.net>"); err == nil {
+			t.Fatalf("%s: RCPT accepted", tc.name)
+		}
+		if got := list.suppressed("rcpt@example.net"); got != tc.suppress {
+			t.Errorf("%s: suppressed = %v, want %v", tc.name, got, tc.suppress)
+		}
+		if !tc.suppress && list.size() != 0 {
+			t.Errorf("%s: suppression list has %d entries, want none", tc.name, list.size())
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// TLS protocol versions and cipher suites, for both the inbound listener and upstream connections
+//
+// tls_min_version defaults to 1.2. tls_ciphers restricts the TLS 1.0-1.2 cipher suites, by Go's names for them (e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256); TLS 1.3 suites aren't configurable in Go.
+//-----------------------------------------------------------------------------
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion returns the version named, e.g. "1.2". Empty gives 0, for Go's default.
+func parseTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(v), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", v)
+	}
+	return version, nil
+}
+
+// parseCipherSuites returns the IDs of a comma-separated list of cipher suite names. Empty gives nil, for Go's default.
+func parseCipherSuites(list string) ([]uint16, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[c.Name] = c.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// applyTLSLimits sets the configured versions and cipher suites on c
+func (bkd *Backend) applyTLSLimits(c *tls.Config) *tls.Config {
+	c.MinVersion = bkd.tlsMinVersion
+	c.MaxVersion = bkd.tlsMaxVersion
+	c.CipherSuites = bkd.tlsCiphers
+	return c
+}
+
+// tlsVersionName names a tls_min_version or tls_max_version setting for logging
+func tlsVersionName(v uint16) string {
+	if v == 0 {
+		return "default"
+	}
+	return tls.VersionName(v)
+}
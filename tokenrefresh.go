@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// OAuth2 token refresh
+//
+// With token_refresh_cmd, upstream_user authenticates upstream with XOAUTH2, using an access token printed on stdout
+// by the command (run with sh -c, so it can be e.g. a curl to a token endpoint). The command is run at startup if
+// upstream_pass gives no initial token, and again whenever the upstream refuses the token, after which AUTH is tried
+// once more. Sessions share the token, so a refresh made by one session is used by the rest, and concurrent refusals
+// of the same token only run the command once. Tokens are never logged.
+//-----------------------------------------------------------------------------
+
+const tokenRefreshTimeout = 30 * time.Second
+
+type tokenRefresher struct {
+	cmd   string
+	mu    sync.Mutex
+	token string
+}
+
+// current returns the token to authenticate with
+func (t *tokenRefresher) current() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.token
+}
+
+// refresh runs the command for a new token, to replace stale, the token the upstream refused. If another session has
+// already replaced it, that token is returned without running the command again.
+func (t *tokenRefresher) refresh(stale string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != stale && t.token != "" {
+		return t.token, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRefreshTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "sh", "-c", t.cmd).Output()
+	if err != nil {
+		return "", fmt.Errorf("token_refresh_cmd: %v", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" || strings.ContainsAny(token, "\r\n") {
+		return "", errors.New("token_refresh_cmd: did not print a single-line token")
+	}
+	t.token = token
+	log.Println("Upstream OAuth2 token refreshed")
+	return token, nil
+}
+
+// refreshedLogin retries a refused XOAUTH2 AUTH once with a fresh token, if the credentials are the service
+// account's and token_refresh_cmd is set. Returns the outcome, and the credentials used.
+func (s *Session) refreshedLogin(mech string, cr credentials, code int, msg string, err error) (credentials, int, string, error) {
+	if err == nil || !cr.refresh || mech != "XOAUTH2" || s.bkd.tokens == nil {
+		return cr, code, msg, err
+	}
+	token, rerr := s.bkd.tokens.refresh(cr.secret)
+	if rerr != nil {
+		log.Println("Upstream token refresh failed:", rerr)
+		return cr, code, msg, err
+	}
+	cr.secret = token
+	s.logger("\tUpstream refused token, retrying AUTH with a refreshed one")
+	s.logger(cmdTwiddle(s), "AUTH", mech, "(credentials redacted)")
+	code, msg, err = saslAuth(s.upstream, mech, cr)
+	s.logger(respTwiddle(s), code, msg)
+	return cr, code, msg, err
+}
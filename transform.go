@@ -0,0 +1,57 @@
+package main
+
+import "io"
+
+//-----------------------------------------------------------------------------
+// DATA stream transformations
+//-----------------------------------------------------------------------------
+
+// crlfReader normalizes bare LF and bare CR line endings to CRLF, leaving existing CRLF untouched
+type crlfReader struct {
+	r      io.Reader
+	buf    []byte
+	out    []byte // normalized bytes not yet returned to the caller
+	prevCR bool   // last byte read was CR, and we don't yet know if LF follows
+	err    error  // deferred error from the underlying reader
+}
+
+func newCRLFReader(r io.Reader) *crlfReader {
+	return &crlfReader{r: r, buf: make([]byte, 32*1024)}
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 && c.err == nil {
+		n, err := c.r.Read(c.buf)
+		for _, b := range c.buf[:n] {
+			if c.prevCR {
+				c.prevCR = false
+				c.out = append(c.out, '\r', '\n')
+				if b == '\n' {
+					continue // was already CRLF
+				}
+			}
+			switch b {
+			case '\r':
+				c.prevCR = true
+			case '\n':
+				c.out = append(c.out, '\r', '\n')
+			default:
+				c.out = append(c.out, b)
+			}
+		}
+		if err != nil {
+			if c.prevCR {
+				c.prevCR = false
+				c.out = append(c.out, '\r', '\n')
+			}
+			c.err = err
+		}
+	}
+	n := copy(p, c.out)
+	if n < len(c.out) {
+		c.out = c.out[n:]
+		return n, nil
+	}
+	c.out = c.out[:0] // fully consumed, reuse the buffer
+	return n, c.err
+}
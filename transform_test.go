@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader returns each chunk from a separate Read
+type chunkReader struct {
+	chunks []string
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	if c.chunks[0] = c.chunks[0][n:]; c.chunks[0] == "" {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestCRLFReader(t *testing.T) {
+	cases := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"LF", []string{"a\nb\n"}, "a\r\nb\r\n"},
+		{"bare CR", []string{"a\rb\r"}, "a\r\nb\r\n"},
+		{"CRLF", []string{"a\r\nb\r\n"}, "a\r\nb\r\n"},
+		{"mixed", []string{"a\nb\rc\r\nd\n\re"}, "a\r\nb\r\nc\r\nd\r\n\r\ne"},
+		{"CR at buffer boundary, then LF", []string{"a\r", "\nb"}, "a\r\nb"},
+		{"CR at buffer boundary, then text", []string{"a\r", "b"}, "a\r\nb"},
+		{"CR at EOF", []string{"a\r"}, "a\r\n"},
+		{"CR CR", []string{"a\r\rb"}, "a\r\n\r\nb"},
+		{"no line endings", []string{"abc"}, "abc"},
+		{"empty", nil, ""},
+	}
+	for _, tc := range cases {
+		got, err := io.ReadAll(newCRLFReader(&chunkReader{chunks: append([]string(nil), tc.chunks...)}))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCRLFReaderSmallReads(t *testing.T) {
+	in := "one\rtwo\nthree\r\nfour\r"
+	want := "one\r\ntwo\r\nthree\r\nfour\r\n"
+	r := newCRLFReader(&chunkReader{chunks: []string{in}})
+	got, err := io.ReadAll(iotest.OneByteReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// Upstream connection management
+//-----------------------------------------------------------------------------
+
+// upstreamTLSConfig returns the TLS settings for connecting to the named upstream host
+func (bkd *Backend) upstreamTLSConfig(host string) *tls.Config {
+	return bkd.applyTLSLimits(&tls.Config{
+		InsecureSkipVerify: bkd.upstreamInsecure,
+		RootCAs:            bkd.upstreamCAs,
+		ServerName:         host,
+		Renegotiation:      bkd.upstreamRenegotiation,
+	})
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return pool, nil
+}
+
+// Upstream STARTTLS modes, for when a client asks for STARTTLS
+const (
+	startTLSRequired      = "required"      // Upstream STARTTLS too, failing if the upstream can't
+	startTLSOpportunistic = "opportunistic" // Upstream STARTTLS if the upstream offers it, otherwise stay plaintext
+	startTLSNone          = "none"          // Never STARTTLS upstream, e.g. for a plaintext relay on a trusted network
+)
+
+var startTLSModes = []string{startTLSRequired, startTLSOpportunistic, startTLSNone}
+
+// wantStartTLS tells whether to secure the upstream connection to hostPort, offering caps, with STARTTLS, per
+// upstream_starttls. Otherwise the client's STARTTLS is terminated by the proxy alone. Unix socket upstreams are local,
+// so aren't secured unless require_upstream_tls forces it.
+func (bkd *Backend) wantStartTLS(hostPort string, caps []string) bool {
+	if isUnixSocket(hostPort) && !bkd.requireUpstreamTLS {
+		return false
+	}
+	switch bkd.upstreamStartTLS {
+	case startTLSNone:
+		return false
+	case startTLSOpportunistic:
+		ok, _ := capability(caps, "STARTTLS")
+		return ok
+	}
+	return true
+}
+
+// An out_hostport entry of the form unix:/path/to/socket is a Unix domain socket
+const unixSocketPrefix = "unix:"
+
+func isUnixSocket(hostPort string) bool {
+	return strings.HasPrefix(hostPort, unixSocketPrefix)
+}
+
+// upstreamName returns the host name of an upstream host:port, or localhost for a Unix socket
+func upstreamName(hostPort string) string {
+	if isUnixSocket(hostPort) {
+		return "localhost"
+	}
+	host, _, _ := net.SplitHostPort(hostPort)
+	return host
+}
+
+// A host is skipped for upstreamSkipTime after upstreamFailLimit consecutive failed dials
+const upstreamFailLimit = 3
+const upstreamSkipTime = 30 * time.Second
+
+// upstreamSet holds the out_hostport hosts, used round-robin
+type upstreamSet struct {
+	hosts     []string
+	mu        sync.Mutex
+	next      int
+	fails     map[string]int
+	skipUntil map[string]time.Time
+}
+
+func newUpstreamSet(list string) *upstreamSet {
+	u := &upstreamSet{fails: make(map[string]int), skipUntil: make(map[string]time.Time)}
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			u.hosts = append(u.hosts, h)
+		}
+	}
+	return u
+}
+
+// order returns the hosts in the order to try them: round-robin, with hosts being skipped moved to the end
+func (u *upstreamSet) order() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var ok, skipped []string
+	now := time.Now()
+	for i := range u.hosts {
+		h := u.hosts[(u.next+i)%len(u.hosts)]
+		if now.Before(u.skipUntil[h]) {
+			skipped = append(skipped, h)
+		} else {
+			ok = append(ok, h)
+		}
+	}
+	u.next = (u.next + 1) % len(u.hosts)
+	return append(ok, skipped...)
+}
+
+// result records the outcome of dialling host
+func (u *upstreamSet) result(host string, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err == nil {
+		u.fails[host] = 0
+		return
+	}
+	u.fails[host]++
+	if u.fails[host] >= upstreamFailLimit {
+		if !time.Now().Before(u.skipUntil[host]) {
+			log.Println("Upstream", host, "failed", u.fails[host], "times in a row, skipping it for", upstreamSkipTime)
+		}
+		u.skipUntil[host] = time.Now().Add(upstreamSkipTime)
+	}
+}
+
+// dialUpstream connects to one of the out_hostport upstream servers, failing over to the next if need be. Returns
+// the connection and the host:port it's to, or the last error if none could be reached. With upstream_implicit_tls,
+// TLS is negotiated as soon as the TCP connection is made (SMTPS), and the certificate is verified just as for STARTTLS.
+func (bkd *Backend) dialUpstream() (*smtpproxy.Client, string, error) {
+	var err error
+	for _, hostPort := range bkd.upstreams.order() {
+		var c *smtpproxy.Client
+		c, err = bkd.dialUpstreamHost(hostPort)
+		bkd.upstreams.result(hostPort, err)
+		if err == nil {
+			return c, hostPort, nil
+		}
+		bkd.logger("\tUpstream", hostPort, "dial error:", err)
+	}
+	return nil, "", err
+}
+
+func (bkd *Backend) dialUpstreamHost(hostPort string) (*smtpproxy.Client, error) {
+	host := upstreamName(hostPort)
+	conn, err := bkd.dialConn(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if !bkd.upstreamImplicitTLS {
+		c, err := smtpproxy.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+		}
+		return c, err
+	}
+	tlsConn := tls.Client(conn, bkd.outTLSConfig(hostPort))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := smtpproxy.NewClient(tlsConn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	bkd.noteUpstreamCert(host, c)
+	return c, nil
+}
+
+// upstreamDialTimeout returns how long an upstream dial may take: dial_timeout, else upstream_timeout
+func (bkd *Backend) upstreamDialTimeout() time.Duration {
+	if bkd.dialTimeout > 0 {
+		return bkd.dialTimeout
+	}
+	return bkd.upstreamTimeout
+}
+
+// dialConn makes a TCP or Unix socket connection to an upstream or relay, within upstreamDialTimeout, with TCP
+// keepalive per upstream_keepalive, through upstream_proxy if set. With upstream_timeout, each read and write on the connection afterwards must
+// complete within it.
+func (bkd *Backend) dialConn(hostPort string) (net.Conn, error) {
+	d := net.Dialer{Timeout: bkd.upstreamDialTimeout(), KeepAlive: bkd.upstreamKeepAlive}
+	network, addr := "tcp", hostPort
+	if isUnixSocket(hostPort) {
+		network, addr = "unix", strings.TrimPrefix(hostPort, unixSocketPrefix)
+	}
+	var conn net.Conn
+	var err error
+	if bkd.upstreamProxy != nil && network == "tcp" {
+		conn, err = bkd.proxyDial(&d, addr)
+	} else {
+		conn, err = d.Dial(network, addr)
+	}
+	if err != nil || bkd.upstreamTimeout <= 0 {
+		return conn, err
+	}
+	return &deadlineConn{Conn: conn, timeout: bkd.upstreamTimeout}, nil
+}
+
+// deadlineConn sets a fresh deadline before each read and write, so a stalled upstream can't hold a session forever
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// outTLSConfig returns the TLS settings for the out_hostport upstream hostPort. Its certificate is verified against
+// upstream_expected_cert_name if set, rather than the host dialled, so the upstream can be addressed by IP.
+func (bkd *Backend) outTLSConfig(hostPort string) *tls.Config {
+	name := upstreamName(hostPort)
+	if bkd.upstreamCertName != "" {
+		name = bkd.upstreamCertName
+	}
+	return bkd.upstreamTLSConfig(name)
+}
+
+// upstreamExpired tells whether the session's upstream connection is older than upstream_conn_ttl
+func (s *Session) upstreamExpired() bool {
+	return s.bkd.upstreamTTL > 0 && s.upstream != nil && time.Since(s.upstreamSince) > s.bkd.upstreamTTL
+}
+
+// renewUpstream replaces the session's upstream connection with a fresh one, brought to the same state: greeted,
+// secured if the old one was, and authenticated if the old one was. On failure, the old connection is kept.
+func (s *Session) renewUpstream() error {
+	if s.authUser != "" && s.authReplay == nil {
+		return errors.New("can't repeat this session's AUTH exchange on a new connection")
+	}
+	if !s.bkd.dialLimiter.wait() {
+		return errors.New("upstream dial rate limit reached")
+	}
+	_, wasTLS := s.upstream.TLSConnectionState()
+	s.logger("---Renewing upstream connection, age", time.Since(s.upstreamSince).Round(time.Second))
+	c, hostPort, err := s.bkd.dialUpstream()
+	if err != nil {
+		return err
+	}
+	host := upstreamName(hostPort)
+	if _, _, err := c.Hello(host); err != nil {
+		c.Close()
+		return err
+	}
+	if err := s.sendXClient(c, host); err != nil {
+		c.Close()
+		return err
+	}
+	if wasTLS && !s.bkd.upstreamImplicitTLS {
+		if _, _, err := c.StartTLS(s.bkd.outTLSConfig(hostPort)); err != nil {
+			c.Close()
+			return err
+		}
+		s.bkd.noteUpstreamCert(host, c)
+	}
+	if s.authReplay != nil {
+		if code, msg, err := s.authReplay(c); err != nil {
+			c.Close()
+			log.Println("Upstream AUTH failed on renewed connection:", code, msg)
+			return err
+		}
+	}
+	old := s.upstream
+	s.upstream = c
+	s.upstreamHost = hostPort
+	s.upstreamSince = time.Now()
+	s.caps = c.Capabilities()
+	old.Quit()
+	return nil
+}
+
+// checkUpstreamAge renews the upstream connection if it has outlived upstream_conn_ttl. Call between transactions.
+func (s *Session) checkUpstreamAge() {
+	if !s.upstreamExpired() || s.blockUpstream {
+		return
+	}
+	if err := s.renewUpstream(); err != nil {
+		s.logger("\tUpstream connection renewal failed, continuing with existing connection:", err)
+	}
+}
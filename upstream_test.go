@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// relayOne runs a complete transaction for one recipient on the session
+func relayOne(t *testing.T, s *Session) {
+	t.Helper()
+	if code, msg, err := s.Mail(250, "MAIL", "FROM:<sender@example.com>"); err != nil {
+		t.Fatalf("MAIL: %d %s %v", code, msg, err)
+	}
+	if code, msg, err := s.Rcpt(250, "RCPT", "TO:<rcpt@example.net>"); err != nil {
+		t.Fatalf("RCPT: %d %s %v", code, msg, err)
+	}
+	if code, msg, err := sendMessage(t, s, testMessage); err != nil {
+		t.Fatalf("DATA: %d %s %v", code, msg, err)
+	}
+}
+
+func TestUpstreamConnTTL(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	f := newFakeUpstream(t, nil)
+	s := testSession(t, f, &Backend{upstreamTTL: ttl})
+	first := s.upstream
+
+	relayOne(t, s)
+	if s.upstream != first || f.connections() != 1 {
+		t.Fatalf("connection replaced before it expired")
+	}
+
+	time.Sleep(2 * ttl)
+	if !s.upstreamExpired() {
+		t.Fatal("upstreamExpired() = false after upstream_conn_ttl")
+	}
+	relayOne(t, s)
+	if s.upstream == first {
+		t.Error("aged upstream connection was reused for the next transaction")
+	}
+	if n := f.connections(); n != 2 {
+		t.Errorf("upstream saw %d connections, want 2", n)
+	}
+	if n := len(f.messages()); n != 2 {
+		t.Errorf("upstream received %d messages, want 2", n)
+	}
+	if n := len(f.commands("QUIT")); n != 1 {
+		t.Errorf("upstream saw %d QUIT commands, want 1 for the old connection", n)
+	}
+}
+
+func TestUpstreamConnTTLOff(t *testing.T) {
+	f := newFakeUpstream(t, nil)
+	s := testSession(t, f, nil)
+	first := s.upstream
+	relayOne(t, s)
+	relayOne(t, s)
+	if s.upstream != first || f.connections() != 1 {
+		t.Error("connection replaced without upstream_conn_ttl")
+	}
+}
+
+// testCert returns a self-signed certificate for 127.0.0.1, and a pool that trusts it
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake.example"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestUpstreamImplicitTLS(t *testing.T) {
+	cert, pool := testCert(t)
+	f := newFakeUpstream(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	s := testSession(t, f, &Backend{upstreamImplicitTLS: true, upstreamCAs: pool})
+
+	if _, isTLS := s.upstream.TLSConnectionState(); !isTLS {
+		t.Fatal("upstream connection is not TLS")
+	}
+	relayOne(t, s)
+	if n := len(f.messages()); n != 1 {
+		t.Errorf("upstream received %d messages, want 1", n)
+	}
+	if n := len(f.commands("STARTTLS")); n != 0 {
+		t.Errorf("upstream saw %d STARTTLS commands, want none", n)
+	}
+}
+
+func TestUpstreamImplicitTLSUntrusted(t *testing.T) {
+	cert, _ := testCert(t)
+	f := newFakeUpstream(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	_, otherPool := testCert(t)
+	bkd := &Backend{upstreamImplicitTLS: true, upstreamCAs: otherPool, upstreams: newUpstreamSet(f.addr)}
+	if _, _, err := bkd.dialUpstream(); err == nil {
+		t.Error("dial succeeded with an untrusted upstream certificate")
+	}
+}
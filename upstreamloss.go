@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"syscall"
+)
+
+//-----------------------------------------------------------------------------
+// Upstream connection loss
+//
+// If the upstream connection breaks (closed, reset, or timed out) while a command is relayed, the client gets a clean
+// 451 rather than a raw I/O error. With upstream_reconnect, a break at MAIL FROM, RCPT TO or DATA is instead repaired
+// once per transaction: a new upstream connection is made as for upstream_conn_ttl (greeted, secured and
+// authenticated as the old one was), MAIL FROM and the recipients accepted so far are replayed, then the command is
+// sent again. Recipients the new connection refuses are dropped, and counted in the final response as for
+// pipeline_rcpt. Messages held until DATA are left to data_retries.
+//-----------------------------------------------------------------------------
+
+const upstreamLostCode = 451
+const upstreamLostMsg = "4.4.2 Upstream connection lost, try again later"
+
+// upstreamLost tells whether err means the upstream connection is broken, rather than being an SMTP reply
+func upstreamLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// canReconnect tells whether a break while relaying cmd may be repaired with upstream_reconnect
+func (s *Session) canReconnect(cmd string) bool {
+	if !s.bkd.upstreamReconnect || s.reconnected || s.holding() || s.bkd.sink {
+		return false
+	}
+	return strings.EqualFold(cmd, "MAIL") || strings.EqualFold(cmd, "RCPT") || strings.EqualFold(cmd, "DATA")
+}
+
+// reconnectUpstream replaces a broken upstream connection, and replays the transaction so far on the new one
+func (s *Session) reconnectUpstream() error {
+	s.reconnected = true
+	if err := s.renewUpstream(); err != nil {
+		return err
+	}
+	if !s.inTransaction || s.mailDeferred {
+		return nil
+	}
+	rcpts := s.defaultRcpts()
+	from := s.mailfrom
+	if s.bkd.verp != "" && from != "" && len(rcpts) == 1 {
+		from = verpAddress(s.bkd.verp, s.mailfrom, rcpts[0])
+	}
+	if code, msg, err := s.Passthru(250, "MAIL", "FROM:<"+from+">"+s.mailParams); err != nil {
+		return fmt.Errorf("MAIL FROM replay refused: %d %s", code, msg)
+	}
+	if len(rcpts) == 0 {
+		return nil
+	}
+	accepted, code, msg, _ := s.sendRcpts(rcpts)
+	if len(accepted) == 0 {
+		return fmt.Errorf("RCPT TO replay refused: %d %s", code, msg)
+	}
+	refused := make(map[string]bool)
+	for _, r := range rcpts {
+		refused[r] = true
+	}
+	for _, r := range accepted {
+		delete(refused, r)
+	}
+	var kept []string
+	for _, r := range s.rcptto {
+		if !refused[r] {
+			kept = append(kept, r)
+		}
+	}
+	s.rcptto = kept
+	s.refusedRcpts += len(refused)
+	return nil
+}
+
+// onUpstreamLost handles a broken upstream connection found while relaying cmd (joined with its argument), trying the
+// command again on a new connection if upstream_reconnect allows
+func (s *Session) onUpstreamLost(expectcode int, cmd, joined string, err error) (int, string, error) {
+	s.logger("\tUpstream connection lost:", err)
+	if s.canReconnect(cmd) {
+		if rerr := s.reconnectUpstream(); rerr != nil {
+			s.logger("\tUpstream reconnect failed:", rerr)
+		} else {
+			s.logger(cmdTwiddle(s), joined, "(after reconnect)")
+			code, msg, err := s.upstream.MyCmd(expectcode, joined)
+			if !upstreamLost(err) {
+				return code, msg, err
+			}
+		}
+	}
+	return upstreamLostCode, upstreamLostMsg, errors.New(upstreamLostMsg)
+}
+
+// dataAfterLoss handles a broken upstream connection found at DATA, issuing it again on a new connection if
+// upstream_reconnect allows
+func (s *Session) dataAfterLoss(err error) (io.WriteCloser, int, string, error) {
+	s.logger("\tUpstream connection lost:", err)
+	if s.canReconnect("DATA") {
+		if rerr := s.reconnectUpstream(); rerr != nil {
+			s.logger("\tUpstream reconnect failed:", rerr)
+		} else if code, msg, err := s.addArchiveRcpt(); code != 0 {
+			return nil, code, msg, err
+		} else {
+			s.logger(cmdTwiddle(s), "DATA", "(after reconnect)")
+			w, code, msg, err := s.upstream.Data()
+			if !upstreamLost(err) {
+				return w, code, msg, err
+			}
+		}
+	}
+	return nil, upstreamLostCode, upstreamLostMsg, errors.New(upstreamLostMsg)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+//-----------------------------------------------------------------------------
+// Outbound proxy
+//
+// With upstream_proxy, TCP connections to upstreams and relays are made through a SOCKS5 proxy (socks5://host:port)
+// or an HTTP proxy's CONNECT tunnel (http://host:port), with optional user:pass@ credentials in the URL. The upstream's
+// host name is passed to the proxy to resolve, and TLS (STARTTLS or upstream_implicit_tls) runs end to end inside the
+// tunnel, so the certificate is still verified against the upstream's name, never the proxy's. Unix socket upstreams
+// are local, so are dialled directly.
+//-----------------------------------------------------------------------------
+
+// Default proxy ports, when the URL doesn't give one
+const socks5DefaultPort = "1080"
+const httpProxyDefaultPort = "8080"
+
+// parseUpstreamProxy checks an upstream_proxy URL
+func parseUpstreamProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	var port string
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		port = socks5DefaultPort
+	case "http":
+		port = httpProxyDefaultPort
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, want socks5 or http", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no proxy host in %q", u.Redacted())
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// proxyDial connects to addr through the upstream_proxy, using d to reach the proxy. The whole exchange with the proxy
+// must complete within d's timeout.
+func (bkd *Backend) proxyDial(d *net.Dialer, addr string) (net.Conn, error) {
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if bkd.upstreamProxy.Scheme == "http" {
+		return bkd.connectTunnel(ctx, d, addr)
+	}
+	var auth *proxy.Auth
+	if u := bkd.upstreamProxy.User; u != nil {
+		pass, _ := u.Password()
+		auth = &proxy.Auth{User: u.Username(), Password: pass}
+	}
+	dialer, err := proxy.SOCKS5("tcp", bkd.upstreamProxy.Host, auth, d)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("upstream_proxy: %v", err)
+	}
+	return conn, nil
+}
+
+// connectTunnel opens an HTTP CONNECT tunnel to addr
+func (bkd *Backend) connectTunnel(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", bkd.upstreamProxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := bkd.upstreamProxy.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream_proxy: CONNECT %s refused: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads through r first, which may already hold the start of the upstream's greeting, read along with
+// the proxy's response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+//-----------------------------------------------------------------------------
+// XCLIENT
+//
+// With xclient, if the upstream offers the XCLIENT extension (as Postfix does, to trusted clients), the proxy tells it
+// the original client's address and name after each upstream greeting, so its logs and policy checks see the real
+// client rather than the proxy. The client's login name is included when already known, e.g. on a renewed upstream
+// connection. Only the attributes the upstream lists are sent. XCLIENT resets the upstream session, so EHLO is
+// repeated after it.
+//
+// With forward_helo, the name the client gave in EHLO / HELO is sent as HELO=, and used for the repeated EHLO, so the
+// upstream sees the client's own greeting. It's also shown in the Received header.
+//-----------------------------------------------------------------------------
+
+const xclientUnavailable = "[UNAVAILABLE]"
+
+// xclientAttrs returns the XCLIENT attributes describing the session's client
+func (s *Session) xclientAttrs() map[string]string {
+	a := map[string]string{"NAME": xclientUnavailable, "ADDR": xclientUnavailable, "PROTO": "SMTP"}
+	ip := remoteHost(s.remoteAddr)
+	if parsed := net.ParseIP(ip); parsed != nil {
+		a["ADDR"] = ip
+		if parsed.To4() == nil {
+			a["ADDR"] = "IPV6:" + ip
+		}
+		if s.bkd.fcrdns != fcrdnsOff {
+			if ok, name := s.bkd.fcrdnsCache.check(ip); ok {
+				a["NAME"] = strings.TrimSuffix(name, ".")
+			}
+		}
+	}
+	if s.ehlo {
+		a["PROTO"] = "ESMTP"
+	}
+	if s.authUser != "" {
+		a["LOGIN"] = s.authUser
+	}
+	if s.heloName != "" {
+		a["HELO"] = s.heloName
+	}
+	return a
+}
+
+// xtext encodes an XCLIENT attribute value (RFC 3461 section 4)
+func xtext(v string) string {
+	var b strings.Builder
+	for _, c := range []byte(v) {
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// sendXClient passes the client's identity to a freshly greeted upstream connection, if enabled and offered, and
+// greets the upstream again as XCLIENT requires
+func (s *Session) sendXClient(c *smtpproxy.Client, host string) error {
+	if !s.bkd.xclient {
+		return nil
+	}
+	ok, params := capability(c.Capabilities(), "XCLIENT")
+	if !ok {
+		s.logger("\tUpstream does not offer XCLIENT")
+		return nil
+	}
+	supported := strings.Fields(strings.ToUpper(params))
+	attrs := s.xclientAttrs()
+	var args []string
+	for _, name := range []string{"NAME", "ADDR", "PROTO", "HELO", "LOGIN"} {
+		if v, ok := attrs[name]; ok && Contains(supported, name) {
+			args = append(args, name+"="+xtext(v))
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	cmd := "XCLIENT " + strings.Join(args, " ")
+	s.logger(cmdTwiddle(s), cmd)
+	code, msg, err := c.MyCmd(220, "%s", cmd)
+	s.logger(respTwiddle(s), code, msg)
+	if err != nil {
+		return fmt.Errorf("XCLIENT: %d %s %v", code, msg, err)
+	}
+	if s.heloName != "" {
+		host = s.heloName
+	}
+	if code, msg, err := c.MyCmd(250, "EHLO %s", host); err != nil {
+		return fmt.Errorf("EHLO after XCLIENT: %d %s %v", code, msg, err)
+	}
+	return nil
+}